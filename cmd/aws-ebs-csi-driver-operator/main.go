@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
 	"github.com/spf13/cobra"
@@ -10,6 +13,7 @@ import (
 
 	"github.com/openshift/aws-ebs-csi-driver-operator/pkg/operator"
 	"github.com/openshift/aws-ebs-csi-driver-operator/pkg/version"
+	"github.com/openshift/aws-ebs-csi-driver-operator/pkg/webhook"
 )
 
 func main() {
@@ -43,10 +47,35 @@ func NewOperatorCommand() *cobra.Command {
 	ctrlCmd.Short = "Start the AWS EBS CSI Driver Operator"
 
 	cmd.AddCommand(ctrlCmd)
+	cmd.AddCommand(NewWebhookCommand())
 
 	return cmd
 }
 
+func NewWebhookCommand() *cobra.Command {
+	options := webhook.Options{}
+	var policy string
+	cmd := &cobra.Command{
+		Use:   "webhook",
+		Short: "Start the StorageClass validating admission webhook",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			options.Policy, err = webhook.ParsePolicy(policy)
+			if err != nil {
+				return fmt.Errorf("invalid --policy: %w", err)
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+			return webhook.Run(ctx, options)
+		},
+	}
+	cmd.Flags().IntVar(&options.Port, "port", 8443, "HTTPS port of the webhook.")
+	cmd.Flags().StringVar(&options.CertFile, "tls-cert-file", "", "Path to the serving certificate.")
+	cmd.Flags().StringVar(&options.KeyFile, "tls-private-key-file", "", "Path to the private key of the serving certificate.")
+	cmd.Flags().StringVar(&policy, "policy", "{}", "JSON policy of the StorageClasses.")
+	return cmd
+}
+
 func runOperatorWithGuestKubeconfig(ctx context.Context, controllerConfig *controllercmd.ControllerContext) error {
 	return operator.RunOperator(ctx, controllerConfig, *guestKubeconfig)
 }
@@ -0,0 +1,233 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	// attachCapacityThresholdAnnotation on the ClusterCSIDriver is the percentage of the allocatable
+	// EBS attachments of a node above which the node is reported, e.g. "90". Defaults to 80.
+	attachCapacityThresholdAnnotation = "ebs.csi.openshift.io/attach-capacity-threshold"
+	defaultAttachCapacityThreshold    = 80
+
+	// attachCapacityConditionType does not use a Degraded suffix, a full node is not an operator failure.
+	attachCapacityConditionType = "AWSEBSAttachCapacityThresholdExceeded"
+)
+
+var (
+	attachedVolumesMetric = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      "aws_ebs_csi_driver_operator",
+			Name:           "node_attached_volumes",
+			Help:           "Number of EBS VolumeAttachments of a node.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node"},
+	)
+	allocatableVolumesMetric = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      "aws_ebs_csi_driver_operator",
+			Name:           "node_allocatable_volumes",
+			Help:           "Number of EBS volumes that can be attached to a node, as reported in its CSINode.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(attachedVolumesMetric, allocatableVolumesMetric)
+}
+
+// nodeAttachCapacity is the number of EBS volumes attached to a node and its allocatable count.
+type nodeAttachCapacity struct {
+	node        string
+	attached    int32
+	allocatable int32
+}
+
+func (n nodeAttachCapacity) String() string {
+	return fmt.Sprintf("%s (%d/%d)", n.node, n.attached, n.allocatable)
+}
+
+// overThreshold returns true when the node uses more than threshold percent of its allocatable attachments.
+func (n nodeAttachCapacity) overThreshold(threshold int) bool {
+	return int64(n.attached)*100 > int64(n.allocatable)*int64(threshold)
+}
+
+// getAttachCapacityThreshold parses the attachCapacityThresholdAnnotation of the ClusterCSIDriver.
+func getAttachCapacityThreshold(ccdLister oplisterv1.ClusterCSIDriverLister) (int, error) {
+	ccd, err := ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return 0, err
+	}
+	value, ok := ccd.Annotations[attachCapacityThresholdAnnotation]
+	if !ok {
+		return defaultAttachCapacityThreshold, nil
+	}
+	threshold, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the %s annotation: %w", attachCapacityThresholdAnnotation, err)
+	}
+	if threshold < 1 || threshold > 100 {
+		return 0, fmt.Errorf("invalid %s annotation %d: must be between 1 and 100", attachCapacityThresholdAnnotation, threshold)
+	}
+	return threshold, nil
+}
+
+// attachCapacityController compares the EBS VolumeAttachments of each node with the allocatable
+// count in its CSINode. It exports both as metrics, emits events when a node crosses the threshold
+// and reports the nodes over the threshold in the AWSEBSAttachCapacityThresholdExceeded condition.
+type attachCapacityController struct {
+	operatorClient         v1helpers.OperatorClient
+	ccdLister              oplisterv1.ClusterCSIDriverLister
+	csiNodeLister          storagev1listers.CSINodeLister
+	volumeAttachmentLister storagev1listers.VolumeAttachmentLister
+	// nodesOverThreshold are the nodes reported in the last sync, to emit events only when a node crosses the threshold.
+	nodesOverThreshold sets.Set[string]
+}
+
+func newAttachCapacityController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	csiNodeLister storagev1listers.CSINodeLister,
+	volumeAttachmentLister storagev1listers.VolumeAttachmentLister,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &attachCapacityController{
+		operatorClient:         operatorClient,
+		ccdLister:              ccdLister,
+		csiNodeLister:          csiNodeLister,
+		volumeAttachmentLister: volumeAttachmentLister,
+		nodesOverThreshold:     sets.New[string](),
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		resync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *attachCapacityController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	threshold, err := getAttachCapacityThreshold(c.ccdLister)
+	if err != nil {
+		return err
+	}
+	capacities, err := c.getNodeAttachCapacities()
+	if err != nil {
+		return err
+	}
+
+	// Drop the series of deleted nodes.
+	attachedVolumesMetric.Reset()
+	allocatableVolumesMetric.Reset()
+	var overThreshold []nodeAttachCapacity
+	nodesOverThreshold := sets.New[string]()
+	for _, capacity := range capacities {
+		attachedVolumesMetric.WithLabelValues(capacity.node).Set(float64(capacity.attached))
+		allocatableVolumesMetric.WithLabelValues(capacity.node).Set(float64(capacity.allocatable))
+
+		if !capacity.overThreshold(threshold) {
+			if c.nodesOverThreshold.Has(capacity.node) {
+				syncCtx.Recorder().Eventf("AttachCapacityRecovered", "Node %s uses %d of %d EBS attachments", capacity.node, capacity.attached, capacity.allocatable)
+			}
+			continue
+		}
+		overThreshold = append(overThreshold, capacity)
+		nodesOverThreshold.Insert(capacity.node)
+		if !c.nodesOverThreshold.Has(capacity.node) {
+			syncCtx.Recorder().Warningf("AttachCapacityThresholdExceeded", "Node %s uses %d of %d EBS attachments, more than %d%%",
+				capacity.node, capacity.attached, capacity.allocatable, threshold)
+		}
+	}
+	c.nodesOverThreshold = nodesOverThreshold
+
+	condition := opv1.OperatorCondition{
+		Type:    attachCapacityConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: fmt.Sprintf("All %d nodes use at most %d%% of their EBS attachments", len(capacities), threshold),
+	}
+	if len(overThreshold) > 0 {
+		names := make([]string, 0, len(overThreshold))
+		for _, capacity := range overThreshold {
+			names = append(names, capacity.String())
+		}
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "ThresholdExceeded"
+		condition.Message = fmt.Sprintf("%d nodes use more than %d%% of their EBS attachments: %s",
+			len(overThreshold), threshold, formatNodeNames(names))
+	}
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// getNodeAttachCapacities returns the attach capacity of the nodes with an allocatable count
+// for the driver in their CSINode, sorted by node name.
+func (c *attachCapacityController) getNodeAttachCapacities() ([]nodeAttachCapacity, error) {
+	volumeAttachments, err := c.volumeAttachmentLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	attached := map[string]int32{}
+	for _, volumeAttachment := range volumeAttachments {
+		if volumeAttachment.Spec.Attacher != string(opv1.AWSEBSCSIDriver) {
+			continue
+		}
+		// Attachments in progress already take a slot.
+		attached[volumeAttachment.Spec.NodeName]++
+	}
+
+	csiNodes, err := c.csiNodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var capacities []nodeAttachCapacity
+	for _, csiNode := range csiNodes {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name != string(opv1.AWSEBSCSIDriver) || driver.Allocatable == nil || driver.Allocatable.Count == nil {
+				continue
+			}
+			capacities = append(capacities, nodeAttachCapacity{
+				node:        csiNode.Name,
+				attached:    attached[csiNode.Name],
+				allocatable: *driver.Allocatable.Count,
+			})
+		}
+	}
+	sort.Slice(capacities, func(i, j int) bool {
+		return capacities[i].node < capacities[j].node
+	})
+	return capacities, nil
+}
@@ -0,0 +1,178 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/utils/pointer"
+)
+
+func TestAttachCapacityControllerSync(t *testing.T) {
+	newCSINode := func(name string, allocatable int32) *storagev1.CSINode {
+		return &storagev1.CSINode{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.CSINodeSpec{
+				Drivers: []storagev1.CSINodeDriver{
+					{Name: "other.csi.example.com", Allocatable: &storagev1.VolumeNodeResources{Count: pointer.Int32(100)}},
+					{Name: provisionerName, Allocatable: &storagev1.VolumeNodeResources{Count: pointer.Int32(allocatable)}},
+				},
+			},
+		}
+	}
+	newVolumeAttachments := func(node, attacher string, count int) []*storagev1.VolumeAttachment {
+		var volumeAttachments []*storagev1.VolumeAttachment
+		for i := 0; i < count; i++ {
+			volumeAttachments = append(volumeAttachments, &storagev1.VolumeAttachment{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%s-%d", node, attacher, i)},
+				Spec:       storagev1.VolumeAttachmentSpec{Attacher: attacher, NodeName: node},
+			})
+		}
+		return volumeAttachments
+	}
+
+	kubeClient := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	csiNodeIndexer := informerFactory.Storage().V1().CSINodes().Informer().GetIndexer()
+	volumeAttachmentIndexer := informerFactory.Storage().V1().VolumeAttachments().Informer().GetIndexer()
+	csiNodeIndexer.Add(newCSINode("node-a", 10))
+	csiNodeIndexer.Add(newCSINode("node-b", 25))
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&opv1.OperatorSpec{ManagementState: opv1.Managed},
+		&opv1.OperatorStatus{},
+		nil,
+	)
+	ccd := &opv1.ClusterCSIDriver{ObjectMeta: metav1.ObjectMeta{
+		Name:        provisionerName,
+		Annotations: map[string]string{attachCapacityThresholdAnnotation: "90"},
+	}}
+	c := &attachCapacityController{
+		operatorClient:         operatorClient,
+		ccdLister:              &fakeCCDLister{ccd},
+		csiNodeLister:          informerFactory.Storage().V1().CSINodes().Lister(),
+		volumeAttachmentLister: informerFactory.Storage().V1().VolumeAttachments().Lister(),
+	}
+
+	steps := []struct {
+		name              string
+		volumeAttachments map[string]int
+		expectedStatus    opv1.ConditionStatus
+		expectedReason    string
+		expectedEvents    []string
+		expectedAttached  map[string]float64
+	}{
+		{
+			name:              "below threshold",
+			volumeAttachments: map[string]int{"node-a": 9, "node-b": 5},
+			expectedStatus:    opv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedAttached:  map[string]float64{"node-a": 9, "node-b": 5},
+		},
+		{
+			name:              "node crosses threshold",
+			volumeAttachments: map[string]int{"node-a": 10, "node-b": 5},
+			expectedStatus:    opv1.ConditionTrue,
+			expectedReason:    "ThresholdExceeded",
+			expectedEvents:    []string{"AttachCapacityThresholdExceeded"},
+			expectedAttached:  map[string]float64{"node-a": 10, "node-b": 5},
+		},
+		{
+			name:              "node stays over threshold",
+			volumeAttachments: map[string]int{"node-a": 10, "node-b": 6},
+			expectedStatus:    opv1.ConditionTrue,
+			expectedReason:    "ThresholdExceeded",
+			expectedAttached:  map[string]float64{"node-a": 10, "node-b": 6},
+		},
+		{
+			name:              "node recovers",
+			volumeAttachments: map[string]int{"node-a": 2},
+			expectedStatus:    opv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedEvents:    []string{"AttachCapacityRecovered"},
+			expectedAttached:  map[string]float64{"node-a": 2, "node-b": 0},
+		},
+	}
+	for _, step := range steps {
+		for _, obj := range volumeAttachmentIndexer.List() {
+			volumeAttachmentIndexer.Delete(obj)
+		}
+		for node, count := range step.volumeAttachments {
+			for _, volumeAttachment := range newVolumeAttachments(node, provisionerName, count) {
+				volumeAttachmentIndexer.Add(volumeAttachment)
+			}
+			// Attachments of other drivers don't count.
+			for _, volumeAttachment := range newVolumeAttachments(node, "other.csi.example.com", 5) {
+				volumeAttachmentIndexer.Add(volumeAttachment)
+			}
+		}
+
+		recorder := events.NewInMemoryRecorder("test")
+		if err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+
+		_, status, _, _ := operatorClient.GetOperatorState()
+		condition := v1helpers.FindOperatorCondition(status.Conditions, attachCapacityConditionType)
+		if condition == nil {
+			t.Fatalf("%s: condition %s not found", step.name, attachCapacityConditionType)
+		}
+		if condition.Status != step.expectedStatus || condition.Reason != step.expectedReason {
+			t.Errorf("%s: expected %s/%s, got %s/%s: %s", step.name, step.expectedStatus, step.expectedReason, condition.Status, condition.Reason, condition.Message)
+		}
+		var reasons []string
+		for _, event := range recorder.Events() {
+			reasons = append(reasons, event.Reason)
+		}
+		if fmt.Sprint(reasons) != fmt.Sprint(step.expectedEvents) {
+			t.Errorf("%s: expected events %v, got %v", step.name, step.expectedEvents, reasons)
+		}
+		for node, expected := range step.expectedAttached {
+			value, err := testutil.GetGaugeMetricValue(attachedVolumesMetric.WithLabelValues(node))
+			if err != nil {
+				t.Fatalf("%s: failed to get metric: %v", step.name, err)
+			}
+			if value != expected {
+				t.Errorf("%s: expected %v attached volumes on %s, got %v", step.name, expected, node, value)
+			}
+		}
+	}
+	if value, _ := testutil.GetGaugeMetricValue(allocatableVolumesMetric.WithLabelValues("node-b")); value != 25 {
+		t.Errorf("expected 25 allocatable volumes on node-b, got %v", value)
+	}
+}
+
+func TestGetAttachCapacityThreshold(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		expected    int
+		expectError bool
+	}{
+		{expected: 80},
+		{annotations: map[string]string{attachCapacityThresholdAnnotation: "95"}, expected: 95},
+		{annotations: map[string]string{attachCapacityThresholdAnnotation: "0"}, expectError: true},
+		{annotations: map[string]string{attachCapacityThresholdAnnotation: "101"}, expectError: true},
+		{annotations: map[string]string{attachCapacityThresholdAnnotation: "90%"}, expectError: true},
+	}
+	for _, test := range tests {
+		ccdLister := &fakeCCDLister{&opv1.ClusterCSIDriver{
+			ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+		}}
+		threshold, err := getAttachCapacityThreshold(ccdLister)
+		if (err != nil) != test.expectError {
+			t.Errorf("%v: unexpected error: %v", test.annotations, err)
+		}
+		if err == nil && threshold != test.expected {
+			t.Errorf("%v: expected %d, got %d", test.annotations, test.expected, threshold)
+		}
+	}
+}
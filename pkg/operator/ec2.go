@@ -0,0 +1,234 @@
+package operator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeclient "k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	awsAccessKeyIDKey     = "aws_access_key_id"
+	awsSecretAccessKeyKey = "aws_secret_access_key"
+	awsRoleARNKey         = "role_arn"
+
+	// webIdentityTokenLifetime is the lifetime of the ServiceAccount tokens the operator exchanges
+	// for AWS credentials. It is the shortest lifetime the TokenRequest API accepts.
+	webIdentityTokenLifetime = 10 * time.Minute
+)
+
+// errNoAWSCredentials is returned when the cloud credentials Secret contains neither a static access key
+// nor a role to assume with web identity.
+var errNoAWSCredentials = errors.New("the cloud credentials contain neither a static AWS access key nor a web identity role")
+
+// ec2ClientConfig holds everything needed to talk to EC2 the same way the driver does.
+type ec2ClientConfig struct {
+	region          string
+	endpoint        string
+	stsEndpoint     string
+	caBundle        []byte
+	accessKeyID     string
+	secretAccessKey string
+	// roleARN is the role assumed with web identity when the Secret has no static access key.
+	roleARN        string
+	tokenRetriever stscreds.IdentityTokenRetriever
+}
+
+// serviceAccountTokenRetriever creates tokens of the driver controller ServiceAccount with the audience
+// of the token in web_identity_token_file, so the operator assumes the driver role as the driver does.
+type serviceAccountTokenRetriever struct {
+	kubeClient     kubeclient.Interface
+	namespace      string
+	serviceAccount string
+}
+
+var _ stscreds.IdentityTokenRetriever = &serviceAccountTokenRetriever{}
+
+func (r *serviceAccountTokenRetriever) GetIdentityToken() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	expirationSeconds := int64(webIdentityTokenLifetime.Seconds())
+	tokenRequest, err := r.kubeClient.CoreV1().ServiceAccounts(r.namespace).CreateToken(ctx, r.serviceAccount, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         []string{webIdentityAudience},
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a token for ServiceAccount %s/%s: %w", r.namespace, r.serviceAccount, err)
+	}
+	return []byte(tokenRequest.Status.Token), nil
+}
+
+// getEC2ClientConfig collects the region, EC2 and STS endpoint overrides and custom CA bundle given to
+// the driver by withAWSRegion, withCustomEndPoint and withCustomAWSCABundle, and the credentials from the
+// cloud credentials Secret. The Secret has either a static access key, or an AWS config file with the
+// role the driver assumes with web identity; tokenRetriever provides the web identity token then.
+func getEC2ClientConfig(
+	infraLister v1.InfrastructureLister,
+	secretLister corev1listers.SecretNamespaceLister,
+	cloudConfigLister corev1listers.ConfigMapNamespaceLister,
+	isHypershift bool,
+	tokenRetriever stscreds.IdentityTokenRetriever,
+) (*ec2ClientConfig, error) {
+	infra, err := infraLister.Get(infrastructureName)
+	if err != nil {
+		return nil, err
+	}
+	if infra.Status.PlatformStatus == nil || infra.Status.PlatformStatus.AWS == nil || infra.Status.PlatformStatus.AWS.Region == "" {
+		return nil, fmt.Errorf("AWS region is not set in the Infrastructure %s", infrastructureName)
+	}
+	cfg := &ec2ClientConfig{
+		region:         infra.Status.PlatformStatus.AWS.Region,
+		tokenRetriever: tokenRetriever,
+	}
+
+	endpoints, err := getServiceEndpoints(infraLister)
+	if err != nil {
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		switch endpoint.Name {
+		case "ec2":
+			cfg.endpoint = endpoint.URL
+		case "sts":
+			cfg.stsEndpoint = endpoint.URL
+		}
+	}
+
+	cfg.caBundle, err = customAWSCABundleData(isHypershift, cloudConfigLister)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := secretLister.Get(cloudCredSecretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the %s Secret: %w", cloudCredSecretName, err)
+	}
+	cfg.accessKeyID = string(secret.Data[awsAccessKeyIDKey])
+	cfg.secretAccessKey = string(secret.Data[awsSecretAccessKeyKey])
+	if cfg.accessKeyID != "" && cfg.secretAccessKey != "" {
+		return cfg, nil
+	}
+	cfg.roleARN = parseAWSConfigValue(secret.Data[awsCredentialsKey], awsRoleARNKey)
+	if cfg.roleARN == "" || tokenRetriever == nil {
+		return nil, errNoAWSCredentials
+	}
+	return cfg, nil
+}
+
+// parseAWSConfigValue returns the value of key in the default profile of an AWS config file,
+// or "" when it is not set.
+func parseAWSConfigValue(config []byte, key string) string {
+	inDefault := false
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inDefault = line == "[default]" || line == "[profile default]"
+			continue
+		}
+		if !inDefault {
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(name) == key {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func newEC2Client(cfg *ec2ClientConfig) (*ec2.Client, error) {
+	httpClient := awshttp.NewBuildableClient()
+	if len(cfg.caBundle) > 0 {
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(cfg.caBundle) {
+			return nil, fmt.Errorf("failed to parse the custom AWS CA bundle")
+		}
+		httpClient = httpClient.WithTransportOptions(func(transport *http.Transport) {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+			}
+			transport.TLSClientConfig.RootCAs = rootCAs
+		})
+	}
+	awsConfig := aws.Config{
+		Region:     cfg.region,
+		HTTPClient: httpClient,
+	}
+
+	if cfg.roleARN != "" {
+		stsClient := sts.NewFromConfig(awsConfig, func(o *sts.Options) {
+			if cfg.stsEndpoint != "" {
+				o.BaseEndpoint = aws.String(cfg.stsEndpoint)
+			}
+		})
+		awsConfig.Credentials = aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(stsClient, cfg.roleARN, cfg.tokenRetriever))
+	} else {
+		awsConfig.Credentials = credentials.NewStaticCredentialsProvider(cfg.accessKeyID, cfg.secretAccessKey, "")
+	}
+
+	return ec2.NewFromConfig(awsConfig, func(o *ec2.Options) {
+		if cfg.endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.endpoint)
+		}
+	}), nil
+}
+
+// ec2ClientFunc returns a function that creates an EC2 client from the current cluster configuration,
+// see getEC2ClientConfig.
+func ec2ClientFunc(
+	infraLister v1.InfrastructureLister,
+	secretLister corev1listers.SecretNamespaceLister,
+	cloudConfigLister corev1listers.ConfigMapNamespaceLister,
+	isHypershift bool,
+	tokenRetriever stscreds.IdentityTokenRetriever,
+) func() (*ec2.Client, error) {
+	return func() (*ec2.Client, error) {
+		cfg, err := getEC2ClientConfig(infraLister, secretLister, cloudConfigLister, isHypershift, tokenRetriever)
+		if err != nil {
+			return nil, err
+		}
+		return newEC2Client(cfg)
+	}
+}
+
+// ec2ClientForEndpointFunc is like ec2ClientFunc, but the returned function replaces the EC2 endpoint
+// of the cluster configuration when called with a non-empty endpoint.
+func ec2ClientForEndpointFunc(
+	infraLister v1.InfrastructureLister,
+	secretLister corev1listers.SecretNamespaceLister,
+	cloudConfigLister corev1listers.ConfigMapNamespaceLister,
+	isHypershift bool,
+	tokenRetriever stscreds.IdentityTokenRetriever,
+) func(endpoint string) (*ec2.Client, error) {
+	return func(endpoint string) (*ec2.Client, error) {
+		cfg, err := getEC2ClientConfig(infraLister, secretLister, cloudConfigLister, isHypershift, tokenRetriever)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint != "" {
+			cfg.endpoint = endpoint
+		}
+		return newEC2Client(cfg)
+	}
+}
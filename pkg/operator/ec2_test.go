@@ -0,0 +1,178 @@
+package operator
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	fakecore "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+const testRoleARN = "arn:aws:iam::123456789012:role/ebs-csi-driver"
+
+type fakeTokenRetriever struct{}
+
+func (fakeTokenRetriever) GetIdentityToken() ([]byte, error) {
+	return []byte("web-identity-token"), nil
+}
+
+func TestGetEC2ClientConfig(t *testing.T) {
+	tests := []struct {
+		name              string
+		secretData        map[string][]byte
+		expectedKeyID     string
+		expectedRoleARN   string
+		expectedNoCredErr bool
+	}{
+		{
+			name: "static credentials",
+			secretData: map[string][]byte{
+				awsAccessKeyIDKey:     []byte("id"),
+				awsSecretAccessKeyKey: []byte("secret"),
+			},
+			expectedKeyID: "id",
+		},
+		{
+			name: "web identity",
+			secretData: map[string][]byte{
+				awsCredentialsKey: renderWebIdentityCredentials(testRoleARN),
+			},
+			expectedRoleARN: testRoleARN,
+		},
+		{
+			name: "web identity with regional STS endpoints",
+			secretData: map[string][]byte{
+				awsCredentialsKey: []byte("[default]\nsts_regional_endpoints = regional\nrole_arn = " + testRoleARN + "\nweb_identity_token_file = /token\n"),
+			},
+			expectedRoleARN: testRoleARN,
+		},
+		{
+			name: "role of another profile",
+			secretData: map[string][]byte{
+				awsCredentialsKey: []byte("[profile other]\nrole_arn = " + testRoleARN + "\n"),
+			},
+			expectedNoCredErr: true,
+		},
+		{
+			name:              "no credentials",
+			secretData:        map[string][]byte{},
+			expectedNoCredErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeInformerFactory := kubeinformers.NewSharedInformerFactory(fakecore.NewSimpleClientset(), 0)
+			kubeInformerFactory.Core().V1().Secrets().Informer().GetIndexer().Add(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: cloudCredSecretName, Namespace: defaultNamespace},
+				Data:       test.secretData,
+			})
+
+			cfg, err := getEC2ClientConfig(
+				newInfraLister("us-east-1"),
+				kubeInformerFactory.Core().V1().Secrets().Lister().Secrets(defaultNamespace),
+				kubeInformerFactory.Core().V1().ConfigMaps().Lister().ConfigMaps(defaultNamespace),
+				false,
+				fakeTokenRetriever{},
+			)
+			if test.expectedNoCredErr {
+				if !errors.Is(err, errNoAWSCredentials) {
+					t.Fatalf("expected errNoAWSCredentials, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.region != "us-east-1" {
+				t.Errorf("expected region us-east-1, got %q", cfg.region)
+			}
+			if cfg.accessKeyID != test.expectedKeyID {
+				t.Errorf("expected access key ID %q, got %q", test.expectedKeyID, cfg.accessKeyID)
+			}
+			if cfg.roleARN != test.expectedRoleARN {
+				t.Errorf("expected role ARN %q, got %q", test.expectedRoleARN, cfg.roleARN)
+			}
+		})
+	}
+}
+
+func TestEC2ClientWebIdentity(t *testing.T) {
+	var assumedRole, usedToken string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.Form.Get("Action") {
+		case "AssumeRoleWithWebIdentity":
+			assumedRole = r.Form.Get("RoleArn")
+			usedToken = r.Form.Get("WebIdentityToken")
+			fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIAWEBIDENTITY</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>
+<SessionToken>session</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`)
+		case "DescribeVolumes":
+			if !strings.Contains(r.Header.Get("Authorization"), "Credential=ASIAWEBIDENTITY/") {
+				http.Error(w, "unexpected credentials", http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `<DescribeVolumesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><volumeSet/></DescribeVolumesResponse>`)
+		default:
+			http.Error(w, "unexpected action", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	kubeClient := fakecore.NewSimpleClientset()
+	kubeClient.PrependReactor("create", "serviceaccounts", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		tokenRequest := action.(core.CreateAction).GetObject().(*authenticationv1.TokenRequest)
+		if len(tokenRequest.Spec.Audiences) != 1 || tokenRequest.Spec.Audiences[0] != webIdentityAudience {
+			return true, nil, fmt.Errorf("unexpected audiences %v", tokenRequest.Spec.Audiences)
+		}
+		tokenRequest.Status.Token = "web-identity-token"
+		return true, tokenRequest, nil
+	})
+
+	ec2Client, err := newEC2Client(&ec2ClientConfig{
+		region:      "us-east-1",
+		endpoint:    server.URL,
+		stsEndpoint: server.URL,
+		caBundle:    caBundle,
+		roleARN:     testRoleARN,
+		tokenRetriever: &serviceAccountTokenRetriever{
+			kubeClient:     kubeClient,
+			namespace:      defaultNamespace,
+			serviceAccount: guestControllerServiceAccount,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create the EC2 client: %v", err)
+	}
+	if _, err := ec2Client.DescribeVolumes(context.TODO(), &ec2.DescribeVolumesInput{}); err != nil {
+		t.Fatalf("DescribeVolumes failed: %v", err)
+	}
+	if assumedRole != testRoleARN {
+		t.Errorf("expected role %s to be assumed, got %q", testRoleARN, assumedRole)
+	}
+	if usedToken != "web-identity-token" {
+		t.Errorf("expected the ServiceAccount token to be used, got %q", usedToken)
+	}
+}
@@ -0,0 +1,273 @@
+package operator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	configv1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	endpointCheckConditionType = "AWSEBSEndpointCheckDegraded"
+	endpointCheckTimeout       = 10 * time.Second
+	endpointCheckInterval      = 5 * time.Minute
+	// endpointCheckFailureThreshold is the number of consecutive failed checks before the condition
+	// becomes True, so a single network hiccup does not degrade the operator.
+	endpointCheckFailureThreshold = 3
+)
+
+// endpointCheckController probes the AWS endpoints used by the driver with the same
+// endpoint overrides and custom CA bundle that are given to the driver by withCustomEndPoint
+// and withCustomAWSCABundle. It reports the result in the AWSEBSEndpointCheckDegraded condition,
+// so a wrong endpoint or CA bundle is visible without looking at crashlooping driver pods.
+// Unreachable endpoints are reported after endpointCheckFailureThreshold consecutive failed checks.
+type endpointCheckController struct {
+	operatorClient    v1helpers.OperatorClient
+	infraLister       v1.InfrastructureLister
+	cloudConfigLister corev1listers.ConfigMapNamespaceLister
+	isHypershift      bool
+	// proxy selects the proxy for the probe requests, like http.Transport.Proxy.
+	proxy func(*http.Request) (*url.URL, error)
+	// failures is the number of consecutive failed checks.
+	failures int
+	// lastMessage is the message of the last event, to emit events only when the failures change.
+	lastMessage string
+}
+
+func newEndpointCheckController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	infraLister v1.InfrastructureLister,
+	cloudConfigLister corev1listers.ConfigMapNamespaceLister,
+	isHypershift bool,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &endpointCheckController{
+		operatorClient:    operatorClient,
+		infraLister:       infraLister,
+		cloudConfigLister: cloudConfigLister,
+		isHypershift:      isHypershift,
+		proxy:             http.ProxyFromEnvironment,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		endpointCheckInterval,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *endpointCheckController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	endpoints, err := c.getEndpoints()
+	if err != nil {
+		return c.updateCondition(ctx, opv1.OperatorCondition{
+			Type:    endpointCheckConditionType,
+			Status:  opv1.ConditionTrue,
+			Reason:  "InvalidEndpoint",
+			Message: err.Error(),
+		})
+	}
+	if len(endpoints) == 0 {
+		klog.V(4).Infof("No AWS endpoint to check")
+		return c.updateCondition(ctx, opv1.OperatorCondition{
+			Type:    endpointCheckConditionType,
+			Status:  opv1.ConditionFalse,
+			Reason:  "NoEndpoints",
+			Message: "No AWS endpoint to check, the Infrastructure has no region and no service endpoints",
+		})
+	}
+
+	caBundle, err := customAWSCABundleData(c.isHypershift, c.cloudConfigLister)
+	if err != nil {
+		return err
+	}
+
+	var failures, successes []string
+	reason := ""
+	for _, endpoint := range endpoints {
+		result := probeEndpoint(ctx, endpoint.URL, caBundle, c.proxy)
+		if result.reason != "" {
+			if reason == "" {
+				reason = result.reason
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s", endpoint.Name, result.message))
+			continue
+		}
+		successes = append(successes, fmt.Sprintf("%s: %s", endpoint.Name, result.message))
+	}
+
+	condition := opv1.OperatorCondition{
+		Type:    endpointCheckConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: strings.Join(successes, "; "),
+	}
+	if len(failures) == 0 {
+		c.failures = 0
+		c.lastMessage = ""
+		return c.updateCondition(ctx, condition)
+	}
+	c.failures++
+	if c.failures < endpointCheckFailureThreshold {
+		condition.Reason = "CheckFailed"
+		condition.Message = fmt.Sprintf("%d of %d consecutive checks failed: %s", c.failures, endpointCheckFailureThreshold, strings.Join(failures, "; "))
+		return c.updateCondition(ctx, condition)
+	}
+	condition.Status = opv1.ConditionTrue
+	condition.Reason = reason
+	condition.Message = strings.Join(failures, "; ")
+	if condition.Message != c.lastMessage {
+		syncCtx.Recorder().Warningf("EndpointCheckFailed", "AWS endpoint check failed: %s", condition.Message)
+		c.lastMessage = condition.Message
+	}
+	return c.updateCondition(ctx, condition)
+}
+
+func (c *endpointCheckController) updateCondition(ctx context.Context, condition opv1.OperatorCondition) error {
+	_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// getEndpoints returns the endpoints the driver talks to. When EC2 has no endpoint override,
+// the default regional EC2 endpoint is checked instead.
+func (c *endpointCheckController) getEndpoints() ([]configv1.AWSServiceEndpoint, error) {
+	endpoints, err := getServiceEndpoints(c.infraLister)
+	if err != nil {
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Name == "ec2" {
+			return endpoints, nil
+		}
+	}
+
+	infra, err := c.infraLister.Get(infrastructureName)
+	if err != nil {
+		return nil, err
+	}
+	if infra.Status.PlatformStatus == nil || infra.Status.PlatformStatus.AWS == nil || infra.Status.PlatformStatus.AWS.Region == "" {
+		return endpoints, nil
+	}
+	return append(endpoints, configv1.AWSServiceEndpoint{
+		Name: "ec2",
+		URL:  defaultEC2Endpoint(infra.Status.PlatformStatus.AWS.Region),
+	}), nil
+}
+
+func defaultEC2Endpoint(region string) string {
+	if strings.HasPrefix(region, "cn-") {
+		return fmt.Sprintf("https://ec2.%s.amazonaws.com.cn", region)
+	}
+	return fmt.Sprintf("https://ec2.%s.amazonaws.com", region)
+}
+
+// endpointCheckResult is the outcome of a single endpoint probe.
+// An empty reason means the endpoint is reachable.
+type endpointCheckResult struct {
+	reason  string
+	message string
+}
+
+// probeEndpoint performs a TLS handshake and an HTTP request against the endpoint.
+// Any HTTP response counts as success, the driver is not authenticated here.
+// When caBundle is not empty, only its certificates are trusted, just like
+// the AWS SDK does with AWS_CA_BUNDLE.
+func probeEndpoint(ctx context.Context, endpoint string, caBundle []byte, proxy func(*http.Request) (*url.URL, error)) endpointCheckResult {
+	tlsConfig := &tls.Config{}
+	if len(caBundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return endpointCheckResult{
+				reason:  "InvalidCABundle",
+				message: fmt.Sprintf("no valid certificate found in the %s of the custom CA bundle", caBundleKey),
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return endpointCheckResult{reason: "InvalidEndpoint", message: err.Error()}
+	}
+
+	via := ""
+	if proxy != nil {
+		proxyURL, err := proxy(req)
+		if err != nil {
+			return endpointCheckResult{reason: "ProxyError", message: err.Error()}
+		}
+		if proxyURL != nil {
+			via = fmt.Sprintf(" via proxy %s", proxyURL.Redacted())
+		}
+	}
+
+	client := &http.Client{
+		Timeout: endpointCheckTimeout,
+		Transport: &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return endpointCheckResult{
+			reason:  endpointErrorReason(err),
+			message: fmt.Sprintf("%s unreachable%s: %v", endpoint, via, err),
+		}
+	}
+	defer resp.Body.Close()
+
+	return endpointCheckResult{
+		message: fmt.Sprintf("%s reachable%s (HTTP %d)", endpoint, via, resp.StatusCode),
+	}
+}
+
+func endpointErrorReason(err error) string {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var tlsVerificationErr *tls.CertificateVerificationError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &certInvalidErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &tlsVerificationErr):
+		return "CertificateError"
+	case errors.As(err, &dnsErr):
+		return "DNSError"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "Timeout"
+	default:
+		return "ConnectionError"
+	}
+}
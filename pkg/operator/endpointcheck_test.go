@@ -0,0 +1,199 @@
+package operator
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newEndpointServer(t *testing.T) (*httptest.Server, []byte) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return server, caBundle
+}
+
+func TestProbeEndpoint(t *testing.T) {
+	server, caBundle := newEndpointServer(t)
+
+	tests := []struct {
+		name           string
+		endpoint       string
+		caBundle       []byte
+		expectedReason string
+	}{
+		{
+			name:     "trusted certificate",
+			endpoint: server.URL,
+			caBundle: caBundle,
+		},
+		{
+			name:           "certificate not in the system trust store",
+			endpoint:       server.URL,
+			expectedReason: "CertificateError",
+		},
+		{
+			name:           "CA bundle without certificates",
+			endpoint:       server.URL,
+			caBundle:       []byte("not a certificate"),
+			expectedReason: "InvalidCABundle",
+		},
+		{
+			name:           "unknown host",
+			endpoint:       "https://ec2.does-not-exist.invalid",
+			caBundle:       caBundle,
+			expectedReason: "DNSError",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := probeEndpoint(context.TODO(), test.endpoint, test.caBundle, nil)
+			if result.reason != test.expectedReason {
+				t.Errorf("expected reason %q, got %q: %s", test.expectedReason, result.reason, result.message)
+			}
+		})
+	}
+}
+
+func TestEndpointCheckSync(t *testing.T) {
+	server, caBundle := newEndpointServer(t)
+
+	tests := []struct {
+		name      string
+		region    string
+		endpoints []v1.AWSServiceEndpoint
+		caBundle  []byte
+		// syncs is the number of syncs, 1 when not set.
+		syncs          int
+		expectedStatus opv1.ConditionStatus
+		expectedReason string
+		expectedEvents int
+	}{
+		{
+			name:   "reachable endpoint",
+			region: "us-east-1",
+			endpoints: []v1.AWSServiceEndpoint{
+				{Name: "ec2", URL: server.URL},
+			},
+			caBundle:       caBundle,
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		},
+		{
+			name:   "untrusted endpoint below the failure threshold",
+			region: "us-east-1",
+			endpoints: []v1.AWSServiceEndpoint{
+				{Name: "ec2", URL: server.URL},
+			},
+			syncs:          endpointCheckFailureThreshold - 1,
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "CheckFailed",
+		},
+		{
+			name:   "untrusted endpoint",
+			region: "us-east-1",
+			endpoints: []v1.AWSServiceEndpoint{
+				{Name: "ec2", URL: server.URL},
+			},
+			syncs:          endpointCheckFailureThreshold + 2,
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "CertificateError",
+			expectedEvents: 1,
+		},
+		{
+			name:   "malformed endpoint",
+			region: "us-east-1",
+			endpoints: []v1.AWSServiceEndpoint{
+				{Name: "ec2", URL: "ec2.example.com"},
+			},
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "InvalidEndpoint",
+		},
+		{
+			name:           "no endpoints",
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "NoEndpoints",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			infra := &v1.Infrastructure{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: infrastructureName,
+				},
+				Status: v1.InfrastructureStatus{
+					PlatformStatus: &v1.PlatformStatus{
+						AWS: &v1.AWSPlatformStatus{
+							Region:           test.region,
+							ServiceEndpoints: test.endpoints,
+						},
+					},
+				},
+			}
+			configInformerFactory := configinformers.NewSharedInformerFactory(fakeconfig.NewSimpleClientset(), 0)
+			configInformerFactory.Config().V1().Infrastructures().Informer().GetIndexer().Add(infra)
+
+			kubeInformerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+			if test.caBundle != nil {
+				kubeInformerFactory.Core().V1().ConfigMaps().Informer().GetIndexer().Add(&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: defaultNamespace,
+						Name:      cloudConfigName,
+					},
+					Data: map[string]string{
+						caBundleKey: string(test.caBundle),
+					},
+				})
+			}
+
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			c := &endpointCheckController{
+				operatorClient:    operatorClient,
+				infraLister:       configInformerFactory.Config().V1().Infrastructures().Lister(),
+				cloudConfigLister: kubeInformerFactory.Core().V1().ConfigMaps().Lister().ConfigMaps(defaultNamespace),
+			}
+			recorder := events.NewInMemoryRecorder("test")
+			syncs := test.syncs
+			if syncs == 0 {
+				syncs = 1
+			}
+			for i := 0; i < syncs; i++ {
+				if err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, endpointCheckConditionType)
+			if condition == nil {
+				t.Fatalf("condition %s not found", endpointCheckConditionType)
+			}
+			if condition.Status != test.expectedStatus || condition.Reason != test.expectedReason {
+				t.Errorf("expected %s/%s, got %s/%s: %s", test.expectedStatus, test.expectedReason, condition.Status, condition.Reason, condition.Message)
+			}
+			if len(recorder.Events()) != test.expectedEvents {
+				t.Errorf("expected %d events, got %d", test.expectedEvents, len(recorder.Events()))
+			}
+		})
+	}
+}
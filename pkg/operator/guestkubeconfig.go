@@ -0,0 +1,201 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeclient "k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// guestKubeconfigSecretName is the Secret in the control plane namespace with the kubeconfig
+	// the CSI sidecars use to access the guest cluster as guestControllerServiceAccount.
+	guestKubeconfigSecretName = "aws-ebs-csi-driver-controller-kubeconfig"
+	guestKubeconfigKey        = "kubeconfig"
+	guestTokenKey             = "token"
+	guestKubeconfigMountPath  = "/etc/hosted-kubernetes"
+
+	// guestControllerServiceAccount is the ServiceAccount in the guest cluster the RBAC
+	// bindings in assets/rbac are bound to.
+	guestControllerServiceAccount = "aws-ebs-csi-driver-controller-sa"
+
+	guestTokenExpirationAnnotation = "ebs.csi.openshift.io/token-expiration"
+	guestTokenSAUIDAnnotation      = "ebs.csi.openshift.io/service-account-uid"
+
+	guestTokenLifetime = 24 * time.Hour
+	// guestTokenRefresh is the remaining lifetime of the token when a new one is requested.
+	guestTokenRefresh     = guestTokenLifetime / 2
+	guestKubeconfigResync = time.Hour
+)
+
+// guestKubeconfigController mints a kubeconfig for the CSI sidecars that run in the control plane
+// namespace of a HyperShift hosted cluster. The kubeconfig authenticates as guestControllerServiceAccount
+// in the guest cluster, which has only the permissions of the rbac/main_*_binding.yaml assets.
+// The token is stored next to the kubeconfig and referenced as tokenFile, so the sidecars pick up
+// a rotated token from the mounted Secret without a restart.
+type guestKubeconfigController struct {
+	operatorClient         v1helpers.OperatorClient
+	controlPlaneKubeClient kubeclient.Interface
+	guestKubeClient        kubeclient.Interface
+	controlPlaneNamespace  string
+	guestNamespace         string
+	secretLister           corev1listers.SecretNamespaceLister
+	// server and caData describe the guest API server, as reachable from the control plane namespace.
+	server string
+	caData []byte
+}
+
+func newGuestKubeconfigController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	controlPlaneKubeClient kubeclient.Interface,
+	guestKubeClient kubeclient.Interface,
+	controlPlaneNamespace string,
+	guestNamespace string,
+	guestKubeConfig *rest.Config,
+	secretLister corev1listers.SecretNamespaceLister,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) (factory.Controller, error) {
+	caData := guestKubeConfig.TLSClientConfig.CAData
+	if len(caData) == 0 && guestKubeConfig.TLSClientConfig.CAFile != "" {
+		var err error
+		caData, err = os.ReadFile(guestKubeConfig.TLSClientConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the guest cluster CA: %w", err)
+		}
+	}
+	c := &guestKubeconfigController{
+		operatorClient:         operatorClient,
+		controlPlaneKubeClient: controlPlaneKubeClient,
+		guestKubeClient:        guestKubeClient,
+		controlPlaneNamespace:  controlPlaneNamespace,
+		guestNamespace:         guestNamespace,
+		secretLister:           secretLister,
+		server:                 guestKubeConfig.Host,
+		caData:                 caData,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		guestKubeconfigResync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	), nil
+}
+
+func (c *guestKubeconfigController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	kubeconfig, err := c.renderKubeconfig()
+	if err != nil {
+		return err
+	}
+	sa, err := c.guestKubeClient.CoreV1().ServiceAccounts(c.guestNamespace).Get(ctx, guestControllerServiceAccount, metav1.GetOptions{})
+	if err != nil {
+		// The ServiceAccount is created by the guest static resources controller.
+		return fmt.Errorf("failed to get ServiceAccount %s/%s: %w", c.guestNamespace, guestControllerServiceAccount, err)
+	}
+
+	existing, err := c.secretLister.Get(guestKubeconfigSecretName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && !needsNewToken(existing, kubeconfig, string(sa.UID), time.Now()) {
+		return nil
+	}
+
+	expirationSeconds := int64(guestTokenLifetime.Seconds())
+	tokenRequest, err := c.guestKubeClient.CoreV1().ServiceAccounts(c.guestNamespace).CreateToken(ctx, guestControllerServiceAccount, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create a token for ServiceAccount %s/%s: %w", c.guestNamespace, guestControllerServiceAccount, err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      guestKubeconfigSecretName,
+			Namespace: c.controlPlaneNamespace,
+			Annotations: map[string]string{
+				guestTokenExpirationAnnotation: tokenRequest.Status.ExpirationTimestamp.UTC().Format(time.RFC3339),
+				guestTokenSAUIDAnnotation:      string(sa.UID),
+			},
+		},
+		Data: map[string][]byte{
+			guestKubeconfigKey: kubeconfig,
+			guestTokenKey:      []byte(tokenRequest.Status.Token),
+		},
+		Type: corev1.SecretTypeOpaque,
+	}
+	klog.V(2).Infof("Updating guest cluster token in Secret %s/%s, expires at %s", c.controlPlaneNamespace, guestKubeconfigSecretName, tokenRequest.Status.ExpirationTimestamp)
+	_, _, err = resourceapply.ApplySecret(ctx, c.controlPlaneKubeClient.CoreV1(), syncCtx.Recorder(), secret)
+	return err
+}
+
+// renderKubeconfig returns the kubeconfig for the sidecars. The token is read from guestTokenKey
+// mounted next to the kubeconfig.
+func (c *guestKubeconfigController) renderKubeconfig() ([]byte, error) {
+	const name = "guest"
+	config := clientcmdapi.NewConfig()
+	config.Clusters[name] = &clientcmdapi.Cluster{
+		Server:                   c.server,
+		CertificateAuthorityData: c.caData,
+	}
+	config.AuthInfos[name] = &clientcmdapi.AuthInfo{
+		TokenFile: guestKubeconfigMountPath + "/" + guestTokenKey,
+	}
+	config.Contexts[name] = &clientcmdapi.Context{
+		Cluster:   name,
+		AuthInfo:  name,
+		Namespace: c.guestNamespace,
+	}
+	config.CurrentContext = name
+	return clientcmd.Write(*config)
+}
+
+// needsNewToken returns true when the Secret does not contain the expected kubeconfig, the token was
+// issued for a different ServiceAccount instance or it expires in less than guestTokenRefresh.
+func needsNewToken(secret *corev1.Secret, kubeconfig []byte, saUID string, now time.Time) bool {
+	if !bytes.Equal(secret.Data[guestKubeconfigKey], kubeconfig) || len(secret.Data[guestTokenKey]) == 0 {
+		return true
+	}
+	if secret.Annotations[guestTokenSAUIDAnnotation] != saUID {
+		return true
+	}
+	expiration, err := time.Parse(time.RFC3339, secret.Annotations[guestTokenExpirationAnnotation])
+	if err != nil {
+		return true
+	}
+	return expiration.Sub(now) < guestTokenRefresh
+}
@@ -0,0 +1,157 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestGuestKubeconfigSync(t *testing.T) {
+	const controlPlaneNamespace = "clusters-test"
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      guestControllerServiceAccount,
+			Namespace: defaultNamespace,
+			UID:       "sa-uid",
+		},
+	}
+	guestClient := fake.NewSimpleClientset(sa)
+	tokenRequests := 0
+	guestClient.PrependReactor("create", "serviceaccounts", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		tokenRequests++
+		return true, &authenticationv1.TokenRequest{
+			Status: authenticationv1.TokenRequestStatus{
+				Token:               "guest-token",
+				ExpirationTimestamp: metav1.NewTime(time.Now().Add(guestTokenLifetime)),
+			},
+		}, nil
+	})
+
+	controlPlaneClient := fake.NewSimpleClientset()
+	secretInformer := informers.NewSharedInformerFactory(controlPlaneClient, 0).Core().V1().Secrets()
+	c := &guestKubeconfigController{
+		operatorClient: v1helpers.NewFakeOperatorClient(
+			&opv1.OperatorSpec{ManagementState: opv1.Managed},
+			&opv1.OperatorStatus{},
+			nil,
+		),
+		controlPlaneKubeClient: controlPlaneClient,
+		guestKubeClient:        guestClient,
+		controlPlaneNamespace:  controlPlaneNamespace,
+		guestNamespace:         defaultNamespace,
+		secretLister:           secretInformer.Lister().Secrets(controlPlaneNamespace),
+		server:                 "https://kube-apiserver:6443",
+		caData:                 []byte("ca"),
+	}
+	syncCtx := factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))
+
+	if err := c.sync(context.TODO(), syncCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret, err := controlPlaneClient.CoreV1().Secrets(controlPlaneNamespace).Get(context.TODO(), guestKubeconfigSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get Secret: %v", err)
+	}
+	if string(secret.Data[guestTokenKey]) != "guest-token" {
+		t.Errorf("unexpected token %q", secret.Data[guestTokenKey])
+	}
+	kubeconfig, err := clientcmd.Load(secret.Data[guestKubeconfigKey])
+	if err != nil {
+		t.Fatalf("failed to parse kubeconfig: %v", err)
+	}
+	ctx := kubeconfig.Contexts[kubeconfig.CurrentContext]
+	if server := kubeconfig.Clusters[ctx.Cluster].Server; server != c.server {
+		t.Errorf("unexpected server %q", server)
+	}
+	if tokenFile := kubeconfig.AuthInfos[ctx.AuthInfo].TokenFile; tokenFile != "/etc/hosted-kubernetes/token" {
+		t.Errorf("unexpected token file %q", tokenFile)
+	}
+
+	// A valid token is not replaced.
+	secretInformer.Informer().GetIndexer().Add(secret)
+	if err := c.sync(context.TODO(), syncCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tokenRequests != 1 {
+		t.Errorf("expected 1 token request, got %d", tokenRequests)
+	}
+}
+
+func TestNeedsNewToken(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	kubeconfig := []byte("kubeconfig")
+	newSecret := func(kubeconfig []byte, saUID string, expiration time.Time) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					guestTokenExpirationAnnotation: expiration.Format(time.RFC3339),
+					guestTokenSAUIDAnnotation:      saUID,
+				},
+			},
+			Data: map[string][]byte{
+				guestKubeconfigKey: kubeconfig,
+				guestTokenKey:      []byte("token"),
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		secret   *corev1.Secret
+		expected bool
+	}{
+		{
+			name:     "fresh token",
+			secret:   newSecret(kubeconfig, "uid", now.Add(20*time.Hour)),
+			expected: false,
+		},
+		{
+			name:     "token close to expiration",
+			secret:   newSecret(kubeconfig, "uid", now.Add(time.Hour)),
+			expected: true,
+		},
+		{
+			name:     "expired token",
+			secret:   newSecret(kubeconfig, "uid", now.Add(-time.Hour)),
+			expected: true,
+		},
+		{
+			name:     "recreated ServiceAccount",
+			secret:   newSecret(kubeconfig, "old-uid", now.Add(20*time.Hour)),
+			expected: true,
+		},
+		{
+			name:     "changed kubeconfig",
+			secret:   newSecret([]byte("old kubeconfig"), "uid", now.Add(20*time.Hour)),
+			expected: true,
+		},
+		{
+			name:     "missing expiration",
+			secret:   &corev1.Secret{Data: map[string][]byte{guestKubeconfigKey: kubeconfig, guestTokenKey: []byte("token")}},
+			expected: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := needsNewToken(test.secret, kubeconfig, "uid", now); result != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
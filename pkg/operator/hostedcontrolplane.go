@@ -0,0 +1,487 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	configv1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeclient "k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	platformMismatchConditionType   = "AWSEBSPlatformMismatch"
+	hostedControlPlaneConditionType = "AWSEBSHostedControlPlaneDegraded"
+
+	// lastKnownHostedControlPlaneConfigMap in the control plane namespace stores the last known
+	// HostedControlPlane of the hostedControlPlaneTracker, so it survives restarts of the operator.
+	lastKnownHostedControlPlaneConfigMap = "aws-ebs-csi-driver-operator-hosted-control-plane"
+	lastKnownHostedControlPlaneKey       = "hostedcontrolplane.json"
+)
+
+// hostedControlPlaneAWSPlatform is the part of the HostedControlPlane spec.platform.aws
+// that is also present in the guest Infrastructure status.
+type hostedControlPlaneAWSPlatform struct {
+	Region           string                        `json:"region,omitempty"`
+	ResourceTags     []configv1.AWSResourceTag     `json:"resourceTags,omitempty"`
+	ServiceEndpoints []configv1.AWSServiceEndpoint `json:"serviceEndpoints,omitempty"`
+}
+
+func getHostedControlPlaneAWSPlatform(hostedControlPlaneLister cache.GenericLister, namespace string) (*hostedControlPlaneAWSPlatform, error) {
+	hcp, err := getHostedControlPlane(hostedControlPlaneLister, namespace)
+	if err != nil {
+		return nil, err
+	}
+	platform := &hostedControlPlaneAWSPlatform{}
+	aws, found, err := unstructured.NestedMap(hcp.UnstructuredContent(), "spec", "platform", "aws")
+	if err != nil || !found {
+		return platform, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(aws, platform); err != nil {
+		return nil, fmt.Errorf("failed to parse spec.platform.aws of HostedControlPlane %s/%s: %w", namespace, hcp.GetName(), err)
+	}
+	return platform, nil
+}
+
+// hostedControlPlaneInfrastructureLister returns the guest Infrastructure with the AWS region,
+// resource tags and service endpoints replaced by the ones from the HostedControlPlane, which is
+// the source of truth in HyperShift and cannot be changed by guest cluster admins. Resource tags and
+// service endpoints missing in the HostedControlPlane mean none, only when the HostedControlPlane
+// cannot be read the guest Infrastructure is used.
+type hostedControlPlaneInfrastructureLister struct {
+	v1.InfrastructureLister
+	hostedControlPlaneLister cache.GenericLister
+	namespace                string
+}
+
+var _ v1.InfrastructureLister = &hostedControlPlaneInfrastructureLister{}
+
+func newHostedControlPlaneInfrastructureLister(infraLister v1.InfrastructureLister, hostedControlPlaneLister cache.GenericLister, namespace string) v1.InfrastructureLister {
+	return &hostedControlPlaneInfrastructureLister{
+		InfrastructureLister:     infraLister,
+		hostedControlPlaneLister: hostedControlPlaneLister,
+		namespace:                namespace,
+	}
+}
+
+func (l *hostedControlPlaneInfrastructureLister) List(selector labels.Selector) ([]*configv1.Infrastructure, error) {
+	infras, err := l.InfrastructureLister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	platform := l.getPlatform()
+	ret := make([]*configv1.Infrastructure, 0, len(infras))
+	for _, infra := range infras {
+		ret = append(ret, withHostedControlPlaneAWSPlatform(infra, platform))
+	}
+	return ret, nil
+}
+
+func (l *hostedControlPlaneInfrastructureLister) Get(name string) (*configv1.Infrastructure, error) {
+	infra, err := l.InfrastructureLister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return withHostedControlPlaneAWSPlatform(infra, l.getPlatform()), nil
+}
+
+func (l *hostedControlPlaneInfrastructureLister) getPlatform() *hostedControlPlaneAWSPlatform {
+	platform, err := getHostedControlPlaneAWSPlatform(l.hostedControlPlaneLister, l.namespace)
+	if err != nil {
+		// Reported by the platform mismatch controller.
+		klog.V(2).Infof("Using the guest Infrastructure: %v", err)
+		return nil
+	}
+	return platform
+}
+
+// withHostedControlPlaneAWSPlatform returns a copy of the Infrastructure with the values of the platform.
+// The Infrastructure from the informer cache is never modified.
+func withHostedControlPlaneAWSPlatform(infra *configv1.Infrastructure, platform *hostedControlPlaneAWSPlatform) *configv1.Infrastructure {
+	if platform == nil {
+		return infra
+	}
+	infra = infra.DeepCopy()
+	if infra.Status.PlatformStatus == nil {
+		infra.Status.PlatformStatus = &configv1.PlatformStatus{Type: configv1.AWSPlatformType}
+	}
+	if infra.Status.PlatformStatus.AWS == nil {
+		infra.Status.PlatformStatus.AWS = &configv1.AWSPlatformStatus{}
+	}
+	aws := infra.Status.PlatformStatus.AWS
+	// The region is required in the HostedControlPlane, the guest one is kept only for an invalid HostedControlPlane.
+	if platform.Region != "" {
+		aws.Region = platform.Region
+	}
+	aws.ResourceTags = platform.ResourceTags
+	aws.ServiceEndpoints = platform.ServiceEndpoints
+	return infra
+}
+
+// platformMismatchController reports differences between the HostedControlPlane spec.platform.aws
+// and the guest Infrastructure in the AWSEBSPlatformMismatch condition. The HostedControlPlane wins,
+// see hostedControlPlaneInfrastructureLister.
+type platformMismatchController struct {
+	operatorClient           v1helpers.OperatorClient
+	infraLister              v1.InfrastructureLister
+	hostedControlPlaneLister cache.GenericLister
+	namespace                string
+}
+
+func newPlatformMismatchController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	infraLister v1.InfrastructureLister,
+	hostedControlPlaneLister cache.GenericLister,
+	namespace string,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &platformMismatchController{
+		operatorClient:           operatorClient,
+		infraLister:              infraLister,
+		hostedControlPlaneLister: hostedControlPlaneLister,
+		namespace:                namespace,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *platformMismatchController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	_, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+
+	condition := opv1.OperatorCondition{
+		Type:    platformMismatchConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: "The guest Infrastructure matches the HostedControlPlane",
+	}
+
+	infra, err := c.infraLister.Get(infrastructureName)
+	if err != nil {
+		return err
+	}
+	platform, err := getHostedControlPlaneAWSPlatform(c.hostedControlPlaneLister, c.namespace)
+	if err != nil {
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "HostedControlPlaneUnavailable"
+		condition.Message = fmt.Sprintf("Using the guest Infrastructure: %v", err)
+	} else if mismatches := compareAWSPlatform(platform, infra); len(mismatches) > 0 {
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "Mismatch"
+		condition.Message = fmt.Sprintf("The guest Infrastructure differs from the HostedControlPlane, using the HostedControlPlane values: %s", strings.Join(mismatches, "; "))
+	}
+
+	previous := v1helpers.FindOperatorCondition(opStatus.Conditions, platformMismatchConditionType)
+	if condition.Status == opv1.ConditionTrue && (previous == nil || previous.Message != condition.Message) {
+		syncCtx.Recorder().Warning("PlatformMismatch", condition.Message)
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// compareAWSPlatform returns a description of each value of the HostedControlPlane that differs
+// in the Infrastructure. The region is compared only when it is set in the HostedControlPlane.
+func compareAWSPlatform(platform *hostedControlPlaneAWSPlatform, infra *configv1.Infrastructure) []string {
+	status := &configv1.AWSPlatformStatus{}
+	if infra.Status.PlatformStatus != nil && infra.Status.PlatformStatus.AWS != nil {
+		status = infra.Status.PlatformStatus.AWS
+	}
+
+	var mismatches []string
+	if platform.Region != "" && platform.Region != status.Region {
+		mismatches = append(mismatches, fmt.Sprintf("region %q != %q", status.Region, platform.Region))
+	}
+	hcpTags := map[string]string{}
+	for _, tag := range platform.ResourceTags {
+		hcpTags[tag.Key] = tag.Value
+	}
+	infraTags := map[string]string{}
+	for _, tag := range status.ResourceTags {
+		infraTags[tag.Key] = tag.Value
+	}
+	if diff := diffStringMaps(infraTags, hcpTags); diff != "" {
+		mismatches = append(mismatches, fmt.Sprintf("resource tags %s", diff))
+	}
+	hcpEndpoints := map[string]string{}
+	for _, endpoint := range platform.ServiceEndpoints {
+		hcpEndpoints[endpoint.Name] = endpoint.URL
+	}
+	infraEndpoints := map[string]string{}
+	for _, endpoint := range status.ServiceEndpoints {
+		infraEndpoints[endpoint.Name] = endpoint.URL
+	}
+	if diff := diffStringMaps(infraEndpoints, hcpEndpoints); diff != "" {
+		mismatches = append(mismatches, fmt.Sprintf("service endpoints %s", diff))
+	}
+	return mismatches
+}
+
+// diffStringMaps returns the keys that differ between actual and expected, or an empty string.
+func diffStringMaps(actual, expected map[string]string) string {
+	var diffs []string
+	for key, value := range expected {
+		if actualValue, ok := actual[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s missing", key))
+		} else if actualValue != value {
+			diffs = append(diffs, fmt.Sprintf("%s %q != %q", key, actualValue, value))
+		}
+	}
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s unexpected", key))
+		}
+	}
+	if len(diffs) == 0 {
+		return ""
+	}
+	sort.Strings(diffs)
+	return "(" + strings.Join(diffs, ", ") + ")"
+}
+
+// hostedControlPlaneTracker is a GenericLister of HostedControlPlanes that remembers the last
+// HostedControlPlane that was the only one in the control plane namespace. While the namespace
+// has no HostedControlPlane or more than one, listing the namespace returns the remembered one,
+// so the driver keeps its last good configuration instead of failing every sync.
+// The state is reported by the hostedControlPlaneTrackerController, which also persists the
+// last known HostedControlPlane in the lastKnownHostedControlPlaneConfigMap. After a restart,
+// the tracker starts with the persisted HostedControlPlane.
+type hostedControlPlaneTracker struct {
+	lister          cache.GenericLister
+	configMapLister corev1listers.ConfigMapNamespaceLister
+	namespace       string
+
+	lock      sync.Mutex
+	lastKnown *unstructured.Unstructured
+}
+
+var _ cache.GenericLister = &hostedControlPlaneTracker{}
+
+func newHostedControlPlaneTracker(lister cache.GenericLister, configMapLister corev1listers.ConfigMapNamespaceLister, namespace string) *hostedControlPlaneTracker {
+	return &hostedControlPlaneTracker{
+		lister:          lister,
+		configMapLister: configMapLister,
+		namespace:       namespace,
+	}
+}
+
+func (t *hostedControlPlaneTracker) List(selector labels.Selector) ([]runtime.Object, error) {
+	return t.lister.List(selector)
+}
+
+func (t *hostedControlPlaneTracker) Get(name string) (runtime.Object, error) {
+	return t.lister.Get(name)
+}
+
+func (t *hostedControlPlaneTracker) ByNamespace(namespace string) cache.GenericNamespaceLister {
+	if namespace != t.namespace {
+		return t.lister.ByNamespace(namespace)
+	}
+	return &trackedHostedControlPlaneLister{tracker: t}
+}
+
+// lookup lists the HostedControlPlanes in the namespace and remembers the HostedControlPlane
+// when it is the only one. It returns the live list and the last known HostedControlPlane.
+func (t *hostedControlPlaneTracker) lookup(selector labels.Selector) ([]runtime.Object, *unstructured.Unstructured, error) {
+	list, err := t.lister.ByNamespace(t.namespace).List(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(list) == 1 && selector.Empty() {
+		if hcp, ok := list[0].(*unstructured.Unstructured); ok {
+			t.lastKnown = hcp.DeepCopy()
+		}
+	}
+	if t.lastKnown == nil {
+		t.lastKnown = t.loadLastKnown()
+	}
+	return list, t.lastKnown, nil
+}
+
+// loadLastKnown returns the HostedControlPlane persisted in the lastKnownHostedControlPlaneConfigMap, if any.
+func (t *hostedControlPlaneTracker) loadLastKnown() *unstructured.Unstructured {
+	cm, err := t.configMapLister.Get(lastKnownHostedControlPlaneConfigMap)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.Warningf("Failed to get the last known HostedControlPlane: %v", err)
+		}
+		return nil
+	}
+	hcp := &unstructured.Unstructured{}
+	if err := hcp.UnmarshalJSON([]byte(cm.Data[lastKnownHostedControlPlaneKey])); err != nil {
+		klog.Warningf("Ignoring malformed HostedControlPlane in ConfigMap %s: %v", lastKnownHostedControlPlaneConfigMap, err)
+		return nil
+	}
+	return hcp
+}
+
+// marshalLastKnown returns the HostedControlPlane to persist, without its status and the metadata
+// that changes with each update of the status.
+func marshalLastKnown(hcp *unstructured.Unstructured) (string, error) {
+	hcp = hcp.DeepCopy()
+	unstructured.RemoveNestedField(hcp.Object, "status")
+	hcp.SetManagedFields(nil)
+	hcp.SetResourceVersion("")
+	data, err := json.Marshal(hcp.Object)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+type trackedHostedControlPlaneLister struct {
+	tracker *hostedControlPlaneTracker
+}
+
+func (l *trackedHostedControlPlaneLister) List(selector labels.Selector) ([]runtime.Object, error) {
+	list, lastKnown, err := l.tracker.lookup(selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 && lastKnown != nil && selector.Empty() {
+		klog.V(4).Infof("Found %d HostedControlPlanes in namespace %s, using the last known HostedControlPlane %s", len(list), l.tracker.namespace, lastKnown.GetName())
+		return []runtime.Object{lastKnown.DeepCopy()}, nil
+	}
+	return list, nil
+}
+
+func (l *trackedHostedControlPlaneLister) Get(name string) (runtime.Object, error) {
+	return l.tracker.lister.ByNamespace(l.tracker.namespace).Get(name)
+}
+
+// hostedControlPlaneTrackerController reports the HostedControlPlane used by the operator in the
+// AWSEBSHostedControlPlaneDegraded condition and persists it in the lastKnownHostedControlPlaneConfigMap.
+// Events are emitted only when the state changes.
+type hostedControlPlaneTrackerController struct {
+	operatorClient v1helpers.OperatorClient
+	kubeClient     kubeclient.Interface
+	tracker        *hostedControlPlaneTracker
+}
+
+func newHostedControlPlaneTrackerController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubeclient.Interface,
+	tracker *hostedControlPlaneTracker,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &hostedControlPlaneTrackerController{
+		operatorClient: operatorClient,
+		kubeClient:     kubeClient,
+		tracker:        tracker,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *hostedControlPlaneTrackerController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	_, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	list, lastKnown, err := c.tracker.lookup(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	namespace := c.tracker.namespace
+	condition := opv1.OperatorCondition{
+		Type:   hostedControlPlaneConditionType,
+		Status: opv1.ConditionTrue,
+	}
+	switch len(list) {
+	case 0:
+		condition.Reason = "HostedControlPlaneMissing"
+		condition.Message = fmt.Sprintf("No HostedControlPlane found in namespace %s", namespace)
+	case 1:
+		condition.Status = opv1.ConditionFalse
+		condition.Reason = "AsExpected"
+		condition.Message = fmt.Sprintf("Using HostedControlPlane %s/%s", namespace, lastKnown.GetName())
+		if err := c.saveLastKnown(ctx, syncCtx.Recorder(), lastKnown); err != nil {
+			return err
+		}
+	default:
+		names := make([]string, 0, len(list))
+		for _, obj := range list {
+			if hcp, ok := obj.(*unstructured.Unstructured); ok {
+				names = append(names, hcp.GetName())
+			}
+		}
+		sort.Strings(names)
+		condition.Reason = "MultipleHostedControlPlanes"
+		condition.Message = fmt.Sprintf("Found %d HostedControlPlanes in namespace %s: %s", len(list), namespace, strings.Join(names, ", "))
+	}
+	if condition.Status == opv1.ConditionTrue {
+		if lastKnown != nil {
+			condition.Message += fmt.Sprintf("; keeping the configuration of the last known HostedControlPlane %s", lastKnown.GetName())
+		} else {
+			condition.Message += "; the driver cannot be configured"
+		}
+	}
+
+	previous := v1helpers.FindOperatorCondition(opStatus.Conditions, hostedControlPlaneConditionType)
+	if previous == nil || previous.Reason != condition.Reason {
+		switch {
+		case condition.Status == opv1.ConditionTrue:
+			syncCtx.Recorder().Warning(condition.Reason, condition.Message)
+		case previous != nil:
+			syncCtx.Recorder().Event("HostedControlPlaneFound", condition.Message)
+		}
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+func (c *hostedControlPlaneTrackerController) saveLastKnown(ctx context.Context, recorder events.Recorder, hcp *unstructured.Unstructured) error {
+	data, err := marshalLastKnown(hcp)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      lastKnownHostedControlPlaneConfigMap,
+			Namespace: c.tracker.namespace,
+		},
+		Data: map[string]string{lastKnownHostedControlPlaneKey: data},
+	}
+	_, _, err = resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), recorder, cm)
+	return err
+}
@@ -0,0 +1,311 @@
+package operator
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestHostedControlPlaneInfrastructureLister(t *testing.T) {
+	const namespace = "clusters-test"
+	guestPlatform := &v1.AWSPlatformStatus{
+		Region:           "us-east-1",
+		ResourceTags:     []v1.AWSResourceTag{{Key: "owner", Value: "guest-admin"}},
+		ServiceEndpoints: []v1.AWSServiceEndpoint{{Name: "ec2", URL: "https://ec2.guest.example.com"}},
+	}
+
+	tests := []struct {
+		name             string
+		hcps             []*unstructured.Unstructured
+		expectedPlatform *v1.AWSPlatformStatus
+		expectedStatus   opv1.ConditionStatus
+		expectedReason   string
+	}{
+		{
+			name: "HostedControlPlane values win",
+			hcps: []*unstructured.Unstructured{hostedControlPlane(namespace, map[string]interface{}{
+				"platform": map[string]interface{}{
+					"aws": map[string]interface{}{
+						"region": "us-west-2",
+						"resourceTags": []interface{}{
+							map[string]interface{}{"key": "owner", "value": "team-a"},
+						},
+						"serviceEndpoints": []interface{}{
+							map[string]interface{}{"name": "ec2", "url": "https://ec2.example.com"},
+						},
+					},
+				},
+			})},
+			expectedPlatform: &v1.AWSPlatformStatus{
+				Region:           "us-west-2",
+				ResourceTags:     []v1.AWSResourceTag{{Key: "owner", Value: "team-a"}},
+				ServiceEndpoints: []v1.AWSServiceEndpoint{{Name: "ec2", URL: "https://ec2.example.com"}},
+			},
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "Mismatch",
+		},
+		{
+			name: "same values",
+			hcps: []*unstructured.Unstructured{hostedControlPlane(namespace, map[string]interface{}{
+				"platform": map[string]interface{}{
+					"aws": map[string]interface{}{
+						"region": "us-east-1",
+						"resourceTags": []interface{}{
+							map[string]interface{}{"key": "owner", "value": "guest-admin"},
+						},
+						"serviceEndpoints": []interface{}{
+							map[string]interface{}{"name": "ec2", "url": "https://ec2.guest.example.com"},
+						},
+					},
+				},
+			})},
+			expectedPlatform: guestPlatform,
+			expectedStatus:   opv1.ConditionFalse,
+			expectedReason:   "AsExpected",
+		},
+		{
+			name: "missing values mean none",
+			hcps: []*unstructured.Unstructured{hostedControlPlane(namespace, map[string]interface{}{
+				"platform": map[string]interface{}{
+					"aws": map[string]interface{}{
+						"region": "us-east-1",
+					},
+				},
+			})},
+			expectedPlatform: &v1.AWSPlatformStatus{Region: "us-east-1"},
+			expectedStatus:   opv1.ConditionTrue,
+			expectedReason:   "Mismatch",
+		},
+		{
+			name:             "no HostedControlPlane",
+			expectedPlatform: guestPlatform,
+			expectedStatus:   opv1.ConditionTrue,
+			expectedReason:   "HostedControlPlaneUnavailable",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			infra := &v1.Infrastructure{
+				ObjectMeta: metav1.ObjectMeta{Name: infrastructureName},
+				Status: v1.InfrastructureStatus{
+					PlatformStatus: &v1.PlatformStatus{
+						AWS: guestPlatform.DeepCopy(),
+					},
+				},
+			}
+			configInformerFactory := configinformers.NewSharedInformerFactory(fakeconfig.NewSimpleClientset(), 0)
+			configInformerFactory.Config().V1().Infrastructures().Informer().GetIndexer().Add(infra)
+			guestLister := configInformerFactory.Config().V1().Infrastructures().Lister()
+			hcpLister := newHostedControlPlaneLister(t, test.hcps...)
+
+			lister := newHostedControlPlaneInfrastructureLister(guestLister, hcpLister, namespace)
+			result, err := lister.Get(infrastructureName)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e, a := test.expectedPlatform, result.Status.PlatformStatus.AWS; !equality.Semantic.DeepEqual(e, a) {
+				t.Errorf("unexpected platform status\nwant=%#v\ngot= %#v", e, a)
+			}
+			if !equality.Semantic.DeepEqual(guestPlatform, infra.Status.PlatformStatus.AWS) {
+				t.Errorf("the cached Infrastructure was modified")
+			}
+
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			c := &platformMismatchController{
+				operatorClient:           operatorClient,
+				infraLister:              guestLister,
+				hostedControlPlaneLister: hcpLister,
+				namespace:                namespace,
+			}
+			recorder := events.NewInMemoryRecorder("test")
+			if err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, platformMismatchConditionType)
+			if condition == nil {
+				t.Fatalf("condition %s not found", platformMismatchConditionType)
+			}
+			if condition.Status != test.expectedStatus || condition.Reason != test.expectedReason {
+				t.Errorf("expected %s/%s, got %s/%s: %s", test.expectedStatus, test.expectedReason, condition.Status, condition.Reason, condition.Message)
+			}
+			if expectEvent := test.expectedStatus == opv1.ConditionTrue; expectEvent != (len(recorder.Events()) > 0) {
+				t.Errorf("unexpected events: %v", recorder.Events())
+			}
+		})
+	}
+}
+
+func TestCompareAWSPlatform(t *testing.T) {
+	infra := &v1.Infrastructure{
+		Status: v1.InfrastructureStatus{
+			PlatformStatus: &v1.PlatformStatus{
+				AWS: &v1.AWSPlatformStatus{
+					Region:       "us-east-1",
+					ResourceTags: []v1.AWSResourceTag{{Key: "owner", Value: "guest"}, {Key: "extra", Value: "x"}},
+				},
+			},
+		},
+	}
+	platform := &hostedControlPlaneAWSPlatform{
+		Region:           "us-west-2",
+		ResourceTags:     []v1.AWSResourceTag{{Key: "owner", Value: "team-a"}},
+		ServiceEndpoints: []v1.AWSServiceEndpoint{{Name: "ec2", URL: "https://ec2.example.com"}},
+	}
+	expected := []string{
+		`region "us-east-1" != "us-west-2"`,
+		`resource tags (extra unexpected, owner "guest" != "team-a")`,
+		`service endpoints (ec2 missing)`,
+	}
+	if result := compareAWSPlatform(platform, infra); !equality.Semantic.DeepEqual(expected, result) {
+		t.Errorf("unexpected mismatches\nwant=%q\ngot= %q", expected, result)
+	}
+}
+
+func TestHostedControlPlaneTracker(t *testing.T) {
+	const namespace = "clusters-test"
+	newHCP := func(name string) *unstructured.Unstructured {
+		hcp := hostedControlPlane(namespace, map[string]interface{}{
+			"controllerAvailabilityPolicy": "HighlyAvailable",
+		})
+		hcp.SetName(name)
+		return hcp
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	hcpLister := cache.NewGenericLister(indexer, hostedControlPlaneGVR.GroupResource())
+	kubeClient := fake.NewSimpleClientset()
+	configMapInformer := informers.NewSharedInformerFactory(kubeClient, 0).Core().V1().ConfigMaps()
+	configMapLister := configMapInformer.Lister().ConfigMaps(namespace)
+	tracker := newHostedControlPlaneTracker(hcpLister, configMapLister, namespace)
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&opv1.OperatorSpec{ManagementState: opv1.Managed},
+		&opv1.OperatorStatus{},
+		nil,
+	)
+	c := &hostedControlPlaneTrackerController{
+		operatorClient: operatorClient,
+		kubeClient:     kubeClient,
+		tracker:        tracker,
+	}
+
+	steps := []struct {
+		name           string
+		hcps           []*unstructured.Unstructured
+		expectedStatus opv1.ConditionStatus
+		expectedReason string
+		expectedEvents int
+		expectedHCP    string
+		// restart replaces the tracker by a new one, like a restart of the operator.
+		restart bool
+	}{
+		{
+			name:           "no HostedControlPlane yet",
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "HostedControlPlaneMissing",
+			expectedEvents: 1,
+		},
+		{
+			name:           "HostedControlPlane created",
+			hcps:           []*unstructured.Unstructured{newHCP("hcp-a")},
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "AsExpected",
+			expectedEvents: 1,
+			expectedHCP:    "hcp-a",
+		},
+		{
+			name:           "second HostedControlPlane",
+			hcps:           []*unstructured.Unstructured{newHCP("hcp-a"), newHCP("hcp-b")},
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "MultipleHostedControlPlanes",
+			expectedEvents: 1,
+			expectedHCP:    "hcp-a",
+		},
+		{
+			name:           "HostedControlPlanes deleted",
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "HostedControlPlaneMissing",
+			expectedEvents: 1,
+			expectedHCP:    "hcp-a",
+		},
+		{
+			name:           "still deleted",
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "HostedControlPlaneMissing",
+			expectedEvents: 0,
+			expectedHCP:    "hcp-a",
+		},
+		{
+			name:           "restarted",
+			restart:        true,
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "HostedControlPlaneMissing",
+			expectedEvents: 0,
+			expectedHCP:    "hcp-a",
+		},
+	}
+	for _, step := range steps {
+		if step.restart {
+			tracker = newHostedControlPlaneTracker(hcpLister, configMapLister, namespace)
+			c.tracker = tracker
+		}
+		for _, obj := range indexer.List() {
+			indexer.Delete(obj)
+		}
+		for _, hcp := range step.hcps {
+			indexer.Add(hcp)
+		}
+		recorder := events.NewInMemoryRecorder("test")
+		if err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		syncConfigMapIndexer(t, kubeClient, namespace, configMapInformer.Informer().GetIndexer())
+
+		_, status, _, _ := operatorClient.GetOperatorState()
+		condition := v1helpers.FindOperatorCondition(status.Conditions, hostedControlPlaneConditionType)
+		if condition == nil {
+			t.Fatalf("%s: condition %s not found", step.name, hostedControlPlaneConditionType)
+		}
+		if condition.Status != step.expectedStatus || condition.Reason != step.expectedReason {
+			t.Errorf("%s: expected %s/%s, got %s/%s: %s", step.name, step.expectedStatus, step.expectedReason, condition.Status, condition.Reason, condition.Message)
+		}
+		// Events of the last known HostedControlPlane ConfigMap are not counted.
+		var stateEvents []string
+		for _, event := range recorder.Events() {
+			if !strings.HasPrefix(event.Reason, "ConfigMap") {
+				stateEvents = append(stateEvents, event.Reason)
+			}
+		}
+		if len(stateEvents) != step.expectedEvents {
+			t.Errorf("%s: expected %d events, got %v", step.name, step.expectedEvents, stateEvents)
+		}
+
+		hcp, err := getHostedControlPlane(tracker, namespace)
+		switch {
+		case step.expectedHCP == "" && err == nil:
+			t.Errorf("%s: expected error, got HostedControlPlane %s", step.name, hcp.GetName())
+		case step.expectedHCP != "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", step.name, err)
+		case step.expectedHCP != "" && hcp.GetName() != step.expectedHCP:
+			t.Errorf("%s: expected HostedControlPlane %s, got %s", step.name, step.expectedHCP, hcp.GetName())
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kubeclient "k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	hypershiftCredentialsConditionType = "AWSEBSCredentialsDegraded"
+
+	// awsCredentialsKey is the key of the AWS config file in the cloud credentials Secret,
+	// mounted by controller.yaml as AWS_CONFIG_FILE.
+	awsCredentialsKey = "credentials"
+	// webIdentityTokenFile is written by the token-minter sidecar.
+	webIdentityTokenFile = "/var/run/secrets/openshift/serviceaccount/token"
+	webIdentityAudience  = "openshift"
+
+	// credentialsOwnerAnnotation marks the cloud credentials Secret rendered by the operator.
+	// Of Secrets without it, e.g. written by HyperShift, only the role is reconciled.
+	credentialsOwnerAnnotation = "ebs.csi.openshift.io/credentials-owner"
+)
+
+// hypershiftCredentialsController renders the cloud credentials Secret of the driver in a HyperShift
+// control plane namespace. The driver assumes the storage role from the HostedControlPlane
+// spec.platform.aws.rolesRef.storageARN with the web identity token minted by the token-minter sidecar.
+// A Secret written by HyperShift keeps its metadata and other keys, its AWS config file is replaced only
+// when it assumes another role.
+type hypershiftCredentialsController struct {
+	operatorClient           v1helpers.OperatorClient
+	kubeClient               kubeclient.Interface
+	namespace                string
+	hostedControlPlaneLister cache.GenericLister
+	secretLister             corev1listers.SecretNamespaceLister
+}
+
+func newHypershiftCredentialsController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubeclient.Interface,
+	namespace string,
+	hostedControlPlaneLister cache.GenericLister,
+	secretLister corev1listers.SecretNamespaceLister,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &hypershiftCredentialsController{
+		operatorClient:           operatorClient,
+		kubeClient:               kubeClient,
+		namespace:                namespace,
+		hostedControlPlaneLister: hostedControlPlaneLister,
+		secretLister:             secretLister,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *hypershiftCredentialsController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	roleARN, err := getHostedControlPlaneStorageRoleARN(c.hostedControlPlaneLister, c.namespace)
+	if err != nil {
+		return err
+	}
+	if roleARN == "" {
+		// Keep the existing Secret, the driver may still have valid credentials.
+		return c.updateCondition(ctx, opv1.OperatorCondition{
+			Type:    hypershiftCredentialsConditionType,
+			Status:  opv1.ConditionTrue,
+			Reason:  "StorageRoleMissing",
+			Message: "HostedControlPlane spec.platform.aws.rolesRef.storageARN is not set",
+		})
+	}
+	if _, err := arn.Parse(roleARN); err != nil {
+		return c.updateCondition(ctx, opv1.OperatorCondition{
+			Type:    hypershiftCredentialsConditionType,
+			Status:  opv1.ConditionTrue,
+			Reason:  "InvalidStorageRole",
+			Message: fmt.Sprintf("HostedControlPlane spec.platform.aws.rolesRef.storageARN %q is invalid: %v", roleARN, err),
+		})
+	}
+
+	existing, err := c.secretLister.Get(cloudCredSecretName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if existing != nil && existing.Annotations[credentialsOwnerAnnotation] != operatorName {
+		return c.syncForeignSecret(ctx, syncCtx, existing, roleARN)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        cloudCredSecretName,
+			Namespace:   c.namespace,
+			Annotations: map[string]string{credentialsOwnerAnnotation: operatorName},
+		},
+		Data: map[string][]byte{
+			awsCredentialsKey: renderWebIdentityCredentials(roleARN),
+		},
+		Type: corev1.SecretTypeOpaque,
+	}
+	if _, _, err := resourceapply.ApplySecret(ctx, c.kubeClient.CoreV1(), syncCtx.Recorder(), secret); err != nil {
+		return err
+	}
+	return c.updateCondition(ctx, opv1.OperatorCondition{
+		Type:    hypershiftCredentialsConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: fmt.Sprintf("Using role %s", roleARN),
+	})
+}
+
+// syncForeignSecret reconciles the role of a Secret that was not rendered by the operator. Its AWS config
+// file is replaced only when it assumes another role, so the rest of the Secret written by HyperShift is kept.
+func (c *hypershiftCredentialsController) syncForeignSecret(ctx context.Context, syncCtx factory.SyncContext, existing *corev1.Secret, roleARN string) error {
+	if parseAWSConfigValue(existing.Data[awsCredentialsKey], awsRoleARNKey) != roleARN {
+		secret := existing.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[awsCredentialsKey] = renderWebIdentityCredentials(roleARN)
+		if _, _, err := resourceapply.ApplySecret(ctx, c.kubeClient.CoreV1(), syncCtx.Recorder(), secret); err != nil {
+			return err
+		}
+	}
+	return c.updateCondition(ctx, opv1.OperatorCondition{
+		Type:    hypershiftCredentialsConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: fmt.Sprintf("Using role %s in Secret %s/%s, it was not created by the operator", roleARN, c.namespace, cloudCredSecretName),
+	})
+}
+
+func (c *hypershiftCredentialsController) updateCondition(ctx context.Context, condition opv1.OperatorCondition) error {
+	_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// getHostedControlPlaneStorageRoleARN returns spec.platform.aws.rolesRef.storageARN of the HostedControlPlane.
+func getHostedControlPlaneStorageRoleARN(hostedControlPlaneLister cache.GenericLister, namespace string) (string, error) {
+	hcp, err := getHostedControlPlane(hostedControlPlaneLister, namespace)
+	if err != nil {
+		return "", err
+	}
+	roleARN, _, err := unstructured.NestedString(hcp.UnstructuredContent(), "spec", "platform", "aws", "rolesRef", "storageARN")
+	if err != nil {
+		return "", err
+	}
+	return roleARN, nil
+}
+
+// renderWebIdentityCredentials returns an AWS config file that assumes the role with the web identity token.
+func renderWebIdentityCredentials(roleARN string) []byte {
+	return []byte(fmt.Sprintf("[default]\nrole_arn = %s\nweb_identity_token_file = %s\n", roleARN, webIdentityTokenFile))
+}
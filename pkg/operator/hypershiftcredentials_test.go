@@ -0,0 +1,167 @@
+package operator
+
+import (
+	"context"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHypershiftCredentialsSync(t *testing.T) {
+	const namespace = "clusters-test"
+	const roleARN = "arn:aws:iam::123456789012:role/test-aws-ebs-csi-driver-controller"
+	storageRoleSpec := map[string]interface{}{
+		"platform": map[string]interface{}{
+			"aws": map[string]interface{}{
+				"rolesRef": map[string]interface{}{
+					"storageARN": roleARN,
+				},
+			},
+		},
+	}
+	expectedCfg := "[default]\n" +
+		"role_arn = " + roleARN + "\n" +
+		"web_identity_token_file = /var/run/secrets/openshift/serviceaccount/token\n"
+	newSecret := func(annotations map[string]string, cfg string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: cloudCredSecretName, Namespace: namespace, Annotations: annotations},
+			Data:       map[string][]byte{awsCredentialsKey: []byte(cfg)},
+		}
+	}
+
+	tests := []struct {
+		name              string
+		spec              map[string]interface{}
+		existingSecret    *corev1.Secret
+		expectedStatus    opv1.ConditionStatus
+		expectedReason    string
+		expectedSecretCfg string
+	}{
+		{
+			name:              "storage role set",
+			spec:              storageRoleSpec,
+			expectedStatus:    opv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedSecretCfg: expectedCfg,
+		},
+		{
+			name:              "Secret rendered by the operator",
+			spec:              storageRoleSpec,
+			existingSecret:    newSecret(map[string]string{credentialsOwnerAnnotation: operatorName}, "old"),
+			expectedStatus:    opv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedSecretCfg: expectedCfg,
+		},
+		{
+			name:              "Secret written by HyperShift with the storage role",
+			spec:              storageRoleSpec,
+			existingSecret:    newSecret(nil, "[default]\nrole_arn = "+roleARN+"\nweb_identity_token_file = /token\n"),
+			expectedStatus:    opv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedSecretCfg: "[default]\nrole_arn = " + roleARN + "\nweb_identity_token_file = /token\n",
+		},
+		{
+			name:              "Secret written by HyperShift with another role",
+			spec:              storageRoleSpec,
+			existingSecret:    newSecret(nil, "[default]\nrole_arn = arn:aws:iam::123456789012:role/other\n"),
+			expectedStatus:    opv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedSecretCfg: expectedCfg,
+		},
+		{
+			name: "storage role missing",
+			spec: map[string]interface{}{
+				"platform": map[string]interface{}{
+					"aws": map[string]interface{}{},
+				},
+			},
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "StorageRoleMissing",
+		},
+		{
+			name: "storage role missing with Secret written by HyperShift",
+			spec: map[string]interface{}{
+				"platform": map[string]interface{}{
+					"aws": map[string]interface{}{},
+				},
+			},
+			existingSecret:    newSecret(nil, "hypershift"),
+			expectedStatus:    opv1.ConditionTrue,
+			expectedReason:    "StorageRoleMissing",
+			expectedSecretCfg: "hypershift",
+		},
+		{
+			name: "invalid storage role",
+			spec: map[string]interface{}{
+				"platform": map[string]interface{}{
+					"aws": map[string]interface{}{
+						"rolesRef": map[string]interface{}{
+							"storageARN": "test-role",
+						},
+					},
+				},
+			},
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "InvalidStorageRole",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			secretInformer := informers.NewSharedInformerFactory(kubeClient, 0).Core().V1().Secrets()
+			if test.existingSecret != nil {
+				kubeClient.Tracker().Add(test.existingSecret)
+				secretInformer.Informer().GetIndexer().Add(test.existingSecret)
+			}
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			c := &hypershiftCredentialsController{
+				operatorClient:           operatorClient,
+				kubeClient:               kubeClient,
+				namespace:                namespace,
+				hostedControlPlaneLister: newHostedControlPlaneLister(t, hostedControlPlane(namespace, test.spec)),
+				secretLister:             secretInformer.Lister().Secrets(namespace),
+			}
+			if err := c.sync(context.TODO(), factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, hypershiftCredentialsConditionType)
+			if condition == nil {
+				t.Fatalf("condition %s not found", hypershiftCredentialsConditionType)
+			}
+			if condition.Status != test.expectedStatus || condition.Reason != test.expectedReason {
+				t.Errorf("expected %s/%s, got %s/%s: %s", test.expectedStatus, test.expectedReason, condition.Status, condition.Reason, condition.Message)
+			}
+
+			secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), cloudCredSecretName, metav1.GetOptions{})
+			if test.expectedSecretCfg == "" {
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("expected no Secret, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get Secret: %v", err)
+			}
+			if cfg := string(secret.Data[awsCredentialsKey]); cfg != test.expectedSecretCfg {
+				t.Errorf("unexpected credentials:\n%s", cfg)
+			}
+			if test.existingSecret != nil && secret.Annotations[credentialsOwnerAnnotation] != test.existingSecret.Annotations[credentialsOwnerAnnotation] {
+				t.Errorf("unexpected annotations %v", secret.Annotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	opv1 "github.com/openshift/api/operator/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeclient "k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// kmsInventoryEC2EndpointAnnotation on the ClusterCSIDriver replaces the EC2 endpoint of the
+	// cluster for the DescribeVolumes calls of the KMS key inventory, e.g. a VPC endpoint.
+	kmsInventoryEC2EndpointAnnotation = "ebs.csi.openshift.io/kms-inventory-ec2-endpoint"
+
+	// kmsInventoryConfigMap is the report for the admin. The KMS key of each EBS PV is stored in the
+	// kmsInventoryKey of the shards of the inventory, the kmsInventoryConfigMap-<index> ConfigMaps.
+	kmsInventoryConfigMap = "aws-ebs-csi-driver-kms-key-inventory"
+	kmsInventoryKey       = "inventory.json"
+	// kmsInventoryShardsKey is the number of shards of the inventory.
+	kmsInventoryShardsKey = "shards"
+	// kmsInventoryOldKeyVolumesKey lists the PVs that are not encrypted with the current key of their StorageClass.
+	kmsInventoryOldKeyVolumesKey = "old-key-volumes"
+	// kmsInventoryUnverifiedVolumesKey lists the PVs with a KMS key that is not verified with EC2.
+	kmsInventoryUnverifiedVolumesKey = "unverified-volumes"
+
+	// kmsInventoryShardSize is the maximum number of PVs in a shard. An entry has less than 1 KiB,
+	// so a shard stays below the 1 MiB limit of a ConfigMap.
+	kmsInventoryShardSize = 1000
+	// kmsInventoryMaxListedVolumes limits the number of PVs in each list of the kmsInventoryConfigMap.
+	kmsInventoryMaxListedVolumes = 1000
+
+	kmsInventoryUnverifiedConditionType = "AWSEBSKMSKeyInventoryUnverified"
+
+	// Sources of the KMS key of a volume. The key of a PV created before its StorageClass is unknown
+	// until it's verified with EC2.
+	kmsKeySourceStorageClass = "StorageClass"
+	kmsKeySourceEC2          = "EC2"
+	kmsKeySourceUnknown      = "Unknown"
+
+	// kmsKeyAWSManaged is the metric label of volumes encrypted with the AWS managed key.
+	kmsKeyAWSManaged = "aws/ebs"
+	// kmsKeyUnencrypted is the metric label of unencrypted volumes.
+	kmsKeyUnencrypted = "none"
+	// kmsKeyUnknown is the metric label of volumes with an unknown key.
+	kmsKeyUnknown = "unknown"
+
+	kmsInventoryBatchSize = 100
+	kmsInventoryQPS       = 5
+	kmsInventoryBurst     = 10
+)
+
+var kmsKeyVolumesMetric = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Namespace:      "aws_ebs_csi_driver_operator",
+		Name:           "kms_key_volumes",
+		Help:           "Number of EBS PVs encrypted with a KMS key.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"kms_key"},
+)
+
+func init() {
+	legacyregistry.MustRegister(kmsKeyVolumesMetric)
+}
+
+// kmsInventoryVolume is the KMS key of a PV in the kmsInventoryConfigMap.
+type kmsInventoryVolume struct {
+	VolumeID     string `json:"volumeID"`
+	StorageClass string `json:"storageClass,omitempty"`
+	Encrypted    bool   `json:"encrypted"`
+	// KMSKeyID is the key of the volume, from EC2 when available. Empty for the AWS managed key.
+	KMSKeyID string `json:"kmsKeyId,omitempty"`
+	// StorageClassKMSKeyID is the kmsKeyId parameter of the StorageClass when the PV was first seen.
+	StorageClassKMSKeyID string `json:"storageClassKmsKeyId,omitempty"`
+	Source               string `json:"source"`
+	OldKey               bool   `json:"oldKey,omitempty"`
+	// Unverified is set when the key was not verified with EC2. The key of a PV that existed before
+	// the inventory is the one of its StorageClass when the PV was first seen. StorageClass parameters
+	// are immutable, so it's the key of the volume, unless the StorageClass was re-created with another
+	// key since the PV was provisioned, then the key is unknown.
+	Unverified bool `json:"unverified,omitempty"`
+}
+
+// kmsInventoryController records the KMS key of each EBS PV in the kmsInventoryConfigMap and
+// exports the number of PVs of each key. The key is taken from the StorageClass parameters when
+// the PV is first seen, so changes of the StorageClass later on don't change it. With the driver
+// credentials, see getEC2ClientConfig, it's replaced by the key EC2 reports for the volume. PVs that are not encrypted
+// with the current key of their StorageClass are listed as old key volumes. PVs not verified with
+// EC2 are listed as unverified volumes and reported in the AWSEBSKMSKeyInventoryUnverified condition,
+// which stays True while the driver has no credentials the operator can use.
+type kmsInventoryController struct {
+	operatorClient     v1helpers.OperatorClient
+	kubeClient         kubeclient.Interface
+	namespace          string
+	ccdLister          oplisterv1.ClusterCSIDriverLister
+	pvLister           corev1listers.PersistentVolumeLister
+	storageClassLister storagev1listers.StorageClassLister
+	configMapLister    corev1listers.ConfigMapNamespaceLister
+	rateLimiter        flowcontrol.RateLimiter
+	// newEC2Client returns the EC2 client to use, with the given endpoint or the one of the driver.
+	newEC2Client func(endpoint string) (*ec2.Client, error)
+}
+
+func newKMSInventoryController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubeclient.Interface,
+	namespace string,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	pvLister corev1listers.PersistentVolumeLister,
+	storageClassLister storagev1listers.StorageClassLister,
+	configMapLister corev1listers.ConfigMapNamespaceLister,
+	newEC2Client func(endpoint string) (*ec2.Client, error),
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &kmsInventoryController{
+		operatorClient:     operatorClient,
+		kubeClient:         kubeClient,
+		namespace:          namespace,
+		ccdLister:          ccdLister,
+		pvLister:           pvLister,
+		storageClassLister: storageClassLister,
+		configMapLister:    configMapLister,
+		rateLimiter:        flowcontrol.NewTokenBucketRateLimiter(kmsInventoryQPS, kmsInventoryBurst),
+		newEC2Client:       newEC2Client,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		resync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *kmsInventoryController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	ccd, err := c.ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return err
+	}
+	endpoint := ccd.Annotations[kmsInventoryEC2EndpointAnnotation]
+	if endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid %s annotation %q: must be an https URL", kmsInventoryEC2EndpointAnnotation, endpoint)
+		}
+	}
+
+	previous, shards, err := c.getInventory()
+	if err != nil {
+		return err
+	}
+	pvs, err := c.pvLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	inventory := map[string]*kmsInventoryVolume{}
+	var unresolved []string
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != string(opv1.AWSEBSCSIDriver) {
+			continue
+		}
+		volume, ok := previous[pv.Name]
+		if !ok || volume.VolumeID != pv.Spec.CSI.VolumeHandle {
+			volume = c.volumeFromStorageClass(pv)
+		}
+		inventory[pv.Name] = volume
+		if volume.Source != kmsKeySourceEC2 {
+			unresolved = append(unresolved, pv.Name)
+		}
+	}
+
+	// The key of a volume can't change, so EC2 is asked only once for each volume.
+	if len(unresolved) > 0 {
+		ec2Client, err := c.newEC2Client(endpoint)
+		switch {
+		case errors.Is(err, errNoAWSCredentials):
+			klog.V(2).Infof("Using the StorageClasses for the KMS keys of %d PVs: %v", len(unresolved), err)
+		case err != nil:
+			return err
+		default:
+			if err := c.resolveFromEC2(ctx, ec2Client, inventory, unresolved); err != nil {
+				return err
+			}
+		}
+	}
+
+	counts := map[string]int{}
+	var oldKeyVolumes, unverifiedVolumes []string
+	for pvName, volume := range inventory {
+		expected, err := c.expectedKMSKey(ccd, volume.StorageClass)
+		if err != nil {
+			return err
+		}
+		volume.OldKey = isOldKMSKey(volume, expected)
+		if volume.OldKey {
+			oldKeyVolumes = append(oldKeyVolumes, pvName)
+		}
+		volume.Unverified = volume.Source != kmsKeySourceEC2
+		if volume.Unverified {
+			unverifiedVolumes = append(unverifiedVolumes, pvName)
+		}
+		counts[kmsKeyMetricLabel(volume)]++
+	}
+	sort.Strings(oldKeyVolumes)
+	sort.Strings(unverifiedVolumes)
+
+	kmsKeyVolumesMetric.Reset()
+	for key, count := range counts {
+		kmsKeyVolumesMetric.WithLabelValues(key).Set(float64(count))
+	}
+	if err := c.saveInventory(ctx, syncCtx.Recorder(), inventory, shards, oldKeyVolumes, unverifiedVolumes); err != nil {
+		return err
+	}
+
+	condition := opv1.OperatorCondition{
+		Type:    kmsInventoryUnverifiedConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: "The KMS keys of all PVs are verified with EC2",
+	}
+	if len(unverifiedVolumes) > 0 {
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "VolumesNotVerified"
+		condition.Message = fmt.Sprintf("The KMS keys of %d PVs are not verified with EC2, they are the keys of their StorageClasses when the PVs were first seen, or unknown for PVs created before their StorageClass. The PVs are listed in the %s key of the %s ConfigMap",
+			len(unverifiedVolumes), kmsInventoryUnverifiedVolumesKey, kmsInventoryConfigMap)
+	}
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// volumeFromStorageClass returns the KMS key of the PV from the current parameters of its StorageClass.
+// The parameters of a StorageClass can't change, so they are the ones the PV was provisioned with when
+// the StorageClass is older than the PV. Otherwise the StorageClass was re-created and the key is unknown.
+func (c *kmsInventoryController) volumeFromStorageClass(pv *corev1.PersistentVolume) *kmsInventoryVolume {
+	volume := &kmsInventoryVolume{
+		VolumeID:     pv.Spec.CSI.VolumeHandle,
+		StorageClass: pv.Spec.StorageClassName,
+		Source:       kmsKeySourceStorageClass,
+	}
+	if pv.Spec.StorageClassName == "" {
+		return volume
+	}
+	sc, err := c.storageClassLister.Get(pv.Spec.StorageClassName)
+	if err != nil {
+		klog.V(4).Infof("Failed to get StorageClass %s of PV %s: %v", pv.Spec.StorageClassName, pv.Name, err)
+		return volume
+	}
+	if pv.CreationTimestamp.Before(&sc.CreationTimestamp) {
+		klog.V(4).Infof("StorageClass %s was created after PV %s, the KMS key of the PV is unknown", sc.Name, pv.Name)
+		volume.Source = kmsKeySourceUnknown
+		return volume
+	}
+	volume.Encrypted = sc.Parameters["encrypted"] == "true"
+	volume.StorageClassKMSKeyID = sc.Parameters[kmsKeyID]
+	volume.KMSKeyID = volume.StorageClassKMSKeyID
+	return volume
+}
+
+// resolveFromEC2 replaces the KMS keys of the unresolved PVs by the ones reported by EC2.
+func (c *kmsInventoryController) resolveFromEC2(ctx context.Context, ec2Client *ec2.Client, inventory map[string]*kmsInventoryVolume, unresolved []string) error {
+	byVolumeID := map[string]*kmsInventoryVolume{}
+	volumeIDs := make([]string, 0, len(unresolved))
+	for _, pvName := range unresolved {
+		byVolumeID[inventory[pvName].VolumeID] = inventory[pvName]
+		volumeIDs = append(volumeIDs, inventory[pvName].VolumeID)
+	}
+	sort.Strings(volumeIDs)
+
+	for start := 0; start < len(volumeIDs); start += kmsInventoryBatchSize {
+		end := start + kmsInventoryBatchSize
+		if end > len(volumeIDs) {
+			end = len(volumeIDs)
+		}
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			return err
+		}
+		// A filter, unlike VolumeIds, does not fail the whole call when a volume was deleted.
+		paginator := ec2.NewDescribeVolumesPaginator(ec2Client, &ec2.DescribeVolumesInput{
+			Filters: []ec2types.Filter{
+				{
+					Name:   aws.String("volume-id"),
+					Values: volumeIDs[start:end],
+				},
+			},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to describe volumes: %w", err)
+			}
+			for _, ec2Volume := range page.Volumes {
+				volume, ok := byVolumeID[aws.ToString(ec2Volume.VolumeId)]
+				if !ok {
+					continue
+				}
+				volume.Encrypted = aws.ToBool(ec2Volume.Encrypted)
+				volume.KMSKeyID = aws.ToString(ec2Volume.KmsKeyId)
+				volume.Source = kmsKeySourceEC2
+			}
+		}
+	}
+	return nil
+}
+
+// expectedKMSKey returns the key new volumes of the StorageClass get. When the StorageClass
+// does not exist anymore, it's the key getKMSKeyHook would set.
+func (c *kmsInventoryController) expectedKMSKey(ccd *opv1.ClusterCSIDriver, scName string) (string, error) {
+	sc, err := c.storageClassLister.Get(scName)
+	if err == nil {
+		return sc.Parameters[kmsKeyID], nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+	return getStorageClassKMSKey(ccd, scName)
+}
+
+// isOldKMSKey returns true when the encrypted volume does not use the expected key.
+// EC2 reports key ARNs, also for the AWS managed key, so aliases and the AWS managed key
+// are compared with the StorageClass parameter the volume was provisioned with.
+func isOldKMSKey(volume *kmsInventoryVolume, expected string) bool {
+	if volume.Source == kmsKeySourceUnknown || !volume.Encrypted {
+		return false
+	}
+	if volume.Source == kmsKeySourceEC2 && strings.Contains(expected, ":key/") {
+		return volume.KMSKeyID != expected
+	}
+	return volume.StorageClassKMSKeyID != expected
+}
+
+func kmsKeyMetricLabel(volume *kmsInventoryVolume) string {
+	switch {
+	case volume.Source == kmsKeySourceUnknown:
+		return kmsKeyUnknown
+	case !volume.Encrypted:
+		return kmsKeyUnencrypted
+	case volume.KMSKeyID == "":
+		return kmsKeyAWSManaged
+	default:
+		return volume.KMSKeyID
+	}
+}
+
+func kmsInventoryShardName(index int) string {
+	return fmt.Sprintf("%s-%d", kmsInventoryConfigMap, index)
+}
+
+// getInventory returns the inventory and the number of its shards.
+func (c *kmsInventoryController) getInventory() (map[string]*kmsInventoryVolume, int, error) {
+	inventory := map[string]*kmsInventoryVolume{}
+	cm, err := c.configMapLister.Get(kmsInventoryConfigMap)
+	if apierrors.IsNotFound(err) {
+		return inventory, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	shards, _ := strconv.Atoi(cm.Data[kmsInventoryShardsKey])
+	for index := 0; index < shards; index++ {
+		name := kmsInventoryShardName(index)
+		shard, err := c.configMapLister.Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal([]byte(shard.Data[kmsInventoryKey]), &inventory); err != nil {
+			klog.Warningf("Ignoring malformed KMS key inventory in ConfigMap %s: %v", name, err)
+		}
+	}
+	return inventory, shards, nil
+}
+
+// saveInventory stores the inventory in shards of kmsInventoryShardSize PVs, deletes the shards that
+// are not needed anymore and updates the report in the kmsInventoryConfigMap.
+func (c *kmsInventoryController) saveInventory(ctx context.Context, recorder events.Recorder, inventory map[string]*kmsInventoryVolume, previousShards int, oldKeyVolumes, unverifiedVolumes []string) error {
+	pvNames := make([]string, 0, len(inventory))
+	for pvName := range inventory {
+		pvNames = append(pvNames, pvName)
+	}
+	sort.Strings(pvNames)
+
+	shards := 0
+	for start := 0; start < len(pvNames); start += kmsInventoryShardSize {
+		end := start + kmsInventoryShardSize
+		if end > len(pvNames) {
+			end = len(pvNames)
+		}
+		shard := make(map[string]*kmsInventoryVolume, end-start)
+		for _, pvName := range pvNames[start:end] {
+			shard[pvName] = inventory[pvName]
+		}
+		data, err := json.Marshal(shard)
+		if err != nil {
+			return err
+		}
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      kmsInventoryShardName(shards),
+				Namespace: c.namespace,
+			},
+			Data: map[string]string{kmsInventoryKey: string(data)},
+		}
+		if _, _, err := resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), recorder, cm); err != nil {
+			return err
+		}
+		shards++
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kmsInventoryConfigMap,
+			Namespace: c.namespace,
+		},
+		Data: map[string]string{
+			kmsInventoryShardsKey:            strconv.Itoa(shards),
+			kmsInventoryOldKeyVolumesKey:     listVolumes(oldKeyVolumes),
+			kmsInventoryUnverifiedVolumesKey: listVolumes(unverifiedVolumes),
+		},
+	}
+	if _, _, err := resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), recorder, cm); err != nil {
+		return err
+	}
+
+	for index := shards; index < previousShards; index++ {
+		err := c.kubeClient.CoreV1().ConfigMaps(c.namespace).Delete(ctx, kmsInventoryShardName(index), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listVolumes returns the PV names, one per line, with at most kmsInventoryMaxListedVolumes names.
+func listVolumes(pvNames []string) string {
+	if len(pvNames) <= kmsInventoryMaxListedVolumes {
+		return strings.Join(pvNames, "\n")
+	}
+	return strings.Join(pvNames[:kmsInventoryMaxListedVolumes], "\n") + fmt.Sprintf("\nand %d more", len(pvNames)-kmsInventoryMaxListedVolumes)
+}
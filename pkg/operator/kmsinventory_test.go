@@ -0,0 +1,283 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// fakeEC2Volumes is a minimal stand-in for the EC2 Query API that supports DescribeVolumes.
+type fakeEC2Volumes struct {
+	lock sync.Mutex
+	// volumes are the KMS key ARNs of the encrypted volumes, "" for unencrypted ones.
+	volumes  map[string]string
+	requests int
+}
+
+func (f *fakeEC2Volumes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "DescribeVolumes" {
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+		return
+	}
+	f.requests++
+	fmt.Fprintf(w, "<DescribeVolumesResponse><requestId>1</requestId><volumeSet>")
+	for i := 1; r.Form.Get(fmt.Sprintf("Filter.1.Value.%d", i)) != ""; i++ {
+		id := r.Form.Get(fmt.Sprintf("Filter.1.Value.%d", i))
+		key, ok := f.volumes[id]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "<item><volumeId>%s</volumeId><encrypted>%t</encrypted><kmsKeyId>%s</kmsKeyId></item>", id, key != "", key)
+	}
+	fmt.Fprintf(w, "</volumeSet></DescribeVolumesResponse>")
+}
+
+func TestKMSInventoryController(t *testing.T) {
+	const (
+		oldKey     = "arn:aws:kms:us-east-1:111122223333:key/old"
+		newKey     = "arn:aws:kms:us-east-1:111122223333:key/new"
+		managedKey = "arn:aws:kms:us-east-1:111122223333:key/aws-managed"
+	)
+	newPV := func(name, handle, scName string) *corev1.PersistentVolume {
+		pv := csiPV(name, provisionerName, handle)
+		pv.Spec.StorageClassName = scName
+		return pv
+	}
+	previousInventory, _ := json.Marshal(map[string]*kmsInventoryVolume{
+		"pv-1":      {VolumeID: "vol-1", StorageClass: "gp3-csi", Encrypted: true, KMSKeyID: oldKey, StorageClassKMSKeyID: oldKey, Source: kmsKeySourceStorageClass},
+		"pv-delete": {VolumeID: "vol-deleted", Source: kmsKeySourceEC2},
+	})
+
+	tests := []struct {
+		name                      string
+		withEC2                   bool
+		expectedOldKeyVolumes     string
+		expectedUnverifiedVolumes string
+		expectedCounts            map[string]float64
+		expectedSource            string
+	}{
+		{
+			name:                      "StorageClass parameters",
+			expectedOldKeyVolumes:     "pv-1",
+			expectedUnverifiedVolumes: "pv-1\npv-2\npv-3",
+			expectedCounts:            map[string]float64{oldKey: 1, newKey: 1, kmsKeyUnknown: 1},
+			expectedSource:            kmsKeySourceStorageClass,
+		},
+		{
+			name:                  "EC2",
+			withEC2:               true,
+			expectedOldKeyVolumes: "pv-1",
+			expectedCounts:        map[string]float64{oldKey: 1, newKey: 1, managedKey: 1},
+			expectedSource:        kmsKeySourceEC2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ec2Server := &fakeEC2Volumes{volumes: map[string]string{"vol-1": oldKey, "vol-2": newKey, "vol-3": managedKey}}
+			server := httptest.NewTLSServer(ec2Server)
+			defer server.Close()
+			caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+			stateCM := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: kmsInventoryConfigMap, Namespace: defaultNamespace},
+				Data:       map[string]string{kmsInventoryShardsKey: "1"},
+			}
+			shardCM := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: kmsInventoryShardName(0), Namespace: defaultNamespace},
+				Data:       map[string]string{kmsInventoryKey: string(previousInventory)},
+			}
+			kubeClient := fake.NewSimpleClientset(stateCM, shardCM)
+			informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+			configMapIndexer := informerFactory.Core().V1().ConfigMaps().Informer().GetIndexer()
+			configMapIndexer.Add(stateCM)
+			configMapIndexer.Add(shardCM)
+			pvIndexer := informerFactory.Core().V1().PersistentVolumes().Informer().GetIndexer()
+			pvIndexer.Add(newPV("pv-1", "vol-1", "gp3-csi"))
+			pvIndexer.Add(newPV("pv-2", "vol-2", "gp3-csi"))
+			pvIndexer.Add(newPV("pv-3", "vol-3", "custom"))
+			pvIndexer.Add(csiPV("pv-other", "other.csi.example.com", "vol-4"))
+			scIndexer := informerFactory.Storage().V1().StorageClasses().Informer().GetIndexer()
+			scIndexer.Add(&storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "gp3-csi"},
+				Parameters: map[string]string{"type": "gp3", "encrypted": "true", kmsKeyID: newKey},
+			})
+			// Re-created after pv-3, so the key of pv-3 is unknown.
+			scIndexer.Add(&storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "custom", CreationTimestamp: metav1.Now()},
+				Parameters: map[string]string{"type": "gp3"},
+			})
+
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			c := &kmsInventoryController{
+				operatorClient: operatorClient,
+				kubeClient:     kubeClient,
+				namespace:      defaultNamespace,
+				ccdLister: &fakeCCDLister{&opv1.ClusterCSIDriver{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        provisionerName,
+						Annotations: map[string]string{kmsInventoryEC2EndpointAnnotation: server.URL},
+					},
+				}},
+				pvLister:           informerFactory.Core().V1().PersistentVolumes().Lister(),
+				storageClassLister: informerFactory.Storage().V1().StorageClasses().Lister(),
+				configMapLister:    informerFactory.Core().V1().ConfigMaps().Lister().ConfigMaps(defaultNamespace),
+				rateLimiter:        flowcontrol.NewFakeAlwaysRateLimiter(),
+				newEC2Client: func(endpoint string) (*ec2.Client, error) {
+					if !test.withEC2 {
+						return nil, errNoAWSCredentials
+					}
+					return newEC2Client(&ec2ClientConfig{
+						region:          "us-east-1",
+						endpoint:        endpoint,
+						caBundle:        caBundle,
+						accessKeyID:     "id",
+						secretAccessKey: "secret",
+					})
+				},
+			}
+
+			// EC2 is asked only in the first sync.
+			for i := 0; i < 2; i++ {
+				if err := c.sync(context.TODO(), factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				syncConfigMapIndexer(t, kubeClient, defaultNamespace, configMapIndexer)
+			}
+			if test.withEC2 && ec2Server.requests != 1 {
+				t.Errorf("expected 1 EC2 request, got %d", ec2Server.requests)
+			}
+
+			cm, _ := kubeClient.CoreV1().ConfigMaps(defaultNamespace).Get(context.TODO(), kmsInventoryConfigMap, metav1.GetOptions{})
+			if oldKeyVolumes := cm.Data[kmsInventoryOldKeyVolumesKey]; oldKeyVolumes != test.expectedOldKeyVolumes {
+				t.Errorf("expected old key volumes %q, got %q", test.expectedOldKeyVolumes, oldKeyVolumes)
+			}
+			if unverifiedVolumes := cm.Data[kmsInventoryUnverifiedVolumesKey]; unverifiedVolumes != test.expectedUnverifiedVolumes {
+				t.Errorf("expected unverified volumes %q, got %q", test.expectedUnverifiedVolumes, unverifiedVolumes)
+			}
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, kmsInventoryUnverifiedConditionType)
+			if condition == nil || (condition.Status == opv1.ConditionTrue) != (test.expectedUnverifiedVolumes != "") {
+				t.Errorf("unexpected condition %+v", condition)
+			}
+			inventory, shards, err := c.getInventory()
+			if err != nil {
+				t.Fatalf("failed to get the inventory: %v", err)
+			}
+			if shards != 1 || len(inventory) != 3 {
+				t.Errorf("expected 3 PVs in the inventory, got %+v", inventory)
+			}
+			if volume := inventory["pv-2"]; volume == nil || volume.Source != test.expectedSource || volume.Unverified != (test.expectedSource != kmsKeySourceEC2) {
+				t.Errorf("expected source %s of pv-2, got %+v", test.expectedSource, volume)
+			}
+			if volume := inventory["pv-3"]; !test.withEC2 && (volume == nil || volume.Source != kmsKeySourceUnknown) {
+				t.Errorf("expected an unknown key of pv-3, got %+v", volume)
+			}
+			for key, expected := range test.expectedCounts {
+				value, err := testutil.GetGaugeMetricValue(kmsKeyVolumesMetric.WithLabelValues(key))
+				if err != nil {
+					t.Fatalf("failed to get metric: %v", err)
+				}
+				if value != expected {
+					t.Errorf("expected %v volumes with key %s, got %v", expected, key, value)
+				}
+			}
+		})
+	}
+}
+
+func TestKMSInventoryShards(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	configMapIndexer := informerFactory.Core().V1().ConfigMaps().Informer().GetIndexer()
+	pvIndexer := informerFactory.Core().V1().PersistentVolumes().Informer().GetIndexer()
+	for i := 0; i < 2*kmsInventoryShardSize+1; i++ {
+		pvIndexer.Add(csiPV(fmt.Sprintf("pv-%04d", i), provisionerName, fmt.Sprintf("vol-%04d", i)))
+	}
+	c := &kmsInventoryController{
+		operatorClient: v1helpers.NewFakeOperatorClient(
+			&opv1.OperatorSpec{ManagementState: opv1.Managed},
+			&opv1.OperatorStatus{},
+			nil,
+		),
+		kubeClient:         kubeClient,
+		namespace:          defaultNamespace,
+		ccdLister:          &fakeCCDLister{&opv1.ClusterCSIDriver{ObjectMeta: metav1.ObjectMeta{Name: provisionerName}}},
+		pvLister:           informerFactory.Core().V1().PersistentVolumes().Lister(),
+		storageClassLister: informerFactory.Storage().V1().StorageClasses().Lister(),
+		configMapLister:    informerFactory.Core().V1().ConfigMaps().Lister().ConfigMaps(defaultNamespace),
+		rateLimiter:        flowcontrol.NewFakeAlwaysRateLimiter(),
+		newEC2Client: func(string) (*ec2.Client, error) {
+			return nil, errNoAWSCredentials
+		},
+	}
+	sync := func() {
+		if err := c.sync(context.TODO(), factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		syncConfigMapIndexer(t, kubeClient, defaultNamespace, configMapIndexer)
+	}
+
+	sync()
+	inventory, shards, err := c.getInventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shards != 3 || len(inventory) != 2*kmsInventoryShardSize+1 {
+		t.Errorf("expected %d PVs in 3 shards, got %d PVs in %d shards", 2*kmsInventoryShardSize+1, len(inventory), shards)
+	}
+	cm, _ := kubeClient.CoreV1().ConfigMaps(defaultNamespace).Get(context.TODO(), kmsInventoryConfigMap, metav1.GetOptions{})
+	if expected := fmt.Sprintf("and %d more", kmsInventoryShardSize+1); !strings.HasSuffix(cm.Data[kmsInventoryUnverifiedVolumesKey], expected) {
+		t.Errorf("expected the unverified volumes to end with %q", expected)
+	}
+
+	// The shards that are not needed anymore are deleted.
+	for i := 1; i < 2*kmsInventoryShardSize+1; i++ {
+		pvIndexer.Delete(csiPV(fmt.Sprintf("pv-%04d", i), provisionerName, fmt.Sprintf("vol-%04d", i)))
+	}
+	sync()
+	configMaps, _ := kubeClient.CoreV1().ConfigMaps(defaultNamespace).List(context.TODO(), metav1.ListOptions{})
+	if len(configMaps.Items) != 2 {
+		t.Errorf("expected the report and 1 shard, got %d ConfigMaps", len(configMaps.Items))
+	}
+}
+
+// syncConfigMapIndexer replaces the ConfigMaps of the indexer by the ones of the client in the namespace.
+func syncConfigMapIndexer(t *testing.T, kubeClient *fake.Clientset, namespace string, indexer cache.Indexer) {
+	configMaps, err := kubeClient.CoreV1().ConfigMaps(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list ConfigMaps: %v", err)
+	}
+	var objects []interface{}
+	for i := range configMaps.Items {
+		objects = append(objects, &configMaps.Items[i])
+	}
+	if err := indexer.Replace(objects, ""); err != nil {
+		t.Fatal(err)
+	}
+}
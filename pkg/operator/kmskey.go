@@ -0,0 +1,218 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	opv1 "github.com/openshift/api/operator/v1"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	// storageClassKMSKeysAnnotation on the ClusterCSIDriver is a JSON object with the KMS key ARNs of
+	// StorageClasses created by the operator, e.g. {"io2-csi": "arn:aws:kms:us-east-1:111122223333:key/..."}.
+	// They replace AWSCSIDriverConfigSpec.KMSKeyARN in these StorageClasses.
+	storageClassKMSKeysAnnotation = "ebs.csi.openshift.io/storage-class-kms-keys"
+
+	kmsKeyConditionType = "AWSEBSKMSKeyDegraded"
+)
+
+// getStorageClassKMSKeys parses the storageClassKMSKeysAnnotation of the ClusterCSIDriver.
+func getStorageClassKMSKeys(ccd *opv1.ClusterCSIDriver) (map[string]string, error) {
+	value, ok := ccd.Annotations[storageClassKMSKeysAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var keys map[string]string
+	if err := json.Unmarshal([]byte(value), &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse the %s annotation: %w", storageClassKMSKeysAnnotation, err)
+	}
+	return keys, nil
+}
+
+// getDefaultKMSKey returns the KMSKeyARN of the AWSCSIDriverConfigSpec of the ClusterCSIDriver.
+func getDefaultKMSKey(ccd *opv1.ClusterCSIDriver) string {
+	driverConfig := ccd.Spec.DriverConfig
+	if driverConfig.DriverType != opv1.AWSDriverType || driverConfig.AWS == nil {
+		return ""
+	}
+	return driverConfig.AWS.KMSKeyARN
+}
+
+// getStorageClassKMSKey returns the KMS key ARN of the StorageClass, either from the
+// storageClassKMSKeysAnnotation or the default one. It returns "" when no key is configured.
+func getStorageClassKMSKey(ccd *opv1.ClusterCSIDriver, scName string) (string, error) {
+	keys, err := getStorageClassKMSKeys(ccd)
+	if err != nil {
+		return "", err
+	}
+	if key, ok := keys[scName]; ok {
+		return key, nil
+	}
+	return getDefaultKMSKey(ccd), nil
+}
+
+// getAWSRegion returns the region of the cluster, or "" when the Infrastructure has none.
+func getAWSRegion(infraLister v1.InfrastructureLister) (string, error) {
+	infra, err := infraLister.Get(infrastructureName)
+	if err != nil {
+		return "", err
+	}
+	if infra.Status.PlatformStatus == nil || infra.Status.PlatformStatus.AWS == nil {
+		return "", nil
+	}
+	return infra.Status.PlatformStatus.AWS.Region, nil
+}
+
+// validateKMSKeyARN checks that the ARN is a KMS key or alias ARN usable for EBS volumes in the region.
+// EBS accepts only keys in the region of the volume. When region is empty, only the format is checked.
+func validateKMSKeyARN(keyARN, region string) error {
+	parsed, err := arn.Parse(keyARN)
+	if err != nil {
+		return fmt.Errorf("invalid KMS key ARN %q: %w", keyARN, err)
+	}
+	if parsed.Service != "kms" {
+		return fmt.Errorf("invalid KMS key ARN %q: service %q is not kms", keyARN, parsed.Service)
+	}
+	if region == "" {
+		return nil
+	}
+	if partition := awsPartitionForRegion(region); parsed.Partition != partition {
+		return fmt.Errorf("KMS key ARN %q is in partition %q, but the cluster region %s is in partition %q", keyARN, parsed.Partition, region, partition)
+	}
+	if parsed.Region != region {
+		return fmt.Errorf("KMS key ARN %q is in region %q, but the cluster is in region %q", keyARN, parsed.Region, region)
+	}
+	return nil
+}
+
+// awsPartitionForRegion returns the AWS partition of the region, from the region name prefixes
+// of the partitions.
+func awsPartitionForRegion(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	default:
+		return "aws"
+	}
+}
+
+// kmsKeyController validates the default KMS key of the ClusterCSIDriver and the keys of the
+// storageClassKMSKeysAnnotation against the region of the cluster. It reports invalid keys, and keys
+// of StorageClasses the operator does not create, in the AWSEBSKMSKeyDegraded condition.
+// getKMSKeyHook does not set invalid keys in StorageClasses.
+type kmsKeyController struct {
+	operatorClient v1helpers.OperatorClient
+	ccdLister      oplisterv1.ClusterCSIDriverLister
+	infraLister    v1.InfrastructureLister
+}
+
+func newKMSKeyController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	infraLister v1.InfrastructureLister,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &kmsKeyController{
+		operatorClient: operatorClient,
+		ccdLister:      ccdLister,
+		infraLister:    infraLister,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		resync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *kmsKeyController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	ccd, err := c.ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return err
+	}
+	region, err := getAWSRegion(c.infraLister)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	keyCount := 0
+	if key := getDefaultKMSKey(ccd); key != "" {
+		keyCount++
+		if err := validateKMSKeyARN(key, region); err != nil {
+			errs = append(errs, fmt.Errorf("kmsKeyARN: %w", err))
+		}
+	}
+	keys, err := getStorageClassKMSKeys(ccd)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	managedNames, err := getStorageClassNames()
+	if err != nil {
+		return err
+	}
+	scNames := make([]string, 0, len(keys))
+	for scName := range keys {
+		scNames = append(scNames, scName)
+	}
+	sort.Strings(scNames)
+	for _, scName := range scNames {
+		if !managedNames.Has(scName) {
+			errs = append(errs, fmt.Errorf("StorageClass %s is not created by the operator, its key is not used", scName))
+			continue
+		}
+		keyCount++
+		if err := validateKMSKeyARN(keys[scName], region); err != nil {
+			errs = append(errs, fmt.Errorf("StorageClass %s: %w", scName, err))
+		}
+	}
+
+	condition := opv1.OperatorCondition{
+		Type:    kmsKeyConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: fmt.Sprintf("%d KMS keys are valid in region %s", keyCount, region),
+	}
+	if keyCount == 0 {
+		condition.Message = "No KMS key is configured"
+	}
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "InvalidKMSKey"
+		condition.Message = err.Error()
+	}
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
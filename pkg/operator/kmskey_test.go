@@ -0,0 +1,128 @@
+package operator
+
+import (
+	"context"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateKMSKeyARN(t *testing.T) {
+	tests := []struct {
+		arn         string
+		region      string
+		expectError bool
+	}{
+		{arn: validARNString, region: "us-east-2"},
+		{arn: "arn:aws:kms:us-east-2:269733383066:key/1234abcd-12ab-34cd-56ef-1234567890ab", region: "us-east-2"},
+		{arn: "arn:aws-cn:kms:cn-north-1:269733383066:key/test", region: "cn-north-1"},
+		{arn: "arn:aws-us-gov:kms:us-gov-west-1:269733383066:key/test", region: "us-gov-west-1"},
+		{arn: validARNString, region: ""},
+		{arn: validARNString, region: "us-west-1", expectError: true},
+		{arn: "arn:aws:kms:cn-north-1:269733383066:key/test", region: "cn-north-1", expectError: true},
+		{arn: "arn:aws:s3:us-east-2:269733383066:bucket", region: "us-east-2", expectError: true},
+		{arn: "1234abcd-12ab-34cd-56ef-1234567890ab", region: "us-east-2", expectError: true},
+	}
+	for _, test := range tests {
+		err := validateKMSKeyARN(test.arn, test.region)
+		if (err != nil) != test.expectError {
+			t.Errorf("%s in %q: unexpected error: %v", test.arn, test.region, err)
+		}
+	}
+}
+
+func TestKMSKeyControllerSync(t *testing.T) {
+	newDriver := func(kmsKeyARN string, annotations map[string]string) *opv1.ClusterCSIDriver {
+		return &opv1.ClusterCSIDriver{
+			ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: annotations},
+			Spec: opv1.ClusterCSIDriverSpec{
+				DriverConfig: opv1.CSIDriverConfigSpec{
+					DriverType: opv1.AWSDriverType,
+					AWS:        &opv1.AWSCSIDriverConfigSpec{KMSKeyARN: kmsKeyARN},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		driver         *opv1.ClusterCSIDriver
+		expectedStatus opv1.ConditionStatus
+		expectedReason string
+	}{
+		{
+			name:           "no key",
+			driver:         newDriver("", nil),
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		},
+		{
+			name: "valid keys",
+			driver: newDriver(validARNString, map[string]string{
+				storageClassKMSKeysAnnotation: `{"io2-csi": "arn:aws:kms:us-east-2:269733383066:key/io2"}`,
+			}),
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		},
+		{
+			name:           "default key in another region",
+			driver:         newDriver("arn:aws:kms:eu-west-1:269733383066:key/test", nil),
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "InvalidKMSKey",
+		},
+		{
+			name: "StorageClass key in another partition",
+			driver: newDriver(validARNString, map[string]string{
+				storageClassKMSKeysAnnotation: `{"io2-csi": "arn:aws-cn:kms:us-east-2:269733383066:key/io2"}`,
+			}),
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "InvalidKMSKey",
+		},
+		{
+			name: "key of a StorageClass not created by the operator",
+			driver: newDriver(validARNString, map[string]string{
+				storageClassKMSKeysAnnotation: `{"gp3": "arn:aws:kms:us-east-2:269733383066:key/gp3"}`,
+			}),
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "InvalidKMSKey",
+		},
+		{
+			name: "invalid annotation",
+			driver: newDriver("", map[string]string{
+				storageClassKMSKeysAnnotation: `["io2-csi"]`,
+			}),
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "InvalidKMSKey",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			c := &kmsKeyController{
+				operatorClient: operatorClient,
+				ccdLister:      &fakeCCDLister{test.driver},
+				infraLister:    newInfraLister("us-east-2"),
+			}
+			if err := c.sync(context.TODO(), factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, kmsKeyConditionType)
+			if condition == nil {
+				t.Fatalf("condition %s not found", kmsKeyConditionType)
+			}
+			if condition.Status != test.expectedStatus || condition.Reason != test.expectedReason {
+				t.Errorf("expected %s/%s, got %s/%s: %s", test.expectedStatus, test.expectedReason, condition.Status, condition.Reason, condition.Message)
+			}
+		})
+	}
+}
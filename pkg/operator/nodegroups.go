@@ -0,0 +1,449 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/csi/csidrivernodeservicecontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/loglevel"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/resource/resourcemerge"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubeclient "k8s.io/client-go/kubernetes"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// nodeGroupsAnnotation on the ClusterCSIDriver holds a JSON list of node groups. Each group gets
+	// its own node DaemonSet with its own volume attachment limits and tolerations, e.g.
+	// [{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large"], "reservedVolumeAttachments": 2}]
+	nodeGroupsAnnotation = "ebs.csi.openshift.io/node-groups"
+	// nodeGroupLabel is set on the node DaemonSets rendered for node groups, its value is the group name.
+	nodeGroupLabel = "ebs.csi.openshift.io/node-group"
+
+	nodeDaemonSetName = "aws-ebs-csi-driver-node"
+
+	// Environment variables with the images of the node DaemonSet, the same as used by
+	// csidrivernodeservicecontroller for the default DaemonSet.
+	driverImageEnvName              = "DRIVER_IMAGE"
+	nodeDriverRegistrarImageEnvName = "NODE_DRIVER_REGISTRAR_IMAGE"
+	livenessProbeImageEnvName       = "LIVENESS_PROBE_IMAGE"
+	kubeRBACProxyImageEnvName       = "KUBE_RBAC_PROXY_IMAGE"
+)
+
+// nodeGroup is a set of nodes with the same label that runs its own node DaemonSet.
+// Groups are matched in order: a node that matches several groups belongs to the first one,
+// nodes that match no group run the default node DaemonSet.
+type nodeGroup struct {
+	Name            string   `json:"name"`
+	NodeLabel       string   `json:"nodeLabel"`
+	NodeLabelValues []string `json:"nodeLabelValues"`
+	// VolumeAttachLimit is passed to the driver as --volume-attach-limit.
+	VolumeAttachLimit *int64 `json:"volumeAttachLimit,omitempty"`
+	// ReservedVolumeAttachments is passed to the driver as --reserved-volume-attachments.
+	ReservedVolumeAttachments *int64 `json:"reservedVolumeAttachments,omitempty"`
+	// Tolerations replace the tolerations of node.yaml when set.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+// getNodeGroups parses and validates the nodeGroupsAnnotation of the ClusterCSIDriver.
+func getNodeGroups(ccd *opv1.ClusterCSIDriver) ([]nodeGroup, error) {
+	value, ok := ccd.Annotations[nodeGroupsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var groups []nodeGroup
+	if err := json.Unmarshal([]byte(value), &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse the %s annotation: %w", nodeGroupsAnnotation, err)
+	}
+	if err := validateNodeGroups(groups); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", nodeGroupsAnnotation, err)
+	}
+	return groups, nil
+}
+
+func validateNodeGroups(groups []nodeGroup) error {
+	var errs []error
+	names := sets.New[string]()
+	for _, group := range groups {
+		if names.Has(group.Name) {
+			errs = append(errs, fmt.Errorf("duplicate node group %q", group.Name))
+			continue
+		}
+		names.Insert(group.Name)
+		if err := validateNodeGroup(group); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func validateNodeGroup(group nodeGroup) error {
+	var errs []error
+	// The group name is part of the DaemonSet name and of the pod label value.
+	for _, msg := range validation.IsDNS1123Label(nodeGroupDaemonSetName(group.Name)) {
+		errs = append(errs, fmt.Errorf("node group name %q: %s", group.Name, msg))
+	}
+	if nodeGroupDaemonSetName(group.Name) == windowsNodeDaemonSetName {
+		errs = append(errs, fmt.Errorf("node group name %q is reserved", group.Name))
+	}
+	for _, msg := range validation.IsQualifiedName(group.NodeLabel) {
+		errs = append(errs, fmt.Errorf("node group %q: nodeLabel %q: %s", group.Name, group.NodeLabel, msg))
+	}
+	if len(group.NodeLabelValues) == 0 {
+		errs = append(errs, fmt.Errorf("node group %q: nodeLabelValues must not be empty", group.Name))
+	}
+	for _, value := range group.NodeLabelValues {
+		for _, msg := range validation.IsValidLabelValue(value) {
+			errs = append(errs, fmt.Errorf("node group %q: nodeLabelValues %q: %s", group.Name, value, msg))
+		}
+	}
+	// The driver refuses to start with both flags set.
+	if group.VolumeAttachLimit != nil && group.ReservedVolumeAttachments != nil {
+		errs = append(errs, fmt.Errorf("node group %q: volumeAttachLimit and reservedVolumeAttachments are mutually exclusive", group.Name))
+	}
+	if group.VolumeAttachLimit != nil && *group.VolumeAttachLimit < 1 {
+		errs = append(errs, fmt.Errorf("node group %q: volumeAttachLimit must be positive", group.Name))
+	}
+	if group.ReservedVolumeAttachments != nil && *group.ReservedVolumeAttachments < 0 {
+		errs = append(errs, fmt.Errorf("node group %q: reservedVolumeAttachments must not be negative", group.Name))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func nodeGroupDaemonSetName(groupName string) string {
+	return nodeDaemonSetName + "-" + groupName
+}
+
+// nodeGroupRequirements returns the node selector requirements of the nodes that belong to groups[index]:
+// nodes with the group label that are not part of any previous group. With index == len(groups),
+// it returns the requirements of the nodes that are not part of any group.
+func nodeGroupRequirements(groups []nodeGroup, index int) []corev1.NodeSelectorRequirement {
+	var requirements []corev1.NodeSelectorRequirement
+	if index < len(groups) {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      groups[index].NodeLabel,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   groups[index].NodeLabelValues,
+		})
+	}
+	for _, group := range groups[:index] {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      group.NodeLabel,
+			Operator: corev1.NodeSelectorOpNotIn,
+			Values:   group.NodeLabelValues,
+		})
+	}
+	return requirements
+}
+
+// addNodeSelectorRequirements restricts the pods to the nodes that match all requirements.
+func addNodeSelectorRequirements(podSpec *corev1.PodSpec, requirements []corev1.NodeSelectorRequirement) {
+	if len(requirements) == 0 {
+		return
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := podSpec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	selector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	// The terms are ORed, the requirements must hold in each of them.
+	for i := range selector.NodeSelectorTerms {
+		term := &selector.NodeSelectorTerms[i]
+		term.MatchExpressions = append(term.MatchExpressions, requirements...)
+	}
+}
+
+// withNodeGroupsExcluded keeps the default node DaemonSet away from the nodes of the node groups.
+// When the nodeGroupsAnnotation is invalid, the default node DaemonSet runs on all nodes and the
+// error is reported by the node groups controller, which removes the node group DaemonSets.
+func withNodeGroupsExcluded(ccdLister oplisterv1.ClusterCSIDriverLister) csidrivernodeservicecontroller.DaemonSetHookFunc {
+	return func(_ *opv1.OperatorSpec, daemonSet *appsv1.DaemonSet) error {
+		ccd, err := ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+		if err != nil {
+			return err
+		}
+		groups, err := getNodeGroups(ccd)
+		if err != nil {
+			klog.Warningf("Not excluding any node groups from the default node DaemonSet: %v", err)
+			return nil
+		}
+		addNodeSelectorRequirements(&daemonSet.Spec.Template.Spec, nodeGroupRequirements(groups, len(groups)))
+		return nil
+	}
+}
+
+// replaceNodePlaceholders replaces the placeholders of node.yaml the same way
+// csidrivernodeservicecontroller does for the default node DaemonSet.
+func replaceNodePlaceholders(manifest []byte, spec *opv1.OperatorSpec) []byte {
+	pairs := []string{}
+	for placeholder, envName := range map[string]string{
+		"${DRIVER_IMAGE}":                driverImageEnvName,
+		"${NODE_DRIVER_REGISTRAR_IMAGE}": nodeDriverRegistrarImageEnvName,
+		"${LIVENESS_PROBE_IMAGE}":        livenessProbeImageEnvName,
+		"${KUBE_RBAC_PROXY_IMAGE}":       kubeRBACProxyImageEnvName,
+	} {
+		if image := os.Getenv(envName); image != "" {
+			pairs = append(pairs, placeholder, image)
+		}
+	}
+	pairs = append(pairs, "${LOG_LEVEL}", strconv.Itoa(loglevel.LogLevelToVerbosity(spec.LogLevel)))
+	return []byte(strings.NewReplacer(pairs...).Replace(string(manifest)))
+}
+
+// renderNodeGroupDaemonSet returns the node DaemonSet of groups[index]. It has its own pod labels,
+// so its selector does not overlap with the default DaemonSet or with the other groups.
+func renderNodeGroupDaemonSet(manifest []byte, spec *opv1.OperatorSpec, groups []nodeGroup, index int) (*appsv1.DaemonSet, error) {
+	group := groups[index]
+	daemonSet := resourceread.ReadDaemonSetV1OrDie(replaceNodePlaceholders(manifest, spec))
+
+	name := nodeGroupDaemonSetName(group.Name)
+	daemonSet.Name = name
+	if daemonSet.Labels == nil {
+		daemonSet.Labels = map[string]string{}
+	}
+	daemonSet.Labels[nodeGroupLabel] = group.Name
+	daemonSet.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}}
+	if daemonSet.Spec.Template.Labels == nil {
+		daemonSet.Spec.Template.Labels = map[string]string{}
+	}
+	daemonSet.Spec.Template.Labels["app"] = name
+	daemonSet.Spec.Template.Labels[nodeGroupLabel] = group.Name
+
+	podSpec := &daemonSet.Spec.Template.Spec
+	addNodeSelectorRequirements(podSpec, nodeGroupRequirements(groups, index))
+	if group.Tolerations != nil {
+		podSpec.Tolerations = group.Tolerations
+	}
+
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container.Name != "csi-driver" {
+			continue
+		}
+		if group.VolumeAttachLimit != nil {
+			container.Args = append(container.Args, fmt.Sprintf("--volume-attach-limit=%d", *group.VolumeAttachLimit))
+		}
+		if group.ReservedVolumeAttachments != nil {
+			container.Args = append(container.Args, fmt.Sprintf("--reserved-volume-attachments=%d", *group.ReservedVolumeAttachments))
+		}
+		return daemonSet, nil
+	}
+	return nil, fmt.Errorf("could not render the node DaemonSet of node group %q because the csi-driver container is missing", group.Name)
+}
+
+// nodeGroupsController renders one node DaemonSet per node group from node.yaml, removes the
+// DaemonSets of deleted groups and reports the aggregated rollout status of all group DaemonSets.
+// The default node DaemonSet is excluded from the nodes of the groups by withNodeGroupsExcluded.
+type nodeGroupsController struct {
+	name            string
+	operatorClient  v1helpers.OperatorClient
+	kubeClient      kubeclient.Interface
+	namespace       string
+	manifest        []byte
+	ccdLister       oplisterv1.ClusterCSIDriverLister
+	daemonSetLister appsv1listers.DaemonSetNamespaceLister
+	hooks           []csidrivernodeservicecontroller.DaemonSetHookFunc
+}
+
+func newNodeGroupsController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubeclient.Interface,
+	namespace string,
+	manifest []byte,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	daemonSetLister appsv1listers.DaemonSetNamespaceLister,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+	hooks ...csidrivernodeservicecontroller.DaemonSetHookFunc,
+) factory.Controller {
+	c := &nodeGroupsController{
+		name:            name,
+		operatorClient:  operatorClient,
+		kubeClient:      kubeClient,
+		namespace:       namespace,
+		manifest:        manifest,
+		ccdLister:       ccdLister,
+		daemonSetLister: daemonSetLister,
+		hooks:           hooks,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		resync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *nodeGroupsController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	ccd, err := c.ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return err
+	}
+	groups, err := getNodeGroups(ccd)
+	if err != nil {
+		// The default node DaemonSet runs on all nodes then, see withNodeGroupsExcluded.
+		if removeErr := c.removeStaleDaemonSets(ctx, nil, syncCtx.Recorder()); removeErr != nil {
+			return utilerrors.NewAggregate([]error{err, removeErr})
+		}
+		return err
+	}
+
+	var daemonSets []*appsv1.DaemonSet
+	for i := range groups {
+		required, err := renderNodeGroupDaemonSet(c.manifest, opSpec, groups, i)
+		if err != nil {
+			return err
+		}
+		for _, hook := range c.hooks {
+			if err := hook(opSpec, required); err != nil {
+				return fmt.Errorf("error running hook function on node group %q: %w", groups[i].Name, err)
+			}
+		}
+		daemonSet, _, err := resourceapply.ApplyDaemonSet(
+			ctx,
+			c.kubeClient.AppsV1(),
+			syncCtx.Recorder(),
+			required,
+			resourcemerge.ExpectedDaemonSetGeneration(required, opStatus.Generations),
+		)
+		if err != nil {
+			return err
+		}
+		daemonSets = append(daemonSets, daemonSet)
+	}
+
+	if err := c.removeStaleDaemonSets(ctx, groups, syncCtx.Recorder()); err != nil {
+		return err
+	}
+
+	availableCondition := opv1.OperatorCondition{
+		Type:   c.name + opv1.OperatorStatusTypeAvailable,
+		Status: opv1.ConditionTrue,
+		Reason: "AsExpected",
+	}
+	progressingCondition := opv1.OperatorCondition{
+		Type:   c.name + opv1.OperatorStatusTypeProgressing,
+		Status: opv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	var unavailable, progressing []string
+	for _, daemonSet := range daemonSets {
+		// A group without nodes has nothing to deploy.
+		if daemonSet.Status.DesiredNumberScheduled > 0 && daemonSet.Status.NumberAvailable == 0 {
+			unavailable = append(unavailable, daemonSet.Name)
+		}
+		if msg := nodeGroupProgressing(daemonSet); msg != "" {
+			progressing = append(progressing, fmt.Sprintf("%s: %s", daemonSet.Name, msg))
+		}
+	}
+	if len(unavailable) > 0 {
+		availableCondition.Status = opv1.ConditionFalse
+		availableCondition.Reason = "Deploying"
+		availableCondition.Message = fmt.Sprintf("Waiting for the node group DaemonSets to deploy the CSI Node Service: %s", strings.Join(unavailable, ", "))
+	}
+	if len(progressing) > 0 {
+		progressingCondition.Status = opv1.ConditionTrue
+		progressingCondition.Reason = "Deploying"
+		progressingCondition.Message = strings.Join(progressing, "; ")
+	}
+
+	updateStatusFn := func(newStatus *opv1.OperatorStatus) error {
+		for _, daemonSet := range daemonSets {
+			resourcemerge.SetDaemonSetGeneration(&newStatus.Generations, daemonSet)
+		}
+		return nil
+	}
+	_, _, err = v1helpers.UpdateStatus(
+		ctx,
+		c.operatorClient,
+		updateStatusFn,
+		v1helpers.UpdateConditionFn(availableCondition),
+		v1helpers.UpdateConditionFn(progressingCondition),
+	)
+	return err
+}
+
+// removeStaleDaemonSets deletes the DaemonSets of node groups that are not configured anymore.
+func (c *nodeGroupsController) removeStaleDaemonSets(ctx context.Context, groups []nodeGroup, recorder events.Recorder) error {
+	existing, err := c.daemonSetLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	names := sets.New[string]()
+	for _, group := range groups {
+		names.Insert(group.Name)
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].Name < existing[j].Name
+	})
+	for _, daemonSet := range existing {
+		groupName, ok := daemonSet.Labels[nodeGroupLabel]
+		if !ok || names.Has(groupName) {
+			continue
+		}
+		err := c.kubeClient.AppsV1().DaemonSets(c.namespace).Delete(ctx, daemonSet.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.V(2).Infof("Deleted DaemonSet %s/%s of removed node group %q", c.namespace, daemonSet.Name, groupName)
+		recorder.Eventf("NodeGroupDaemonSetDeleted", "Deleted DaemonSet %s of removed node group %q", daemonSet.Name, groupName)
+	}
+	return nil
+}
+
+// nodeGroupProgressing returns why the DaemonSet is still rolling out, or an empty string when it is done.
+func nodeGroupProgressing(daemonSet *appsv1.DaemonSet) string {
+	switch {
+	case daemonSet.Generation != daemonSet.Status.ObservedGeneration:
+		return "Waiting for DaemonSet to act on changes"
+	case daemonSet.Status.NumberUnavailable > 0:
+		return fmt.Sprintf("Waiting for DaemonSet to deploy node pods (%d unavailable)", daemonSet.Status.NumberUnavailable)
+	case daemonSet.Status.UpdatedNumberScheduled < daemonSet.Status.DesiredNumberScheduled:
+		return fmt.Sprintf("Waiting for DaemonSet to update node pods (%d of %d updated)", daemonSet.Status.UpdatedNumberScheduled, daemonSet.Status.DesiredNumberScheduled)
+	}
+	return ""
+}
@@ -0,0 +1,364 @@
+package operator
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/pointer"
+
+	"github.com/openshift/aws-ebs-csi-driver-operator/assets"
+)
+
+func TestGetNodeGroups(t *testing.T) {
+	tests := []struct {
+		name           string
+		annotation     string
+		expectedGroups int
+		expectedError  string
+	}{
+		{
+			name:           "no annotation",
+			expectedGroups: 0,
+		},
+		{
+			name: "valid groups",
+			annotation: `[
+				{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large", "m5.xlarge"], "volumeAttachLimit": 20},
+				{"name": "storage", "nodeLabel": "example.com/pool", "nodeLabelValues": ["storage"], "reservedVolumeAttachments": 2,
+				 "tolerations": [{"key": "example.com/storage", "operator": "Exists", "effect": "NoSchedule"}]}
+			]`,
+			expectedGroups: 2,
+		},
+		{
+			name:          "malformed JSON",
+			annotation:    `{"name": "m5"}`,
+			expectedError: "failed to parse",
+		},
+		{
+			name: "duplicate name",
+			annotation: `[
+				{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large"]},
+				{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.xlarge"]}
+			]`,
+			expectedError: `duplicate node group "m5"`,
+		},
+		{
+			name:          "invalid name",
+			annotation:    `[{"name": "M5_large", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large"]}]`,
+			expectedError: `node group name "M5_large"`,
+		},
+		{
+			name:          "reserved name",
+			annotation:    `[{"name": "windows", "nodeLabel": "kubernetes.io/os", "nodeLabelValues": ["linux"]}]`,
+			expectedError: `node group name "windows" is reserved`,
+		},
+		{
+			name:          "missing label values",
+			annotation:    `[{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type"}]`,
+			expectedError: "nodeLabelValues must not be empty",
+		},
+		{
+			name:          "both limits",
+			annotation:    `[{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large"], "volumeAttachLimit": 20, "reservedVolumeAttachments": 2}]`,
+			expectedError: "mutually exclusive",
+		},
+		{
+			name:          "zero attach limit",
+			annotation:    `[{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large"], "volumeAttachLimit": 0}]`,
+			expectedError: "volumeAttachLimit must be positive",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ccd := &opv1.ClusterCSIDriver{ObjectMeta: metav1.ObjectMeta{Name: provisionerName}}
+			if test.annotation != "" {
+				ccd.Annotations = map[string]string{nodeGroupsAnnotation: test.annotation}
+			}
+			groups, err := getNodeGroups(ccd)
+			if test.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+					t.Errorf("expected error containing %q, got %v", test.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(groups) != test.expectedGroups {
+				t.Errorf("expected %d groups, got %d", test.expectedGroups, len(groups))
+			}
+		})
+	}
+}
+
+func TestRenderNodeGroupDaemonSet(t *testing.T) {
+	manifest, err := assets.ReadFile("node.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceManifest, err := assets.ReadFile("node_service.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsService := resourceread.ReadServiceV1OrDie(serviceManifest)
+	storageToleration := corev1.Toleration{Key: "example.com/storage", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}
+	groups := []nodeGroup{
+		{
+			Name:              "m5",
+			NodeLabel:         "node.kubernetes.io/instance-type",
+			NodeLabelValues:   []string{"m5.large"},
+			VolumeAttachLimit: pointer.Int64(20),
+		},
+		{
+			Name:                      "storage",
+			NodeLabel:                 "example.com/pool",
+			NodeLabelValues:           []string{"storage"},
+			ReservedVolumeAttachments: pointer.Int64(2),
+			Tolerations:               []corev1.Toleration{storageToleration},
+		},
+	}
+	spec := &opv1.OperatorSpec{LogLevel: opv1.Debug}
+
+	tests := []struct {
+		name                 string
+		index                int
+		expectedName         string
+		expectedRequirements []corev1.NodeSelectorRequirement
+		expectedArg          string
+		expectedTolerations  []corev1.Toleration
+	}{
+		{
+			name:         "first group",
+			index:        0,
+			expectedName: "aws-ebs-csi-driver-node-m5",
+			expectedRequirements: []corev1.NodeSelectorRequirement{
+				{Key: "node.kubernetes.io/instance-type", Operator: corev1.NodeSelectorOpIn, Values: []string{"m5.large"}},
+			},
+			expectedArg:         "--volume-attach-limit=20",
+			expectedTolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+		},
+		{
+			name:         "second group excludes the first one",
+			index:        1,
+			expectedName: "aws-ebs-csi-driver-node-storage",
+			expectedRequirements: []corev1.NodeSelectorRequirement{
+				{Key: "example.com/pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"storage"}},
+				{Key: "node.kubernetes.io/instance-type", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"m5.large"}},
+			},
+			expectedArg:         "--reserved-volume-attachments=2",
+			expectedTolerations: []corev1.Toleration{storageToleration},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			daemonSet, err := renderNodeGroupDaemonSet(manifest, spec, groups, test.index)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if daemonSet.Name != test.expectedName {
+				t.Errorf("expected name %s, got %s", test.expectedName, daemonSet.Name)
+			}
+			if app := daemonSet.Spec.Selector.MatchLabels["app"]; app != test.expectedName || daemonSet.Spec.Template.Labels["app"] != app {
+				t.Errorf("unexpected selector %v and pod labels %v", daemonSet.Spec.Selector, daemonSet.Spec.Template.Labels)
+			}
+			if !labels.SelectorFromSet(metricsService.Spec.Selector).Matches(labels.Set(daemonSet.Spec.Template.Labels)) {
+				t.Errorf("node metrics Service selector %v does not match pod labels %v", metricsService.Spec.Selector, daemonSet.Spec.Template.Labels)
+			}
+			if group := daemonSet.Labels[nodeGroupLabel]; group != groups[test.index].Name {
+				t.Errorf("unexpected %s label %q", nodeGroupLabel, group)
+			}
+			terms := daemonSet.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			if len(terms) != 1 || !equality.Semantic.DeepEqual(test.expectedRequirements, terms[0].MatchExpressions) {
+				t.Errorf("unexpected node selector terms: %+v", terms)
+			}
+			if !equality.Semantic.DeepEqual(test.expectedTolerations, daemonSet.Spec.Template.Spec.Tolerations) {
+				t.Errorf("unexpected tolerations: %+v", daemonSet.Spec.Template.Spec.Tolerations)
+			}
+			args := strings.Join(daemonSet.Spec.Template.Spec.Containers[0].Args, " ")
+			if !strings.Contains(args, test.expectedArg) || !strings.Contains(args, "--v=4") {
+				t.Errorf("unexpected csi-driver args: %s", args)
+			}
+		})
+	}
+
+	// The default DaemonSet runs on the nodes outside of all groups.
+	ccd := &opv1.ClusterCSIDriver{ObjectMeta: metav1.ObjectMeta{
+		Name:        provisionerName,
+		Annotations: map[string]string{nodeGroupsAnnotation: `[{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large"]}]`},
+	}}
+	daemonSet := &appsv1.DaemonSet{}
+	if err := withNodeGroupsExcluded(&fakeCCDLister{ccd})(spec, daemonSet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+		{Key: "node.kubernetes.io/instance-type", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"m5.large"}},
+	}}}
+	if terms := daemonSet.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms; !equality.Semantic.DeepEqual(expected, terms) {
+		t.Errorf("unexpected default DaemonSet node selector terms: %+v", terms)
+	}
+
+	// With an invalid annotation, the default DaemonSet runs on all nodes.
+	ccd.Annotations[nodeGroupsAnnotation] = `[{"name": "m5"`
+	daemonSet = &appsv1.DaemonSet{}
+	if err := withNodeGroupsExcluded(&fakeCCDLister{ccd})(spec, daemonSet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if daemonSet.Spec.Template.Spec.Affinity != nil {
+		t.Errorf("unexpected default DaemonSet affinity: %+v", daemonSet.Spec.Template.Spec.Affinity)
+	}
+}
+
+func TestNodeGroupsControllerSync(t *testing.T) {
+	manifest, err := assets.ReadFile("node.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleDaemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "aws-ebs-csi-driver-node-old",
+			Namespace: defaultNamespace,
+			Labels:    map[string]string{nodeGroupLabel: "old"},
+		},
+	}
+	defaultDaemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nodeDaemonSetName,
+			Namespace: defaultNamespace,
+		},
+	}
+	kubeClient := fake.NewSimpleClientset(staleDaemonSet, defaultDaemonSet)
+	daemonSetInformer := informers.NewSharedInformerFactory(kubeClient, 0).Apps().V1().DaemonSets()
+	daemonSetInformer.Informer().GetIndexer().Add(staleDaemonSet)
+	daemonSetInformer.Informer().GetIndexer().Add(defaultDaemonSet)
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&opv1.OperatorSpec{ManagementState: opv1.Managed},
+		&opv1.OperatorStatus{},
+		nil,
+	)
+	ccd := &opv1.ClusterCSIDriver{ObjectMeta: metav1.ObjectMeta{
+		Name:        provisionerName,
+		Annotations: map[string]string{nodeGroupsAnnotation: `[{"name": "m5", "nodeLabel": "node.kubernetes.io/instance-type", "nodeLabelValues": ["m5.large"], "volumeAttachLimit": 20}]`},
+	}}
+	c := &nodeGroupsController{
+		name:            "AWSEBSDriverNodeGroupsController",
+		operatorClient:  operatorClient,
+		kubeClient:      kubeClient,
+		namespace:       defaultNamespace,
+		manifest:        manifest,
+		ccdLister:       &fakeCCDLister{ccd},
+		daemonSetLister: daemonSetInformer.Lister().DaemonSets(defaultNamespace),
+	}
+	if err := c.sync(context.TODO(), factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := kubeClient.AppsV1().DaemonSets(defaultNamespace).Get(context.TODO(), "aws-ebs-csi-driver-node-m5", metav1.GetOptions{}); err != nil {
+		t.Errorf("failed to get the node group DaemonSet: %v", err)
+	}
+	if _, err := kubeClient.AppsV1().DaemonSets(defaultNamespace).Get(context.TODO(), staleDaemonSet.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the stale DaemonSet to be deleted, got %v", err)
+	}
+	if _, err := kubeClient.AppsV1().DaemonSets(defaultNamespace).Get(context.TODO(), nodeDaemonSetName, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the default DaemonSet to be kept, got %v", err)
+	}
+
+	_, status, _, _ := operatorClient.GetOperatorState()
+	for _, conditionType := range []string{c.name + opv1.OperatorStatusTypeAvailable, c.name + opv1.OperatorStatusTypeProgressing} {
+		if v1helpers.FindOperatorCondition(status.Conditions, conditionType) == nil {
+			t.Errorf("condition %s not found", conditionType)
+		}
+	}
+	if len(status.Generations) != 1 || status.Generations[0].Name != "aws-ebs-csi-driver-node-m5" {
+		t.Errorf("unexpected generations: %+v", status.Generations)
+	}
+}
+
+func TestNodeGroupsControllerSyncInvalidAnnotation(t *testing.T) {
+	groupDaemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "aws-ebs-csi-driver-node-m5",
+			Namespace: defaultNamespace,
+			Labels:    map[string]string{nodeGroupLabel: "m5"},
+		},
+	}
+	kubeClient := fake.NewSimpleClientset(groupDaemonSet)
+	daemonSetInformer := informers.NewSharedInformerFactory(kubeClient, 0).Apps().V1().DaemonSets()
+	daemonSetInformer.Informer().GetIndexer().Add(groupDaemonSet)
+
+	ccd := &opv1.ClusterCSIDriver{ObjectMeta: metav1.ObjectMeta{
+		Name:        provisionerName,
+		Annotations: map[string]string{nodeGroupsAnnotation: `[{"name": "m5"`},
+	}}
+	c := &nodeGroupsController{
+		name: "AWSEBSDriverNodeGroupsController",
+		operatorClient: v1helpers.NewFakeOperatorClient(
+			&opv1.OperatorSpec{ManagementState: opv1.Managed},
+			&opv1.OperatorStatus{},
+			nil,
+		),
+		kubeClient:      kubeClient,
+		namespace:       defaultNamespace,
+		ccdLister:       &fakeCCDLister{ccd},
+		daemonSetLister: daemonSetInformer.Lister().DaemonSets(defaultNamespace),
+	}
+	err := c.sync(context.TODO(), factory.NewSyncContext("test", events.NewInMemoryRecorder("test")))
+	if err == nil || !strings.Contains(err.Error(), "failed to parse") {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+	// The default DaemonSet runs on the nodes of the group now.
+	if _, err := kubeClient.AppsV1().DaemonSets(defaultNamespace).Get(context.TODO(), groupDaemonSet.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the node group DaemonSet to be deleted, got %v", err)
+	}
+}
+
+func TestNodeGroupProgressing(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   appsv1.DaemonSetStatus
+		expected string
+	}{
+		{
+			name:     "rolled out",
+			status:   appsv1.DaemonSetStatus{ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 3},
+			expected: "",
+		},
+		{
+			name:     "not observed",
+			status:   appsv1.DaemonSetStatus{ObservedGeneration: 1},
+			expected: "Waiting for DaemonSet to act on changes",
+		},
+		{
+			name:     "unavailable pods",
+			status:   appsv1.DaemonSetStatus{ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberUnavailable: 1},
+			expected: "Waiting for DaemonSet to deploy node pods (1 unavailable)",
+		},
+		{
+			name:     "old pods",
+			status:   appsv1.DaemonSetStatus{ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 1},
+			expected: "Waiting for DaemonSet to update node pods (1 of 3 updated)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			daemonSet := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Generation: 2}, Status: test.status}
+			if result := nodeGroupProgressing(daemonSet); result != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+}
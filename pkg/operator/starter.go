@@ -3,7 +3,9 @@ package operator
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -16,7 +18,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	kubeclient "k8s.io/client-go/kubernetes"
@@ -25,12 +30,14 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
+	configv1 "github.com/openshift/api/config/v1"
 	opv1 "github.com/openshift/api/operator/v1"
 	configclient "github.com/openshift/client-go/config/clientset/versioned"
 	configinformers "github.com/openshift/client-go/config/informers/externalversions"
 	v1 "github.com/openshift/client-go/config/listers/config/v1"
 	opclient "github.com/openshift/client-go/operator/clientset/versioned"
 	opinformers "github.com/openshift/client-go/operator/informers/externalversions"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
 	"github.com/openshift/library-go/pkg/config/client"
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
 	"github.com/openshift/library-go/pkg/controller/factory"
@@ -57,6 +64,8 @@ const (
 
 	cloudCredSecretName   = "ebs-cloud-credentials"
 	metricsCertSecretName = "aws-ebs-csi-driver-controller-metrics-serving-cert"
+	// nodeMetricsCertSecretName is the serving certificate of the node DaemonSet metrics, in the guest cluster.
+	nodeMetricsCertSecretName = "aws-ebs-csi-driver-node-metrics-serving-cert"
 
 	hypershiftImageEnvName = "HYPERSHIFT_IMAGE"
 
@@ -68,11 +77,33 @@ const (
 	kmsKeyID           = "kmsKeyId"
 
 	hypershiftPriorityClass = "hypershift-control-plane"
+	// HostedControlPlane annotations that customize the hosted control plane components.
+	hypershiftPriorityClassAnnotation       = "hypershift.openshift.io/control-plane-priority-class"
+	hypershiftResourceRequestOverridePrefix = "resource-request-override.hypershift.openshift.io"
+	// hypershiftRootCAConfigMap is the CA of the HostedControlPlane that signs the metrics serving
+	// certificate and the metrics-client certificate used by the HyperShift monitoring stack.
+	hypershiftRootCAConfigMap = "root-ca"
+	// hypershiftMetricsCertSecretName is the metrics serving certificate provided by the HostedControlPlane.
+	hypershiftMetricsCertSecretName  = "aws-ebs-csi-driver-controller-metrics-tls"
+	hypershiftKubeRBACProxyConfigMap = "aws-ebs-csi-driver-controller-kube-rbac-proxy-config"
+
+	// Values of HostedControlPlane spec.controllerAvailabilityPolicy.
+	hypershiftSingleReplica   = "SingleReplica"
+	hypershiftHighlyAvailable = "HighlyAvailable"
 
 	resync = 20 * time.Minute
 )
 
 var (
+	// awsServiceEndpointEnvVars maps the names of the AWS services used by the driver
+	// to the environment variables that override their endpoints.
+	awsServiceEndpointEnvVars = map[string]string{
+		"ec2": "AWS_EC2_ENDPOINT",
+		"sts": "AWS_ENDPOINT_URL_STS",
+		"kms": "AWS_ENDPOINT_URL_KMS",
+		"iam": "AWS_ENDPOINT_URL_IAM",
+	}
+
 	hostedControlPlaneGVR = schema.GroupVersionResource{
 		Group:    "hypershift.openshift.io",
 		Version:  "v1beta1",
@@ -138,7 +169,9 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 	// Client informers for the GUEST cluster.
 	guestKubeInformersForNamespaces := v1helpers.NewKubeInformersForNamespaces(guestKubeClient, guestNamespace, "")
 	guestConfigMapInformer := guestKubeInformersForNamespaces.InformersFor(guestNamespace).Core().V1().ConfigMaps()
+	guestSecretInformer := guestKubeInformersForNamespaces.InformersFor(guestNamespace).Core().V1().Secrets()
 	guestNodeInformer := guestKubeInformersForNamespaces.InformersFor("").Core().V1().Nodes()
+	guestPVInformer := guestKubeInformersForNamespaces.InformersFor("").Core().V1().PersistentVolumes()
 
 	guestConfigClient := configclient.NewForConfigOrDie(rest.AddUserAgent(guestKubeConfig, operatorName))
 	guestConfigInformers := configinformers.NewSharedInformerFactory(guestConfigClient, resync)
@@ -147,6 +180,7 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 	// operator.openshift.io client, used for ClusterCSIDriver
 	guestCCDClient := opclient.NewForConfigOrDie(rest.AddUserAgent(guestKubeConfig, operatorName))
 	guestCCDInformers := opinformers.NewSharedInformerFactory(guestCCDClient, resync)
+	guestCCDInformer := guestCCDInformers.Operator().V1().ClusterCSIDrivers()
 
 	// Create client and informers for our ClusterCSIDriver CR.
 	gvr := opv1.SchemeGroupVersion.WithResource("clustercsidrivers")
@@ -159,16 +193,39 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		"cabundle_cm.yaml",
 	}
 	if isHypershift {
-		staticResourceFiles = append(staticResourceFiles, "hypershift/controller_sa.yaml")
+		staticResourceFiles = append(staticResourceFiles,
+			"hypershift/controller_sa.yaml",
+			"hypershift/metrics_service.yaml",
+			"hypershift/kube_rbac_proxy_config.yaml",
+		)
 	} else {
 		staticResourceFiles = append(staticResourceFiles, "controller_sa.yaml")
 	}
 
 	var hostedControlPlaneLister cache.GenericLister
 	var hostedControlPlaneInformer cache.SharedInformer
+	var hcpTracker *hostedControlPlaneTracker
 	if isHypershift {
 		hostedControlPlaneInformer = controlPlaneDynamicInformers.ForResource(hostedControlPlaneGVR).Informer()
-		hostedControlPlaneLister = controlPlaneDynamicInformers.ForResource(hostedControlPlaneGVR).Lister()
+		hcpTracker = newHostedControlPlaneTracker(
+			controlPlaneDynamicInformers.ForResource(hostedControlPlaneGVR).Lister(),
+			controlPlaneConfigMapInformer.Lister().ConfigMaps(controlPlaneNamespace),
+			controlPlaneNamespace,
+		)
+		hostedControlPlaneLister = hcpTracker
+	}
+
+	// In HyperShift, the AWS region, resource tags and service endpoints come from the HostedControlPlane.
+	awsInfraLister := guestInfraInformer.Lister()
+	awsInfraInformers := []factory.Informer{guestInfraInformer.Informer()}
+	if isHypershift {
+		awsInfraLister = newHostedControlPlaneInfrastructureLister(guestInfraInformer.Lister(), hostedControlPlaneLister, controlPlaneNamespace)
+		awsInfraInformers = append(awsInfraInformers, hostedControlPlaneInformer)
+	}
+
+	controllerMetricsCertSecretName := metricsCertSecretName
+	if isHypershift {
+		controllerMetricsCertSecretName = hypershiftMetricsCertSecretName
 	}
 
 	controlPlaneInformersForEvents := []factory.Informer{
@@ -176,6 +233,7 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		controlPlaneConfigMapInformer.Informer(),
 		guestNodeInformer.Informer(),
 		guestInfraInformer.Informer(),
+		guestCCDInformer.Informer(),
 	}
 	if isHypershift {
 		controlPlaneInformersForEvents = append(controlPlaneInformersForEvents, hostedControlPlaneInformer)
@@ -208,16 +266,16 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		controlPlaneKubeInformersForNamespaces.InformersFor(controlPlaneNamespace),
 		guestConfigInformers,
 		controlPlaneInformersForEvents,
-		withHypershiftDeploymentHook(isHypershift, os.Getenv(hypershiftImageEnvName), controlPlaneNamespace, hostedControlPlaneLister),
-		withHypershiftReplicasHook(isHypershift, guestNodeInformer.Lister()),
+		withHypershiftDeploymentHook(isHypershift, os.Getenv(hypershiftImageEnvName), controlPlaneNamespace, guestNamespace, hostedControlPlaneLister),
+		withHypershiftReplicasHook(isHypershift, guestNodeInformer.Lister(), controlPlaneNamespace, hostedControlPlaneLister),
 		withNamespaceDeploymentHook(controlPlaneNamespace),
 		csidrivercontrollerservicecontroller.WithSecretHashAnnotationHook(controlPlaneNamespace, cloudCredSecretName, controlPlaneSecretInformer),
-		csidrivercontrollerservicecontroller.WithSecretHashAnnotationHook(controlPlaneNamespace, metricsCertSecretName, controlPlaneSecretInformer),
+		csidrivercontrollerservicecontroller.WithSecretHashAnnotationHook(controlPlaneNamespace, controllerMetricsCertSecretName, controlPlaneSecretInformer),
 		csidrivercontrollerservicecontroller.WithObservedProxyDeploymentHook(),
 		withCustomAWSCABundle(isHypershift, controlPlaneCloudConfigLister),
-		withAWSRegion(guestInfraInformer.Lister()),
-		withCustomTags(guestInfraInformer.Lister()),
-		withCustomEndPoint(guestInfraInformer.Lister()),
+		withAWSRegion(awsInfraLister),
+		withCustomTags(awsInfraLister, guestCCDInformer.Lister()),
+		withCustomEndPoint(awsInfraLister),
 		csidrivercontrollerservicecontroller.WithCABundleDeploymentHook(
 			controlPlaneNamespace,
 			trustedCAConfigMap,
@@ -242,8 +300,13 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		[]string{
 			"csidriver.yaml",
 			"node_sa.yaml",
+			"node_service.yaml",
 			"rbac/privileged_role.yaml",
 			"rbac/node_privileged_binding.yaml",
+			"rbac/kube_rbac_proxy_role.yaml",
+			"rbac/node_kube_rbac_proxy_binding.yaml",
+			"rbac/prometheus_role.yaml",
+			"rbac/prometheus_rolebinding.yaml",
 		},
 	).WithConditionalStaticResourcesController(
 		"AWSEBSDriverConditionalStaticResourcesController",
@@ -270,24 +333,49 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		"node.yaml",
 		guestKubeClient,
 		guestKubeInformersForNamespaces.InformersFor(guestNamespace),
-		[]factory.Informer{guestConfigMapInformer.Informer()},
+		[]factory.Informer{guestConfigMapInformer.Informer(), guestSecretInformer.Informer(), guestCCDInformer.Informer()},
 		csidrivernodeservicecontroller.WithObservedProxyDaemonSetHook(),
 		csidrivernodeservicecontroller.WithCABundleDaemonSetHook(
 			guestNamespace,
 			trustedCAConfigMap,
 			guestConfigMapInformer,
 		),
-	).WithStorageClassController(
-		"AWSEBSDriverStorageClassController",
+		csidrivernodeservicecontroller.WithSecretHashAnnotationHook(guestNamespace, nodeMetricsCertSecretName, guestSecretInformer),
+		withNodeGroupsExcluded(guestCCDInformer.Lister()),
+		withStartupTaint(guestCCDInformer.Lister()),
+	).WithServiceMonitorController(
+		"AWSEBSDriverNodeServiceMonitorController",
+		guestDynamicClient,
 		assets.ReadFile,
-		[]string{
-			"storageclass_gp3.yaml",
-			"storageclass_gp2.yaml",
-		},
+		"node_servicemonitor.yaml",
+	)
+
+	windowsNodeManifest, err := assets.ReadFile("node_windows.yaml")
+	if err != nil {
+		return err
+	}
+	windowsNodeServiceController := newWindowsNodeServiceController(
+		"AWSEBSDriverWindowsNodeServiceController",
+		windowsNodeManifest,
+		guestOperatorClient,
 		guestKubeClient,
-		guestKubeInformersForNamespaces.InformersFor(""),
-		guestCCDInformers,
-		getKMSKeyHook(guestCCDInformers.Operator().V1().ClusterCSIDrivers().Lister()),
+		guestNamespace,
+		windowsNodeImages{
+			driver:              os.Getenv(windowsDriverImageEnvName),
+			nodeDriverRegistrar: os.Getenv(windowsNodeDriverRegistrarImageEnvName),
+			livenessProbe:       os.Getenv(windowsLivenessProbeImageEnvName),
+		},
+		guestNodeInformer,
+		guestKubeInformersForNamespaces.InformersFor(guestNamespace).Apps().V1().DaemonSets(),
+		[]factory.Informer{guestConfigMapInformer.Informer(), guestCCDInformer.Informer()},
+		eventRecorder,
+		csidrivernodeservicecontroller.WithObservedProxyDaemonSetHook(),
+		csidrivernodeservicecontroller.WithCABundleDaemonSetHook(
+			guestNamespace,
+			trustedCAConfigMap,
+			guestConfigMapInformer,
+		),
+		withStartupTaint(guestCCDInformer.Lister()),
 	)
 
 	if !isHypershift {
@@ -319,9 +407,6 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 				"rbac/storageclass_reader_resizer_binding.yaml",
 				"rbac/main_snapshotter_binding.yaml",
 				"service.yaml",
-				"rbac/prometheus_role.yaml",
-				"rbac/prometheus_rolebinding.yaml",
-				"rbac/kube_rbac_proxy_role.yaml",
 				"rbac/kube_rbac_proxy_binding.yaml",
 				"rbac/lease_leader_election_role.yaml",
 				"rbac/lease_leader_election_rolebinding.yaml",
@@ -347,6 +432,375 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		go serviceMonitorController.Run(ctx, 1)
 	}
 
+	if isHypershift {
+		// The CSI sidecars access the guest cluster as a dedicated ServiceAccount
+		// with only the permissions they need.
+		guestStaticResourcesController := staticresourcecontroller.NewStaticResourceController(
+			"AWSEBSDriverGuestRBACStaticResourcesController",
+			assets.ReadFile,
+			[]string{
+				"hypershift/guest_controller_sa.yaml",
+				"rbac/main_attacher_binding.yaml",
+				"rbac/main_provisioner_binding.yaml",
+				"rbac/volumesnapshot_reader_provisioner_binding.yaml",
+				"rbac/main_resizer_binding.yaml",
+				"rbac/storageclass_reader_resizer_binding.yaml",
+				"rbac/main_snapshotter_binding.yaml",
+				"rbac/lease_leader_election_role.yaml",
+				"rbac/lease_leader_election_rolebinding.yaml",
+				"hypershift/guest_token_minter_role.yaml",
+				"hypershift/guest_token_minter_rolebinding.yaml",
+			},
+			(&resourceapply.ClientHolder{}).WithKubernetes(guestKubeClient),
+			guestOperatorClient,
+			eventRecorder,
+		).AddKubeInformers(guestKubeInformersForNamespaces)
+
+		klog.Info("Starting guest RBAC static resources controller")
+		go guestStaticResourcesController.Run(ctx, 1)
+
+		hostedControlPlaneTrackerController := newHostedControlPlaneTrackerController(
+			"AWSEBSDriverHostedControlPlaneController",
+			guestOperatorClient,
+			controlPlaneKubeClient,
+			hcpTracker,
+			[]factory.Informer{hostedControlPlaneInformer, controlPlaneConfigMapInformer.Informer()},
+			eventRecorder,
+		)
+
+		klog.Info("Starting HostedControlPlane controller")
+		go hostedControlPlaneTrackerController.Run(ctx, 1)
+
+		guestKubeconfigController, err := newGuestKubeconfigController(
+			"AWSEBSDriverGuestKubeconfigController",
+			guestOperatorClient,
+			controlPlaneKubeClient,
+			guestKubeClient,
+			controlPlaneNamespace,
+			guestNamespace,
+			guestKubeConfig,
+			controlPlaneSecretInformer.Lister().Secrets(controlPlaneNamespace),
+			[]factory.Informer{controlPlaneSecretInformer.Informer()},
+			eventRecorder,
+		)
+		if err != nil {
+			return err
+		}
+
+		klog.Info("Starting guest kubeconfig controller")
+		go guestKubeconfigController.Run(ctx, 1)
+
+		hypershiftCredentialsController := newHypershiftCredentialsController(
+			"AWSEBSDriverCredentialsController",
+			guestOperatorClient,
+			controlPlaneKubeClient,
+			controlPlaneNamespace,
+			hostedControlPlaneLister,
+			controlPlaneSecretInformer.Lister().Secrets(controlPlaneNamespace),
+			[]factory.Informer{
+				hostedControlPlaneInformer,
+				controlPlaneSecretInformer.Informer(),
+			},
+			eventRecorder,
+		)
+
+		klog.Info("Starting credentials controller")
+		go hypershiftCredentialsController.Run(ctx, 1)
+
+		platformMismatchController := newPlatformMismatchController(
+			"AWSEBSDriverPlatformMismatchController",
+			guestOperatorClient,
+			guestInfraInformer.Lister(),
+			hostedControlPlaneLister,
+			controlPlaneNamespace,
+			awsInfraInformers,
+			eventRecorder,
+		)
+
+		klog.Info("Starting platform mismatch controller")
+		go platformMismatchController.Run(ctx, 1)
+
+		hypershiftServiceMonitorController := staticresourcecontroller.NewStaticResourceController(
+			"AWSEBSDriverServiceMonitorController",
+			assetWithNamespaceFunc(controlPlaneNamespace),
+			[]string{"hypershift/servicemonitor.yaml"},
+			(&resourceapply.ClientHolder{}).WithDynamicClient(controlPlaneDynamicClient),
+			guestOperatorClient,
+			eventRecorder,
+		).WithIgnoreNotFoundOnCreate()
+
+		klog.Info("Starting ServiceMonitor controller")
+		go hypershiftServiceMonitorController.Run(ctx, 1)
+	}
+
+	endpointCheckInformers := append([]factory.Informer{}, awsInfraInformers...)
+	if !isHypershift {
+		endpointCheckInformers = append(endpointCheckInformers, controlPlaneCloudConfigInformer.Informer())
+	}
+	endpointCheckController := newEndpointCheckController(
+		"AWSEBSDriverEndpointCheckController",
+		guestOperatorClient,
+		awsInfraLister,
+		controlPlaneCloudConfigLister,
+		isHypershift,
+		endpointCheckInformers,
+		eventRecorder,
+	)
+
+	klog.Info("Starting endpoint check controller")
+	go endpointCheckController.Run(ctx, 1)
+
+	extraTagsController := newExtraTagsController(
+		"AWSEBSDriverExtraTagsController",
+		guestOperatorClient,
+		awsInfraLister,
+		guestCCDInformer.Lister(),
+		append([]factory.Informer{guestCCDInformer.Informer()}, awsInfraInformers...),
+		eventRecorder,
+	)
+
+	klog.Info("Starting extra tags controller")
+	go extraTagsController.Run(ctx, 1)
+
+	// The operator exchanges tokens of the driver ServiceAccount for AWS credentials when the driver uses STS.
+	webIdentityTokenRetriever := &serviceAccountTokenRetriever{
+		kubeClient:     guestKubeClient,
+		namespace:      guestNamespace,
+		serviceAccount: guestControllerServiceAccount,
+	}
+	newEC2Client := ec2ClientFunc(
+		awsInfraLister,
+		controlPlaneSecretInformer.Lister().Secrets(controlPlaneNamespace),
+		controlPlaneCloudConfigLister,
+		isHypershift,
+		webIdentityTokenRetriever,
+	)
+
+	tagReconcilerController := newTagReconcilerController(
+		"AWSEBSDriverTagReconcilerController",
+		guestOperatorClient,
+		controlPlaneKubeClient,
+		guestDynamicClient,
+		controlPlaneNamespace,
+		awsInfraLister,
+		guestCCDInformer.Lister(),
+		guestPVInformer.Lister(),
+		controlPlaneConfigMapInformer.Lister().ConfigMaps(controlPlaneNamespace),
+		newEC2Client,
+		append([]factory.Informer{
+			guestCCDInformer.Informer(),
+			guestPVInformer.Informer(),
+			controlPlaneSecretInformer.Informer(),
+			controlPlaneConfigMapInformer.Informer(),
+		}, awsInfraInformers...),
+		eventRecorder,
+	)
+
+	klog.Info("Starting tag reconciler controller")
+	go tagReconcilerController.Run(ctx, 1)
+
+	nodeManifest, err := assets.ReadFile("node.yaml")
+	if err != nil {
+		return err
+	}
+	guestDaemonSetInformer := guestKubeInformersForNamespaces.InformersFor(guestNamespace).Apps().V1().DaemonSets()
+	nodeGroupsController := newNodeGroupsController(
+		"AWSEBSDriverNodeGroupsController",
+		guestOperatorClient,
+		guestKubeClient,
+		guestNamespace,
+		nodeManifest,
+		guestCCDInformer.Lister(),
+		guestDaemonSetInformer.Lister().DaemonSets(guestNamespace),
+		[]factory.Informer{
+			guestCCDInformer.Informer(),
+			guestDaemonSetInformer.Informer(),
+			guestConfigMapInformer.Informer(),
+			guestSecretInformer.Informer(),
+		},
+		eventRecorder,
+		csidrivernodeservicecontroller.WithObservedProxyDaemonSetHook(),
+		csidrivernodeservicecontroller.WithCABundleDaemonSetHook(
+			guestNamespace,
+			trustedCAConfigMap,
+			guestConfigMapInformer,
+		),
+		csidrivernodeservicecontroller.WithSecretHashAnnotationHook(guestNamespace, nodeMetricsCertSecretName, guestSecretInformer),
+		withStartupTaint(guestCCDInformer.Lister()),
+	)
+
+	klog.Info("Starting node groups controller")
+	go nodeGroupsController.Run(ctx, 1)
+
+	// The RBAC of the startup taint removal exists only while the feature is enabled.
+	shouldCreateStartupTaintRBAC, shouldDeleteStartupTaintRBAC := startupTaintConditionalFuncs(guestCCDInformer.Lister())
+	startupTaintStaticResourcesController := staticresourcecontroller.NewStaticResourceController(
+		"AWSEBSDriverStartupTaintStaticResourcesController",
+		assets.ReadFile,
+		[]string{},
+		(&resourceapply.ClientHolder{}).WithKubernetes(guestKubeClient),
+		guestOperatorClient,
+		eventRecorder,
+	).WithConditionalResources(
+		assets.ReadFile,
+		[]string{
+			"rbac/node_startup_taint_role.yaml",
+			"rbac/node_startup_taint_binding.yaml",
+		},
+		shouldCreateStartupTaintRBAC,
+		shouldDeleteStartupTaintRBAC,
+	).AddKubeInformers(guestKubeInformersForNamespaces).AddInformer(guestCCDInformer.Informer())
+
+	klog.Info("Starting startup taint static resources controller")
+	go startupTaintStaticResourcesController.Run(ctx, 1)
+
+	startupTaintController := newStartupTaintController(
+		"AWSEBSDriverStartupTaintController",
+		guestOperatorClient,
+		guestCCDInformer.Lister(),
+		guestNodeInformer.Lister(),
+		[]factory.Informer{guestCCDInformer.Informer(), guestNodeInformer.Informer()},
+		eventRecorder,
+	)
+
+	klog.Info("Starting startup taint controller")
+	go startupTaintController.Run(ctx, 1)
+
+	guestCSINodeInformer := guestKubeInformersForNamespaces.InformersFor("").Storage().V1().CSINodes()
+	guestVolumeAttachmentInformer := guestKubeInformersForNamespaces.InformersFor("").Storage().V1().VolumeAttachments()
+	attachCapacityController := newAttachCapacityController(
+		"AWSEBSDriverAttachCapacityController",
+		guestOperatorClient,
+		guestCCDInformer.Lister(),
+		guestCSINodeInformer.Lister(),
+		guestVolumeAttachmentInformer.Lister(),
+		[]factory.Informer{
+			guestCCDInformer.Informer(),
+			guestCSINodeInformer.Informer(),
+			guestVolumeAttachmentInformer.Informer(),
+		},
+		eventRecorder,
+	)
+
+	klog.Info("Starting attach capacity controller")
+	go attachCapacityController.Run(ctx, 1)
+
+	guestStorageClassInformer := guestKubeInformersForNamespaces.InformersFor("").Storage().V1().StorageClasses()
+	storageClassController := newStorageClassController(
+		"AWSEBSDriverStorageClassController",
+		guestOperatorClient,
+		guestKubeClient,
+		guestCCDInformer.Lister(),
+		guestStorageClassInformer.Lister(),
+		guestNodeInformer.Lister(),
+		assets.ReadFile,
+		append([]factory.Informer{guestCCDInformer.Informer(), guestStorageClassInformer.Informer(), guestNodeInformer.Informer()}, awsInfraInformers...),
+		eventRecorder,
+		getKMSKeyHook(guestCCDInformer.Lister(), awsInfraLister),
+		getGP3ParametersHook(guestCCDInformer.Lister()),
+		// Last, to validate the StorageClasses rendered by the other hooks.
+		getStorageClassPolicyHook(guestCCDInformer.Lister()),
+	)
+
+	klog.Info("Starting StorageClass controller")
+	go storageClassController.Run(ctx, 1)
+
+	kmsKeyController := newKMSKeyController(
+		"AWSEBSDriverKMSKeyController",
+		guestOperatorClient,
+		guestCCDInformer.Lister(),
+		awsInfraLister,
+		append([]factory.Informer{guestCCDInformer.Informer()}, awsInfraInformers...),
+		eventRecorder,
+	)
+
+	klog.Info("Starting KMS key controller")
+	go kmsKeyController.Run(ctx, 1)
+
+	kmsInventoryController := newKMSInventoryController(
+		"AWSEBSDriverKMSInventoryController",
+		guestOperatorClient,
+		guestKubeClient,
+		guestNamespace,
+		guestCCDInformer.Lister(),
+		guestPVInformer.Lister(),
+		guestStorageClassInformer.Lister(),
+		guestConfigMapInformer.Lister().ConfigMaps(guestNamespace),
+		ec2ClientForEndpointFunc(
+			awsInfraLister,
+			controlPlaneSecretInformer.Lister().Secrets(controlPlaneNamespace),
+			controlPlaneCloudConfigLister,
+			isHypershift,
+			webIdentityTokenRetriever,
+		),
+		append([]factory.Informer{
+			guestCCDInformer.Informer(),
+			guestPVInformer.Informer(),
+			guestStorageClassInformer.Informer(),
+			guestConfigMapInformer.Informer(),
+			controlPlaneSecretInformer.Informer(),
+		}, awsInfraInformers...),
+		eventRecorder,
+	)
+
+	klog.Info("Starting KMS key inventory controller")
+	go kmsInventoryController.Run(ctx, 1)
+
+	// The webhook exists only while the StorageClass policy is set.
+	operatorImage, err := getOperatorImage(ctx, controlPlaneKubeClient, controlPlaneNamespace)
+	if err != nil {
+		klog.Warningf("The StorageClass policy webhook can't be deployed: %v", err)
+	}
+	shouldCreateWebhook, shouldDeleteWebhook := webhookConditionalFuncs(guestCCDInformer.Lister(), operatorImage)
+	webhookStaticResourcesController := staticresourcecontroller.NewStaticResourceController(
+		"AWSEBSDriverWebhookStaticResourcesController",
+		assets.ReadFile,
+		[]string{},
+		(&resourceapply.ClientHolder{}).WithKubernetes(guestKubeClient),
+		guestOperatorClient,
+		eventRecorder,
+	).WithConditionalResources(
+		assets.ReadFile,
+		[]string{
+			"webhook_sa.yaml",
+			"webhook_service.yaml",
+		},
+		shouldCreateWebhook,
+		shouldDeleteWebhook,
+	).AddKubeInformers(guestKubeInformersForNamespaces).AddInformer(guestCCDInformer.Informer())
+
+	klog.Info("Starting webhook static resources controller")
+	go webhookStaticResourcesController.Run(ctx, 1)
+
+	webhookManifest, err := assets.ReadFile("webhook.yaml")
+	if err != nil {
+		return err
+	}
+	webhookConfigManifest, err := assets.ReadFile("webhook_config.yaml")
+	if err != nil {
+		return err
+	}
+	webhookController := newWebhookController(
+		"AWSEBSDriverWebhookController",
+		webhookManifest,
+		webhookConfigManifest,
+		guestOperatorClient,
+		guestKubeClient,
+		guestNamespace,
+		operatorImage,
+		guestCCDInformer.Lister(),
+		guestKubeInformersForNamespaces.InformersFor(guestNamespace).Apps().V1().Deployments(),
+		guestKubeInformersForNamespaces.InformersFor("").Admissionregistration().V1().ValidatingWebhookConfigurations(),
+		[]factory.Informer{guestCCDInformer.Informer(), guestNodeInformer.Informer(), guestInfraInformer.Informer()},
+		eventRecorder,
+		nil,
+		csidrivercontrollerservicecontroller.WithControlPlaneTopologyHook(guestConfigInformers),
+		csidrivercontrollerservicecontroller.WithReplicasHook(guestNodeInformer.Lister()),
+	)
+
+	klog.Info("Starting webhook controller")
+	go webhookController.Run(ctx, 1)
+
 	klog.Info("Starting the control plane informers")
 	go controlPlaneKubeInformersForNamespaces.Start(ctx.Done())
 	go controlPlaneDynamicInformers.Start(ctx.Done())
@@ -363,6 +817,9 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 	klog.Info("Starting guest cluster controllerset")
 	go guestCSIControllerSet.Run(ctx, 1)
 
+	klog.Info("Starting Windows node service controller")
+	go windowsNodeServiceController.Run(ctx, 1)
+
 	<-ctx.Done()
 
 	return fmt.Errorf("stopped")
@@ -409,23 +866,16 @@ func withCustomAWSCABundle(isHypershift bool, cloudConfigLister corev1listers.Co
 	}
 }
 
+// withCustomEndPoint adds the AWS service endpoint overrides from Infrastructure.Status.PlatformStatus.AWS.ServiceEndpoints
+// to the driver container as environment variables. Only services used by the driver are propagated, see
+// awsServiceEndpointEnvVars. Malformed or duplicate entries make the hook fail, which degrades the operator.
 func withCustomEndPoint(infraLister v1.InfrastructureLister) dc.DeploymentHookFunc {
 	return func(_ *opv1.OperatorSpec, deployment *appsv1.Deployment) error {
-		infra, err := infraLister.Get(infrastructureName)
+		serviceEndPoints, err := getServiceEndpoints(infraLister)
 		if err != nil {
 			return err
 		}
-		if infra.Status.PlatformStatus == nil || infra.Status.PlatformStatus.AWS == nil {
-			return nil
-		}
-		serviceEndPoints := infra.Status.PlatformStatus.AWS.ServiceEndpoints
-		ec2EndPoint := ""
-		for _, serviceEndPoint := range serviceEndPoints {
-			if serviceEndPoint.Name == "ec2" {
-				ec2EndPoint = serviceEndPoint.URL
-			}
-		}
-		if ec2EndPoint == "" {
+		if len(serviceEndPoints) == 0 {
 			return nil
 		}
 
@@ -434,16 +884,74 @@ func withCustomEndPoint(infraLister v1.InfrastructureLister) dc.DeploymentHookFu
 			if container.Name != "csi-driver" {
 				continue
 			}
-			container.Env = append(container.Env, corev1.EnvVar{
-				Name:  "AWS_EC2_ENDPOINT",
-				Value: ec2EndPoint,
-			})
+			for _, serviceEndPoint := range serviceEndPoints {
+				container.Env = append(container.Env, corev1.EnvVar{
+					Name:  awsServiceEndpointEnvVars[serviceEndPoint.Name],
+					Value: serviceEndPoint.URL,
+				})
+			}
 			return nil
 		}
 		return nil
 	}
 }
 
+// getServiceEndpoints returns the validated service endpoint overrides of the services used by the driver,
+// in the order they are listed in the Infrastructure object.
+func getServiceEndpoints(infraLister v1.InfrastructureLister) ([]configv1.AWSServiceEndpoint, error) {
+	infra, err := infraLister.Get(infrastructureName)
+	if err != nil {
+		return nil, err
+	}
+	if infra.Status.PlatformStatus == nil || infra.Status.PlatformStatus.AWS == nil {
+		return nil, nil
+	}
+	return filterServiceEndpoints(infra.Status.PlatformStatus.AWS.ServiceEndpoints)
+}
+
+// filterServiceEndpoints validates the given service endpoints and drops the ones of services not used by the driver.
+func filterServiceEndpoints(serviceEndPoints []configv1.AWSServiceEndpoint) ([]configv1.AWSServiceEndpoint, error) {
+	var errs []error
+	seen := sets.New[string]()
+	filtered := make([]configv1.AWSServiceEndpoint, 0, len(serviceEndPoints))
+	for _, serviceEndPoint := range serviceEndPoints {
+		// Endpoints of other services are not validated, the driver never uses them.
+		if _, ok := awsServiceEndpointEnvVars[serviceEndPoint.Name]; !ok {
+			klog.V(4).Infof("Ignoring endpoint of AWS service %q not used by the driver", serviceEndPoint.Name)
+			continue
+		}
+		if seen.Has(serviceEndPoint.Name) {
+			errs = append(errs, fmt.Errorf("duplicate endpoint for AWS service %q", serviceEndPoint.Name))
+			continue
+		}
+		seen.Insert(serviceEndPoint.Name)
+
+		if err := validateServiceEndpointURL(serviceEndPoint.URL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid endpoint for AWS service %q: %w", serviceEndPoint.Name, err))
+			continue
+		}
+		filtered = append(filtered, serviceEndPoint)
+	}
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return filtered, nil
+}
+
+func validateServiceEndpointURL(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("URL %q must use the https scheme", endpoint)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", endpoint)
+	}
+	return nil
+}
+
 func newCustomAWSBundleSyncer(
 	operatorClient v1helpers.OperatorClient,
 	kubeInformers v1helpers.KubeInformersForNamespaces,
@@ -495,30 +1003,44 @@ func customAWSCABundle(isHypershift bool, cloudConfigLister corev1listers.Config
 	return configName, nil
 }
 
-// withCustomTags add tags from Infrastructure.Status.PlatformStatus.AWS.ResourceTags to the driver command line as
-// --extra-tags=<key1>=<value1>,<key2>=<value2>,...
-func withCustomTags(infraLister v1.InfrastructureLister) dc.DeploymentHookFunc {
+// customAWSCABundleData returns the content of the custom CA bundle, or nil when no custom CA bundle is used.
+func customAWSCABundleData(isHypershift bool, cloudConfigLister corev1listers.ConfigMapNamespaceLister) ([]byte, error) {
+	configName, err := customAWSCABundle(isHypershift, cloudConfigLister)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine if a custom CA bundle is in use: %w", err)
+	}
+	if configName == "" {
+		return nil, nil
+	}
+	cloudConfigCM, err := cloudConfigLister.Get(configName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the %s ConfigMap: %w", configName, err)
+	}
+	return []byte(cloudConfigCM.Data[caBundleKey]), nil
+}
+
+// withCustomTags add tags from Infrastructure.Status.PlatformStatus.AWS.ResourceTags and from the extraTagsAnnotation
+// of the ClusterCSIDriver to the driver command line as --extra-tags=<key1>=<value1>,<key2>=<value2>,...
+// Tags that the driver cannot parse or AWS would refuse are dropped, see filterValidTags, and only the
+// Infrastructure tags are used when the annotation cannot be parsed. Both are reported by the extra tags controller.
+func withCustomTags(infraLister v1.InfrastructureLister, ccdLister oplisterv1.ClusterCSIDriverLister) dc.DeploymentHookFunc {
 	return func(spec *opv1.OperatorSpec, deployment *appsv1.Deployment) error {
-		infra, err := infraLister.Get(infrastructureName)
-		if err != nil {
+		userTags, err := getEffectiveTags(infraLister, ccdLister)
+		var annotationErr *extraTagsAnnotationError
+		if errors.As(err, &annotationErr) {
+			klog.Warningf("Using only the Infrastructure resource tags: %v", err)
+		} else if err != nil {
 			return err
 		}
-		if infra.Status.PlatformStatus == nil || infra.Status.PlatformStatus.AWS == nil {
-			return nil
+		userTags, dropped, err := filterValidTags(userTags)
+		if err != nil {
+			// Reported by the extra tags controller.
+			klog.V(2).Infof("Dropping resource tags %q: %v", dropped, err)
 		}
-
-		userTags := infra.Status.PlatformStatus.AWS.ResourceTags
 		if len(userTags) == 0 {
 			return nil
 		}
-
-		tagPairs := make([]string, 0, len(userTags))
-		for _, userTag := range userTags {
-			pair := fmt.Sprintf("%s=%s", userTag.Key, userTag.Value)
-			tagPairs = append(tagPairs, pair)
-		}
-		tags := strings.Join(tagPairs, ",")
-		tagsArgument := fmt.Sprintf("--extra-tags=%s", tags)
+		tagsArgument := fmt.Sprintf("--extra-tags=%s", encodeTags(userTags))
 
 		for i := range deployment.Spec.Template.Spec.Containers {
 			container := &deployment.Spec.Template.Spec.Containers[i]
@@ -548,20 +1070,63 @@ func withNamespaceDeploymentHook(namespace string) dc.DeploymentHookFunc {
 	}
 }
 
-func withHypershiftReplicasHook(isHypershift bool, guestNodeLister corev1listers.NodeLister) dc.DeploymentHookFunc {
+func withHypershiftReplicasHook(isHypershift bool, guestNodeLister corev1listers.NodeLister, namespace string, hostedControlPlaneLister cache.GenericLister) dc.DeploymentHookFunc {
 	if !isHypershift {
 		return csidrivercontrollerservicecontroller.WithReplicasHook(guestNodeLister)
 	}
 	return func(_ *opv1.OperatorSpec, deployment *appsv1.Deployment) error {
-		// TODO: get this information from HostedControlPlane.Spec.AvailabilityPolicy
+		policy, err := getHostedControlPlaneAvailabilityPolicy(hostedControlPlaneLister, namespace)
+		if err != nil {
+			return err
+		}
 		replicas := int32(1)
+		if policy == hypershiftHighlyAvailable {
+			replicas = 2
+		}
 		deployment.Spec.Replicas = &replicas
+		withHostnameAntiAffinity(deployment)
 		return nil
 	}
+}
+
+// withHostnameAntiAffinity makes the hostname anti-affinity of the controller pods required
+// when there is more than one replica, so a single node failure does not take down all replicas.
+// The rolling update strategy (maxSurge: 0) and controller_pdb.yaml (maxUnavailable: 1) never
+// need two controller pods on the same node.
+func withHostnameAntiAffinity(deployment *appsv1.Deployment) {
+	podSpec := &deployment.Spec.Template.Spec
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas < 2 {
+		return
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.PodAntiAffinity == nil {
+		podSpec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	}
+	antiAffinity := podSpec.Affinity.PodAntiAffinity
 
+	var preferred []corev1.WeightedPodAffinityTerm
+	for _, term := range antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		if term.PodAffinityTerm.TopologyKey == corev1.LabelHostname {
+			continue
+		}
+		preferred = append(preferred, term)
+	}
+	antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = preferred
+
+	for _, term := range antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+		if term.TopologyKey == corev1.LabelHostname {
+			return
+		}
+	}
+	antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, corev1.PodAffinityTerm{
+		LabelSelector: deployment.Spec.Selector.DeepCopy(),
+		TopologyKey:   corev1.LabelHostname,
+	})
 }
 
-func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, namespace string, hostedControlPlaneLister cache.GenericLister) dc.DeploymentHookFunc {
+func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, namespace string, guestNamespace string, hostedControlPlaneLister cache.GenericLister) dc.DeploymentHookFunc {
 	return func(_ *opv1.OperatorSpec, deployment *appsv1.Deployment) error {
 		if !isHypershift {
 			return nil
@@ -571,7 +1136,15 @@ func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, nam
 		delete(deployment.Annotations, "config.openshift.io/inject-proxy")
 		delete(deployment.Annotations, "config.openshift.io/inject-proxy-cabundle")
 
+		hcp, err := getHostedControlPlane(hostedControlPlaneLister, namespace)
+		if err != nil {
+			return err
+		}
+
 		deployment.Spec.Template.Spec.PriorityClassName = hypershiftPriorityClass
+		if priorityClass := hcp.GetAnnotations()[hypershiftPriorityClassAnnotation]; priorityClass != "" {
+			deployment.Spec.Template.Spec.PriorityClassName = priorityClass
+		}
 
 		// Inject into the pod the volumes used by CSI and token minter sidecars.
 		podSpec := &deployment.Spec.Template.Spec
@@ -580,8 +1153,7 @@ func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, nam
 				Name: "hosted-kubeconfig",
 				VolumeSource: corev1.VolumeSource{
 					Secret: &corev1.SecretVolumeSource{
-						// FIXME: use a ServiceAccount from the guest cluster
-						SecretName: "service-network-admin-kubeconfig",
+						SecretName: guestKubeconfigSecretName,
 					},
 				},
 			},
@@ -599,27 +1171,60 @@ func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, nam
 			}
 		}
 
-		// The metrics-serving-cert volume is not used in Hypershift.
+		// The metrics are served with the serving certificate of the HostedControlPlane.
 		for i := range podSpec.Volumes {
-			if podSpec.Volumes[i].Name == "metrics-serving-cert" {
-				podSpec.Volumes = append(podSpec.Volumes[:i], podSpec.Volumes[i+1:]...)
-				break
+			if podSpec.Volumes[i].Name != "metrics-serving-cert" {
+				continue
+			}
+			podSpec.Volumes[i].VolumeSource = corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: hypershiftMetricsCertSecretName,
+				},
 			}
 		}
 
-		filtered := []corev1.Container{}
+		// The kube-rbac-proxies cannot review tokens of the HyperShift monitoring stack,
+		// they authenticate it by its client certificate instead.
+		podSpec.Volumes = append(podSpec.Volumes,
+			corev1.Volume{
+				Name: "metrics-client-ca",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: hypershiftRootCAConfigMap},
+					},
+				},
+			},
+			corev1.Volume{
+				Name: "kube-rbac-proxy-config",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: hypershiftKubeRBACProxyConfigMap},
+					},
+				},
+			},
+		)
 		for i := range podSpec.Containers {
-			switch podSpec.Containers[i].Name {
-			case "driver-kube-rbac-proxy":
-			case "provisioner-kube-rbac-proxy":
-			case "attacher-kube-rbac-proxy":
-			case "resizer-kube-rbac-proxy":
-			case "snapshotter-kube-rbac-proxy":
-			default:
-				filtered = append(filtered, podSpec.Containers[i])
+			container := &podSpec.Containers[i]
+			if !strings.HasSuffix(container.Name, "-kube-rbac-proxy") {
+				continue
 			}
+			container.Args = append(container.Args,
+				"--client-ca-file=/etc/tls/client/ca.crt",
+				"--config-file=/etc/kube-rbac-proxy/config.yaml",
+			)
+			container.VolumeMounts = append(container.VolumeMounts,
+				corev1.VolumeMount{
+					Name:      "metrics-client-ca",
+					MountPath: "/etc/tls/client",
+					ReadOnly:  true,
+				},
+				corev1.VolumeMount{
+					Name:      "kube-rbac-proxy-config",
+					MountPath: "/etc/kube-rbac-proxy",
+					ReadOnly:  true,
+				},
+			)
 		}
-		podSpec.Containers = filtered
 
 		// Inject into the CSI sidecars the hosted Kubeconfig.
 		for i := range podSpec.Containers {
@@ -635,27 +1240,28 @@ func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, nam
 			container.Args = append(container.Args, "--kubeconfig=$(KUBECONFIG)")
 			container.Env = append(container.Env, corev1.EnvVar{
 				Name:  "KUBECONFIG",
-				Value: "/etc/hosted-kubernetes/kubeconfig",
+				Value: guestKubeconfigMountPath + "/" + guestKubeconfigKey,
 			})
 			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
 				Name:      "hosted-kubeconfig",
-				MountPath: "/etc/hosted-kubernetes",
+				MountPath: guestKubeconfigMountPath,
 				ReadOnly:  true,
 			})
 		}
 
-		// Add the token minter sidecar into the pod.
+		// Add the token minter sidecar into the pod. It mints the web identity tokens of the guest
+		// ServiceAccount the operator creates for the CSI sidecars, see guestKubeconfigController.
 		podSpec.Containers = append(podSpec.Containers, corev1.Container{
 			Name:            "token-minter",
 			Image:           hypershiftImage,
 			ImagePullPolicy: corev1.PullIfNotPresent,
 			Command:         []string{"/usr/bin/control-plane-operator", "token-minter"},
 			Args: []string{
-				"--service-account-namespace=openshift-cluster-csi-drivers",
-				"--service-account-name=aws-ebs-csi-driver-controller-sa",
-				"--token-audience=openshift",
-				"--token-file=/var/run/secrets/openshift/serviceaccount/token",
-				"--kubeconfig=/etc/hosted-kubernetes/kubeconfig",
+				"--service-account-namespace=" + guestNamespace,
+				"--service-account-name=" + guestControllerServiceAccount,
+				"--token-audience=" + webIdentityAudience,
+				"--token-file=" + webIdentityTokenFile,
+				"--kubeconfig=" + guestKubeconfigMountPath + "/" + guestKubeconfigKey,
 			},
 			Resources: corev1.ResourceRequirements{
 				Requests: corev1.ResourceList{
@@ -670,7 +1276,7 @@ func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, nam
 				},
 				{
 					Name:      "hosted-kubeconfig",
-					MountPath: "/etc/hosted-kubernetes",
+					MountPath: guestKubeconfigMountPath,
 					ReadOnly:  true,
 				},
 			},
@@ -755,9 +1361,88 @@ func withHypershiftDeploymentHook(isHypershift bool, hypershiftImage string, nam
 				Effect:   corev1.TaintEffectNoSchedule,
 			},
 		}
+		tolerations, err := getHostedControlPlaneTolerations(hcp)
+		if err != nil {
+			return err
+		}
+		podSpec.Tolerations = append(podSpec.Tolerations, tolerations...)
 
-		return nil
+		return applyResourceRequestOverrides(hcp.GetAnnotations(), deployment)
+	}
+}
+
+// getHostedControlPlaneTolerations returns spec.tolerations of the HostedControlPlane,
+// added to all hosted control plane components.
+func getHostedControlPlaneTolerations(hcp *unstructured.Unstructured) ([]corev1.Toleration, error) {
+	list, found, err := unstructured.NestedSlice(hcp.UnstructuredContent(), "spec", "tolerations")
+	if err != nil || !found {
+		return nil, err
+	}
+	tolerations := make([]corev1.Toleration, 0, len(list))
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid toleration in HostedControlPlane %s/%s: %v", hcp.GetNamespace(), hcp.GetName(), item)
+		}
+		toleration := corev1.Toleration{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &toleration); err != nil {
+			return nil, fmt.Errorf("invalid toleration in HostedControlPlane %s/%s: %w", hcp.GetNamespace(), hcp.GetName(), err)
+		}
+		tolerations = append(tolerations, toleration)
 	}
+	return tolerations, nil
+}
+
+// applyResourceRequestOverrides sets the container resource requests from the HyperShift
+// resource-request-override annotations of the HostedControlPlane. The annotation key is
+// <prefix>/<deployment name>.<container name> and the value is a comma separated list of
+// <resource name>=<quantity>, e.g. "cpu=100m,memory=200Mi".
+func applyResourceRequestOverrides(annotations map[string]string, deployment *appsv1.Deployment) error {
+	var errs []error
+	for key, value := range annotations {
+		target, found := strings.CutPrefix(key, hypershiftResourceRequestOverridePrefix+"/")
+		if !found {
+			continue
+		}
+		deploymentName, containerName, found := strings.Cut(target, ".")
+		if !found || deploymentName != deployment.Name {
+			continue
+		}
+		requests, err := parseResourceRequests(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid annotation %s: %w", key, err))
+			continue
+		}
+		for i := range deployment.Spec.Template.Spec.Containers {
+			container := &deployment.Spec.Template.Spec.Containers[i]
+			if container.Name != containerName {
+				continue
+			}
+			if container.Resources.Requests == nil {
+				container.Resources.Requests = corev1.ResourceList{}
+			}
+			for name, quantity := range requests {
+				container.Resources.Requests[name] = quantity
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func parseResourceRequests(value string) (corev1.ResourceList, error) {
+	requests := corev1.ResourceList{}
+	for _, item := range strings.Split(value, ",") {
+		name, quantity, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("expected <resource name>=<quantity>, got %q", item)
+		}
+		q, err := resource.ParseQuantity(quantity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity of %s: %w", name, err)
+		}
+		requests[corev1.ResourceName(name)] = q
+	}
+	return requests, nil
 }
 
 func getHostedControlPlaneNodeSelector(hostedControlPlaneLister cache.GenericLister, namespace string) (map[string]string, error) {
@@ -776,6 +1461,27 @@ func getHostedControlPlaneNodeSelector(hostedControlPlaneLister cache.GenericLis
 	return nodeSelector, nil
 }
 
+// getHostedControlPlaneAvailabilityPolicy returns spec.controllerAvailabilityPolicy of the HostedControlPlane.
+// HyperShift defaults the policy to SingleReplica.
+func getHostedControlPlaneAvailabilityPolicy(hostedControlPlaneLister cache.GenericLister, namespace string) (string, error) {
+	hcp, err := getHostedControlPlane(hostedControlPlaneLister, namespace)
+	if err != nil {
+		return "", err
+	}
+	policy, exists, err := unstructured.NestedString(hcp.UnstructuredContent(), "spec", "controllerAvailabilityPolicy")
+	if err != nil {
+		return "", err
+	}
+	if !exists || policy == "" {
+		return hypershiftSingleReplica, nil
+	}
+	if policy != hypershiftSingleReplica && policy != hypershiftHighlyAvailable {
+		return "", fmt.Errorf("unknown controllerAvailabilityPolicy %q of HostedControlPlane %s/%s", policy, namespace, hcp.GetName())
+	}
+	klog.V(4).Infof("Using controller availability policy %s", policy)
+	return policy, nil
+}
+
 func getHostedControlPlane(hostedControlPlaneLister cache.GenericLister, namespace string) (*unstructured.Unstructured, error) {
 	list, err := hostedControlPlaneLister.ByNamespace(namespace).List(labels.Everything())
 	if err != nil {
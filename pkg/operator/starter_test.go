@@ -1,20 +1,27 @@
 package operator
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	v1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/aws-ebs-csi-driver-operator/assets"
 	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
 	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
 	"github.com/openshift/library-go/pkg/operator/v1helpers"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 func TestWithCustomCABundle(t *testing.T) {
@@ -167,6 +174,7 @@ func TestWithCustomTags(t *testing.T) {
 	tests := []struct {
 		name         string
 		userTags     []v1.AWSResourceTag
+		annotations  map[string]string
 		inDeployment *appsv1.Deployment
 		expected     *appsv1.Deployment
 	}{
@@ -240,6 +248,121 @@ func TestWithCustomTags(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "tags from infrastructure and ClusterCSIDriver",
+			userTags: []v1.AWSResourceTag{
+				{
+					Key:   "key1",
+					Value: "value1",
+				},
+				{
+					Key:   "key2",
+					Value: "value2",
+				},
+			},
+			annotations: map[string]string{
+				extraTagsAnnotation: `{"key3": "value3", "key2": "ignored", "cost-center": "storage"}`,
+			},
+			inDeployment: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expected: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+								Args: []string{
+									"--extra-tags=key1=value1,key2=value2,cost-center=storage,key3=value3",
+								},
+							}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "invalid ClusterCSIDriver tag",
+			userTags: []v1.AWSResourceTag{
+				{
+					Key:   "key1",
+					Value: "value1",
+				},
+			},
+			annotations: map[string]string{
+				extraTagsAnnotation: `{"a=b": "value", "cost-center": "storage"}`,
+			},
+			inDeployment: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expected: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+								Args: []string{
+									"--extra-tags=key1=value1,cost-center=storage",
+								},
+							}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "malformed ClusterCSIDriver annotation",
+			userTags: []v1.AWSResourceTag{
+				{
+					Key:   "key1",
+					Value: "value1",
+				},
+			},
+			annotations: map[string]string{
+				extraTagsAnnotation: `cost-center=storage`,
+			},
+			inDeployment: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expected: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+								Args: []string{
+									"--extra-tags=key1=value1",
+								},
+							}},
+						},
+					},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -266,7 +389,13 @@ func TestWithCustomTags(t *testing.T) {
 				return configInformerFactory.Config().V1().Infrastructures().Informer().HasSynced(), nil
 			})
 			deployment := test.inDeployment.DeepCopy()
-			err := withCustomTags(configInformerFactory.Config().V1().Infrastructures().Lister())(nil, deployment)
+			ccdLister := &fakeCCDLister{&opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        provisionerName,
+					Annotations: test.annotations,
+				},
+			}}
+			err := withCustomTags(configInformerFactory.Config().V1().Infrastructures().Lister(), ccdLister)(nil, deployment)
 			if err != nil {
 				t.Errorf("unexpected error: %v", err)
 			}
@@ -283,6 +412,7 @@ func TestWithCustomEndPoint(t *testing.T) {
 		customEndPoints []v1.AWSServiceEndpoint
 		inDeployment    *appsv1.Deployment
 		expected        *appsv1.Deployment
+		expectError     bool
 	}{
 		{
 			name:            "when no service end point is set",
@@ -369,6 +499,172 @@ func TestWithCustomEndPoint(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "when custom sts, kms and iam end points are specified",
+			customEndPoints: []v1.AWSServiceEndpoint{
+				{
+					Name: "sts",
+					URL:  "https://sts.example.com",
+				},
+				{
+					Name: "elasticloadbalancing",
+					URL:  "https://elb.example.com",
+				},
+				{
+					Name: "kms",
+					URL:  "https://kms.example.com",
+				},
+				{
+					Name: "iam",
+					URL:  "https://iam.example.com",
+				},
+			},
+			inDeployment: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expected: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+								Env: []corev1.EnvVar{
+									{
+										Name:  "AWS_ENDPOINT_URL_STS",
+										Value: "https://sts.example.com",
+									},
+									{
+										Name:  "AWS_ENDPOINT_URL_KMS",
+										Value: "https://kms.example.com",
+									},
+									{
+										Name:  "AWS_ENDPOINT_URL_IAM",
+										Value: "https://iam.example.com",
+									},
+								},
+							}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "when an end point is specified twice",
+			customEndPoints: []v1.AWSServiceEndpoint{
+				{
+					Name: "ec2",
+					URL:  "https://example.com",
+				},
+				{
+					Name: "ec2",
+					URL:  "https://other.example.com",
+				},
+			},
+			inDeployment: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expected: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "when an end point is malformed",
+			customEndPoints: []v1.AWSServiceEndpoint{
+				{
+					Name: "sts",
+					URL:  "http://sts.example.com",
+				},
+			},
+			inDeployment: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expected: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "when an end point of a service not used by the driver is malformed",
+			customEndPoints: []v1.AWSServiceEndpoint{
+				{
+					Name: "ec2",
+					URL:  "https://ec2.example.com",
+				},
+				{
+					Name: "elasticloadbalancing",
+					URL:  "elb.example.com",
+				},
+			},
+			inDeployment: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+							}},
+						},
+					},
+				},
+			},
+			expected: &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name: "csi-driver",
+								Env: []corev1.EnvVar{
+									{
+										Name:  "AWS_EC2_ENDPOINT",
+										Value: "https://ec2.example.com",
+									},
+								},
+							}},
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -395,9 +691,12 @@ func TestWithCustomEndPoint(t *testing.T) {
 			})
 			deployment := test.inDeployment.DeepCopy()
 			err := withCustomEndPoint(configInformerFactory.Config().V1().Infrastructures().Lister())(nil, deployment)
-			if err != nil {
+			if err != nil && !test.expectError {
 				t.Errorf("unexpected error: %v", err)
 			}
+			if err == nil && test.expectError {
+				t.Errorf("expected error, got none")
+			}
 			if e, a := test.expected, deployment; !equality.Semantic.DeepEqual(e, a) {
 				t.Errorf("unexpected deployment\nwant=%#v\ngot= %#v", e, a)
 			}
@@ -550,3 +849,326 @@ func TestWithHypershiftControlPlaneImages(t *testing.T) {
 	}
 
 }
+
+func newHostedControlPlaneLister(t *testing.T, hcps ...*unstructured.Unstructured) cache.GenericLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, hcp := range hcps {
+		if err := indexer.Add(hcp); err != nil {
+			t.Fatalf("failed to add HostedControlPlane: %v", err)
+		}
+	}
+	return cache.NewGenericLister(indexer, hostedControlPlaneGVR.GroupResource())
+}
+
+func hostedControlPlane(namespace string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "hypershift.openshift.io/v1beta1",
+			"kind":       "HostedControlPlane",
+			"metadata": map[string]interface{}{
+				"name":      "hcp",
+				"namespace": namespace,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+func TestWithHypershiftReplicasHook(t *testing.T) {
+	const namespace = "clusters-test"
+	preferredAntiAffinity := &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"app": "aws-ebs-csi-driver-controller"},
+						},
+						TopologyKey: corev1.LabelHostname,
+					},
+				},
+			},
+		},
+	}
+	requiredAntiAffinity := &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "aws-ebs-csi-driver-controller"},
+					},
+					TopologyKey: corev1.LabelHostname,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name             string
+		hcps             []*unstructured.Unstructured
+		expectedReplicas int32
+		expectedAffinity *corev1.Affinity
+		expectError      bool
+	}{
+		{
+			name:             "no availability policy",
+			hcps:             []*unstructured.Unstructured{hostedControlPlane(namespace, map[string]interface{}{})},
+			expectedReplicas: 1,
+			expectedAffinity: preferredAntiAffinity,
+		},
+		{
+			name: "single replica",
+			hcps: []*unstructured.Unstructured{hostedControlPlane(namespace, map[string]interface{}{
+				"controllerAvailabilityPolicy": "SingleReplica",
+			})},
+			expectedReplicas: 1,
+			expectedAffinity: preferredAntiAffinity,
+		},
+		{
+			name: "highly available",
+			hcps: []*unstructured.Unstructured{hostedControlPlane(namespace, map[string]interface{}{
+				"controllerAvailabilityPolicy": "HighlyAvailable",
+			})},
+			expectedReplicas: 2,
+			expectedAffinity: requiredAntiAffinity,
+		},
+		{
+			name: "unknown availability policy",
+			hcps: []*unstructured.Unstructured{hostedControlPlane(namespace, map[string]interface{}{
+				"controllerAvailabilityPolicy": "Unknown",
+			})},
+			expectError: true,
+		},
+		{
+			name:        "no HostedControlPlane",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "aws-ebs-csi-driver-controller"},
+					},
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Affinity: preferredAntiAffinity.DeepCopy(),
+						},
+					},
+				},
+			}
+			hook := withHypershiftReplicasHook(true, nil, namespace, newHostedControlPlaneLister(t, test.hcps...))
+			err := hook(nil, deployment)
+			if err != nil {
+				if !test.expectError {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if test.expectError {
+				t.Fatalf("expected error, got none")
+			}
+			if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != test.expectedReplicas {
+				t.Errorf("expected %d replicas, got %v", test.expectedReplicas, deployment.Spec.Replicas)
+			}
+			if e, a := test.expectedAffinity, deployment.Spec.Template.Spec.Affinity; !equality.Semantic.DeepEqual(e, a) {
+				t.Errorf("unexpected affinity\nwant=%#v\ngot= %#v", e, a)
+			}
+		})
+	}
+}
+
+func TestControllerPDBAllowsHighlyAvailableReplicas(t *testing.T) {
+	data, err := assets.ReadFile("controller_pdb.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdb := resourceread.ReadPodDisruptionBudgetV1OrDie(data)
+	// With 2 replicas, the PDB must keep one replica running and still allow a node drain.
+	if pdb.Spec.MaxUnavailable == nil || pdb.Spec.MaxUnavailable.IntValue() != 1 {
+		t.Errorf("expected maxUnavailable: 1, got %v", pdb.Spec.MaxUnavailable)
+	}
+	if pdb.Spec.MinAvailable != nil {
+		t.Errorf("expected no minAvailable, got %v", pdb.Spec.MinAvailable)
+	}
+}
+
+func TestWithHypershiftDeploymentHookMetrics(t *testing.T) {
+	const namespace = "clusters-test"
+	data, err := assets.ReadFile("controller.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := resourceread.ReadDeploymentV1OrDie(data)
+	hcpLister := newHostedControlPlaneLister(t, hostedControlPlane(namespace, map[string]interface{}{}))
+	if err := withHypershiftDeploymentHook(true, "hypershift-image", namespace, defaultNamespace, hcpLister)(nil, deployment); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	podSpec := deployment.Spec.Template.Spec
+	volumes := map[string]corev1.Volume{}
+	for _, volume := range podSpec.Volumes {
+		volumes[volume.Name] = volume
+	}
+	for _, name := range []string{"metrics-serving-cert", "metrics-client-ca", "kube-rbac-proxy-config"} {
+		if _, found := volumes[name]; !found {
+			t.Errorf("volume %s not found", name)
+		}
+	}
+	if secret := volumes["metrics-serving-cert"].Secret; secret == nil || secret.SecretName != hypershiftMetricsCertSecretName {
+		t.Errorf("expected the metrics to be served with Secret %s, got %+v", hypershiftMetricsCertSecretName, volumes["metrics-serving-cert"].VolumeSource)
+	}
+	if configMap := volumes["metrics-client-ca"].ConfigMap; configMap == nil || configMap.Name != hypershiftRootCAConfigMap {
+		t.Errorf("expected the metrics client CA from ConfigMap %s, got %+v", hypershiftRootCAConfigMap, volumes["metrics-client-ca"].VolumeSource)
+	}
+
+	proxies := 0
+	for _, container := range podSpec.Containers {
+		if !strings.HasSuffix(container.Name, "-kube-rbac-proxy") {
+			continue
+		}
+		proxies++
+		args := strings.Join(container.Args, " ")
+		for _, arg := range []string{"--tls-cert-file=/etc/tls/private/tls.crt", "--client-ca-file=/etc/tls/client/ca.crt", "--config-file=/etc/kube-rbac-proxy/config.yaml"} {
+			if !strings.Contains(args, arg) {
+				t.Errorf("container %s: argument %s not found in %s", container.Name, arg, args)
+			}
+		}
+	}
+	if proxies != 5 {
+		t.Errorf("expected 5 kube-rbac-proxy containers, got %d", proxies)
+	}
+}
+
+func TestWithHypershiftDeploymentHookTokenMinter(t *testing.T) {
+	const namespace = "clusters-test"
+	data, err := assets.ReadFile("controller.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := resourceread.ReadDeploymentV1OrDie(data)
+	hcpLister := newHostedControlPlaneLister(t, hostedControlPlane(namespace, map[string]interface{}{}))
+	if err := withHypershiftDeploymentHook(true, "hypershift-image", namespace, "guest-namespace", hcpLister)(nil, deployment); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name != "token-minter" {
+			continue
+		}
+		args := strings.Join(container.Args, " ")
+		for _, arg := range []string{"--service-account-namespace=guest-namespace", "--service-account-name=" + guestControllerServiceAccount} {
+			if !strings.Contains(args, arg) {
+				t.Errorf("argument %s not found in %s", arg, args)
+			}
+		}
+		return
+	}
+	t.Errorf("token-minter container not found")
+}
+
+func TestWithHypershiftDeploymentHookScheduling(t *testing.T) {
+	const namespace = "clusters-test"
+	data, err := assets.ReadFile("controller.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                  string
+		annotations           map[string]interface{}
+		tolerations           []interface{}
+		expectedPriorityClass string
+		expectedTolerations   int
+		expectedRequests      map[string]corev1.ResourceList
+		expectError           bool
+	}{
+		{
+			name:                  "defaults",
+			expectedPriorityClass: "hypershift-control-plane",
+			expectedTolerations:   2,
+			expectedRequests: map[string]corev1.ResourceList{
+				"csi-driver": {
+					corev1.ResourceCPU:    resource.MustParse("10m"),
+					corev1.ResourceMemory: resource.MustParse("50Mi"),
+				},
+				"token-minter": {
+					corev1.ResourceCPU:    resource.MustParse("10m"),
+					corev1.ResourceMemory: resource.MustParse("10Mi"),
+				},
+			},
+		},
+		{
+			name: "overrides",
+			annotations: map[string]interface{}{
+				"hypershift.openshift.io/control-plane-priority-class":                                         "custom-priority",
+				"resource-request-override.hypershift.openshift.io/aws-ebs-csi-driver-controller.csi-driver":   "cpu=100m,memory=200Mi",
+				"resource-request-override.hypershift.openshift.io/aws-ebs-csi-driver-controller.token-minter": "memory=20Mi",
+				"resource-request-override.hypershift.openshift.io/other-deployment.csi-driver":                "cpu=1",
+			},
+			tolerations: []interface{}{
+				map[string]interface{}{"key": "custom-taint", "operator": "Exists", "effect": "NoSchedule"},
+			},
+			expectedPriorityClass: "custom-priority",
+			expectedTolerations:   3,
+			expectedRequests: map[string]corev1.ResourceList{
+				"csi-driver": {
+					corev1.ResourceCPU:    resource.MustParse("100m"),
+					corev1.ResourceMemory: resource.MustParse("200Mi"),
+				},
+				"token-minter": {
+					corev1.ResourceCPU:    resource.MustParse("10m"),
+					corev1.ResourceMemory: resource.MustParse("20Mi"),
+				},
+			},
+		},
+		{
+			name: "invalid override",
+			annotations: map[string]interface{}{
+				"resource-request-override.hypershift.openshift.io/aws-ebs-csi-driver-controller.csi-driver": "cpu",
+			},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hcp := hostedControlPlane(namespace, map[string]interface{}{})
+			if test.tolerations != nil {
+				hcp.Object["spec"] = map[string]interface{}{"tolerations": test.tolerations}
+			}
+			if test.annotations != nil {
+				unstructured.SetNestedField(hcp.Object, test.annotations, "metadata", "annotations")
+			}
+			deployment := resourceread.ReadDeploymentV1OrDie(data)
+			err := withHypershiftDeploymentHook(true, "hypershift-image", namespace, defaultNamespace, newHostedControlPlaneLister(t, hcp))(nil, deployment)
+			if err != nil {
+				if !test.expectError {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if test.expectError {
+				t.Fatalf("expected error, got none")
+			}
+
+			podSpec := deployment.Spec.Template.Spec
+			if podSpec.PriorityClassName != test.expectedPriorityClass {
+				t.Errorf("expected priority class %q, got %q", test.expectedPriorityClass, podSpec.PriorityClassName)
+			}
+			if len(podSpec.Tolerations) != test.expectedTolerations {
+				t.Errorf("expected %d tolerations, got %+v", test.expectedTolerations, podSpec.Tolerations)
+			}
+			for _, container := range podSpec.Containers {
+				expected, ok := test.expectedRequests[container.Name]
+				if !ok {
+					continue
+				}
+				if !equality.Semantic.DeepEqual(expected, container.Resources.Requests) {
+					t.Errorf("container %s: expected requests %v, got %v", container.Name, expected, container.Resources.Requests)
+				}
+			}
+		})
+	}
+}
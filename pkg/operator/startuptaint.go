@@ -0,0 +1,262 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/csi/csidrivernodeservicecontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// startupTaintAnnotation on the ClusterCSIDriver enables the removal of the startupTaintKey
+	// taint by the node plugin, once it's registered on the node. "true" or "false", defaults to "false".
+	startupTaintAnnotation = "ebs.csi.openshift.io/startup-taint"
+	// startupTaintKey is the taint that keeps pods off nodes until the node plugin is ready.
+	// It must be added to new nodes, e.g. by the MachineSet, the driver only removes it.
+	startupTaintKey = "ebs.csi.aws.com/agent-not-ready"
+
+	startupTaintConditionType = "AWSEBSStartupTaintDegraded"
+
+	// startupTaintTimeout is how long a node may keep the taint before it's reported as stuck.
+	startupTaintTimeout = 10 * time.Minute
+	// maxReportedStuckNodes limits the number of node names in the condition message.
+	maxReportedStuckNodes = 10
+)
+
+// isStartupTaintEnabled parses the startupTaintAnnotation of the ClusterCSIDriver.
+// The removal is disabled when the annotation can't be parsed.
+func isStartupTaintEnabled(ccd *opv1.ClusterCSIDriver) (bool, error) {
+	value, ok := ccd.Annotations[startupTaintAnnotation]
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse the %s annotation: %w", startupTaintAnnotation, err)
+	}
+	return enabled, nil
+}
+
+// startupTaintConditionalFuncs returns the functions that decide if the RBAC of the startup taint
+// removal should be created or deleted. When the ClusterCSIDriver can't be read, nothing is changed.
+func startupTaintConditionalFuncs(ccdLister oplisterv1.ClusterCSIDriverLister) (shouldCreate, shouldDelete func() bool) {
+	isEnabled := func() (enabled bool, ok bool) {
+		ccd, err := ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+		if err != nil {
+			return false, false
+		}
+		enabled, _ = isStartupTaintEnabled(ccd)
+		return enabled, true
+	}
+	shouldCreate = func() bool {
+		enabled, ok := isEnabled()
+		return ok && enabled
+	}
+	shouldDelete = func() bool {
+		enabled, ok := isEnabled()
+		return ok && !enabled
+	}
+	return shouldCreate, shouldDelete
+}
+
+// withStartupTaint lets the node plugin remove the startup taint from its node. The driver removes
+// the taint only when CSI_NODE_NAME is set. The DaemonSet must tolerate the taint to run on the node.
+// An invalid annotation disables the removal, it's reported by the startupTaintController.
+func withStartupTaint(ccdLister oplisterv1.ClusterCSIDriverLister) csidrivernodeservicecontroller.DaemonSetHookFunc {
+	return func(_ *opv1.OperatorSpec, daemonSet *appsv1.DaemonSet) error {
+		ccd, err := ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+		if err != nil {
+			return err
+		}
+		enabled, err := isStartupTaintEnabled(ccd)
+		if err != nil {
+			klog.Warningf("Startup taint removal is disabled: %v", err)
+			return nil
+		}
+		if !enabled {
+			return nil
+		}
+
+		podSpec := &daemonSet.Spec.Template.Spec
+		if !toleratesStartupTaint(podSpec.Tolerations) {
+			podSpec.Tolerations = append(podSpec.Tolerations, corev1.Toleration{
+				Key:      startupTaintKey,
+				Operator: corev1.TolerationOpExists,
+			})
+		}
+		for i := range podSpec.Containers {
+			container := &podSpec.Containers[i]
+			if container.Name != "csi-driver" {
+				continue
+			}
+			for _, env := range container.Env {
+				if env.Name == "CSI_NODE_NAME" {
+					return nil
+				}
+			}
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name: "CSI_NODE_NAME",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+				},
+			})
+			return nil
+		}
+		return fmt.Errorf("could not enable the startup taint removal because the csi-driver container is missing from the DaemonSet %s", daemonSet.Name)
+	}
+}
+
+func toleratesStartupTaint(tolerations []corev1.Toleration) bool {
+	taint := &corev1.Taint{Key: startupTaintKey, Effect: corev1.TaintEffectNoExecute}
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// startupTaintController reports nodes that keep the startup taint longer than startupTaintTimeout
+// in the AWSEBSStartupTaintDegraded condition. The condition is True only when the removal is enabled
+// and nodes are stuck, or the annotation is invalid; while the removal is disabled, tainted nodes are
+// only listed in the message.
+type startupTaintController struct {
+	operatorClient v1helpers.OperatorClient
+	ccdLister      oplisterv1.ClusterCSIDriverLister
+	nodeLister     corev1listers.NodeLister
+	// lastMessage is the message of the last event, to emit events only when the stuck nodes change.
+	lastMessage string
+	now         func() time.Time
+}
+
+func newStartupTaintController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	nodeLister corev1listers.NodeLister,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &startupTaintController{
+		operatorClient: operatorClient,
+		ccdLister:      ccdLister,
+		nodeLister:     nodeLister,
+		now:            time.Now,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		// Nodes become stuck without any informer event.
+		time.Minute,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *startupTaintController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	ccd, err := c.ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return err
+	}
+	enabled, annotationErr := isStartupTaintEnabled(ccd)
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	stuckNodes := getStuckNodes(nodes, c.now())
+
+	condition := opv1.OperatorCondition{
+		Type:   startupTaintConditionType,
+		Status: opv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	switch {
+	case annotationErr != nil:
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "InvalidAnnotation"
+		condition.Message = fmt.Sprintf("Startup taint removal is disabled: %v", annotationErr)
+	case len(stuckNodes) == 0 && enabled:
+		condition.Message = "Startup taint removal is enabled"
+	case len(stuckNodes) == 0:
+		condition.Message = "Startup taint removal is disabled"
+	case enabled:
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "NodesStuck"
+		condition.Message = fmt.Sprintf("The node plugin did not remove the %s taint within %s from %s",
+			startupTaintKey, startupTaintTimeout, formatNodeNames(stuckNodes))
+	default:
+		// The taint may be meant for something else than the driver, it's not an error of the operator.
+		condition.Reason = "StartupTaintDisabled"
+		condition.Message = fmt.Sprintf("Startup taint removal is disabled, the %s annotation of the ClusterCSIDriver is not \"true\". Nodes with the %s taint: %s",
+			startupTaintAnnotation, startupTaintKey, formatNodeNames(stuckNodes))
+	}
+
+	if condition.Status == opv1.ConditionTrue && condition.Message != c.lastMessage {
+		syncCtx.Recorder().Warning(condition.Reason, condition.Message)
+	}
+	c.lastMessage = ""
+	if condition.Status == opv1.ConditionTrue {
+		c.lastMessage = condition.Message
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// getStuckNodes returns the sorted names of the nodes that have the startup taint for longer than startupTaintTimeout.
+func getStuckNodes(nodes []*corev1.Node, now time.Time) []string {
+	var stuckNodes []string
+	for _, node := range nodes {
+		for _, taint := range node.Spec.Taints {
+			if taint.Key != startupTaintKey {
+				continue
+			}
+			// Only NoExecute taints added by the API server have TimeAdded.
+			added := node.CreationTimestamp.Time
+			if taint.TimeAdded != nil {
+				added = taint.TimeAdded.Time
+			}
+			if now.Sub(added) > startupTaintTimeout {
+				klog.V(4).Infof("Node %s has the %s taint since %s", node.Name, startupTaintKey, added)
+				stuckNodes = append(stuckNodes, node.Name)
+			}
+			break
+		}
+	}
+	sort.Strings(stuckNodes)
+	return stuckNodes
+}
+
+func formatNodeNames(names []string) string {
+	if len(names) <= maxReportedStuckNodes {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxReportedStuckNodes], ", "), len(names)-maxReportedStuckNodes)
+}
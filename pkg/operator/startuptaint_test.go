@@ -0,0 +1,206 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWithStartupTaint(t *testing.T) {
+	newDaemonSet := func(tolerations ...corev1.Toleration) *appsv1.DaemonSet {
+		return &appsv1.DaemonSet{
+			Spec: appsv1.DaemonSetSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Tolerations: tolerations,
+						Containers:  []corev1.Container{{Name: "csi-driver"}, {Name: "csi-liveness-probe"}},
+					},
+				},
+			},
+		}
+	}
+	groupToleration := corev1.Toleration{Key: "example.com/storage", Operator: corev1.TolerationOpExists}
+	startupToleration := corev1.Toleration{Key: startupTaintKey, Operator: corev1.TolerationOpExists}
+
+	tests := []struct {
+		name                string
+		annotations         map[string]string
+		inDaemonSet         *appsv1.DaemonSet
+		expectedTolerations []corev1.Toleration
+		expectedNodeNameEnv bool
+		expectError         bool
+	}{
+		{
+			name:                "disabled by default",
+			inDaemonSet:         newDaemonSet(groupToleration),
+			expectedTolerations: []corev1.Toleration{groupToleration},
+		},
+		{
+			name:                "enabled",
+			annotations:         map[string]string{startupTaintAnnotation: "true"},
+			inDaemonSet:         newDaemonSet(groupToleration),
+			expectedTolerations: []corev1.Toleration{groupToleration, startupToleration},
+			expectedNodeNameEnv: true,
+		},
+		{
+			name:                "enabled with all taints tolerated",
+			annotations:         map[string]string{startupTaintAnnotation: "true"},
+			inDaemonSet:         newDaemonSet(corev1.Toleration{Operator: corev1.TolerationOpExists}),
+			expectedTolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			expectedNodeNameEnv: true,
+		},
+		{
+			name:                "invalid annotation",
+			annotations:         map[string]string{startupTaintAnnotation: "yes please"},
+			inDaemonSet:         newDaemonSet(groupToleration),
+			expectedTolerations: []corev1.Toleration{groupToleration},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ccdLister := &fakeCCDLister{&opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+			}}
+			daemonSet := test.inDaemonSet.DeepCopy()
+			err := withStartupTaint(ccdLister)(nil, daemonSet)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			podSpec := daemonSet.Spec.Template.Spec
+			if len(podSpec.Tolerations) != len(test.expectedTolerations) {
+				t.Errorf("unexpected tolerations: %+v", podSpec.Tolerations)
+			}
+			hasNodeNameEnv := len(podSpec.Containers[0].Env) == 1 &&
+				podSpec.Containers[0].Env[0].Name == "CSI_NODE_NAME" &&
+				podSpec.Containers[0].Env[0].ValueFrom.FieldRef.FieldPath == "spec.nodeName"
+			if hasNodeNameEnv != test.expectedNodeNameEnv {
+				t.Errorf("unexpected csi-driver env: %+v", podSpec.Containers[0].Env)
+			}
+			if len(podSpec.Containers[1].Env) != 0 {
+				t.Errorf("unexpected csi-liveness-probe env: %+v", podSpec.Containers[1].Env)
+			}
+		})
+	}
+}
+
+func TestStartupTaintControllerSync(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	newNode := func(name string, created time.Time, taints ...corev1.Taint) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(created)},
+			Spec:       corev1.NodeSpec{Taints: taints},
+		}
+	}
+	startupTaint := corev1.Taint{Key: startupTaintKey, Effect: corev1.TaintEffectNoSchedule}
+	recentlyAdded := metav1.NewTime(now.Add(-time.Minute))
+	recentNoExecuteTaint := corev1.Taint{Key: startupTaintKey, Effect: corev1.TaintEffectNoExecute, TimeAdded: &recentlyAdded}
+
+	tests := []struct {
+		name           string
+		annotations    map[string]string
+		nodes          []*corev1.Node
+		expectedStatus opv1.ConditionStatus
+		expectedReason string
+		expectedEvents int
+	}{
+		{
+			name:           "no tainted nodes",
+			annotations:    map[string]string{startupTaintAnnotation: "true"},
+			nodes:          []*corev1.Node{newNode("ready", now.Add(-time.Hour))},
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		},
+		{
+			name:        "recently tainted nodes",
+			annotations: map[string]string{startupTaintAnnotation: "true"},
+			nodes: []*corev1.Node{
+				newNode("new", now.Add(-time.Minute), startupTaint),
+				newNode("re-tainted", now.Add(-time.Hour), recentNoExecuteTaint),
+			},
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		},
+		{
+			name:        "stuck node",
+			annotations: map[string]string{startupTaintAnnotation: "true"},
+			nodes: []*corev1.Node{
+				newNode("stuck", now.Add(-time.Hour), startupTaint),
+				newNode("ready", now.Add(-time.Hour)),
+			},
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "NodesStuck",
+			expectedEvents: 1,
+		},
+		{
+			name:           "tainted node with disabled removal",
+			nodes:          []*corev1.Node{newNode("stuck", now.Add(-time.Hour), startupTaint)},
+			expectedStatus: opv1.ConditionFalse,
+			expectedReason: "StartupTaintDisabled",
+		},
+		{
+			name:           "invalid annotation",
+			annotations:    map[string]string{startupTaintAnnotation: "yes please"},
+			nodes:          []*corev1.Node{newNode("stuck", now.Add(-time.Hour), startupTaint)},
+			expectedStatus: opv1.ConditionTrue,
+			expectedReason: "InvalidAnnotation",
+			expectedEvents: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodeInformer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Core().V1().Nodes()
+			for _, node := range test.nodes {
+				nodeInformer.Informer().GetIndexer().Add(node)
+			}
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			c := &startupTaintController{
+				operatorClient: operatorClient,
+				ccdLister: &fakeCCDLister{&opv1.ClusterCSIDriver{
+					ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+				}},
+				nodeLister: nodeInformer.Lister(),
+				now:        func() time.Time { return now },
+			}
+			recorder := events.NewInMemoryRecorder("test")
+			syncCtx := factory.NewSyncContext("test", recorder)
+			// The second sync must not repeat the event.
+			for i := 0; i < 2; i++ {
+				if err := c.sync(context.TODO(), syncCtx); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, startupTaintConditionType)
+			if condition == nil {
+				t.Fatalf("condition %s not found", startupTaintConditionType)
+			}
+			if condition.Status != test.expectedStatus || condition.Reason != test.expectedReason {
+				t.Errorf("expected %s/%s, got %s/%s: %s", test.expectedStatus, test.expectedReason, condition.Status, condition.Reason, condition.Message)
+			}
+			if len(recorder.Events()) != test.expectedEvents {
+				t.Errorf("expected %d events, got %v", test.expectedEvents, recorder.Events())
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	storageClassDriftConditionType = "AWSEBSStorageClassesDrifted"
+
+	// maxReportedDriftedStorageClasses limits the number of StorageClasses in the condition message.
+	maxReportedDriftedStorageClasses = 10
+)
+
+// storageClassFieldDiff is a field of a StorageClass that differs from the rendered one.
+// Desired and Live are nil when the field is not set.
+type storageClassFieldDiff struct {
+	Field   string
+	Desired *string
+	Live    *string
+}
+
+func (d storageClassFieldDiff) String() string {
+	format := func(value *string) string {
+		if value == nil {
+			return "unset"
+		}
+		return fmt.Sprintf("%q", *value)
+	}
+	return fmt.Sprintf("%s (live %s, desired %s)", d.Field, format(d.Live), format(d.Desired))
+}
+
+// storageClassDrift is how a live StorageClass differs from the one the operator would apply
+// with StorageClassState Managed.
+type storageClassDrift struct {
+	Name string
+	// Missing is set when the StorageClass does not exist.
+	Missing bool
+	// Removed is set when the operator would delete the StorageClass.
+	Removed bool
+	Diffs   []storageClassFieldDiff
+}
+
+func (d storageClassDrift) String() string {
+	return d.Name + ": " + d.details()
+}
+
+func (d storageClassDrift) details() string {
+	switch {
+	case d.Missing:
+		return "missing"
+	case d.Removed:
+		return "would be deleted"
+	}
+	diffs := make([]string, 0, len(d.Diffs))
+	for _, diff := range d.Diffs {
+		diffs = append(diffs, diff.String())
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// diffStorageClass returns the fields of the live StorageClass that ApplyStorageClass would change to
+// the desired ones. Like ApplyStorageClass, it ignores labels and annotations that are not desired.
+// Fields the API server defaults are compared only when they are desired.
+func diffStorageClass(desired, live *storagev1.StorageClass) []storageClassFieldDiff {
+	var diffs []storageClassFieldDiff
+	add := func(field string, desiredValue, liveValue *string) {
+		if desiredValue == nil && liveValue == nil {
+			return
+		}
+		if desiredValue != nil && liveValue != nil && *desiredValue == *liveValue {
+			return
+		}
+		diffs = append(diffs, storageClassFieldDiff{Field: field, Desired: desiredValue, Live: liveValue})
+	}
+	lookup := func(m map[string]string, key string) *string {
+		if value, ok := m[key]; ok {
+			return &value
+		}
+		return nil
+	}
+	toString := func(value interface{}) *string {
+		s := fmt.Sprint(value)
+		return &s
+	}
+	toJSON := func(value interface{}) *string {
+		data, _ := json.Marshal(value)
+		s := string(data)
+		return &s
+	}
+
+	for _, key := range sets.List(sets.KeySet(desired.Labels)) {
+		add("metadata.labels."+key, lookup(desired.Labels, key), lookup(live.Labels, key))
+	}
+	for _, key := range sets.List(sets.KeySet(desired.Annotations)) {
+		add("metadata.annotations."+key, lookup(desired.Annotations, key), lookup(live.Annotations, key))
+	}
+	add("provisioner", &desired.Provisioner, &live.Provisioner)
+	for _, key := range sets.List(sets.KeySet(desired.Parameters).Union(sets.KeySet(live.Parameters))) {
+		add("parameters."+key, lookup(desired.Parameters, key), lookup(live.Parameters, key))
+	}
+	if desired.ReclaimPolicy != nil {
+		var liveValue *string
+		if live.ReclaimPolicy != nil {
+			liveValue = toString(*live.ReclaimPolicy)
+		}
+		add("reclaimPolicy", toString(*desired.ReclaimPolicy), liveValue)
+	}
+	if desired.VolumeBindingMode != nil {
+		var liveValue *string
+		if live.VolumeBindingMode != nil {
+			liveValue = toString(*live.VolumeBindingMode)
+		}
+		add("volumeBindingMode", toString(*desired.VolumeBindingMode), liveValue)
+	}
+	if desired.AllowVolumeExpansion != nil {
+		var liveValue *string
+		if live.AllowVolumeExpansion != nil {
+			liveValue = toString(*live.AllowVolumeExpansion)
+		}
+		add("allowVolumeExpansion", toString(*desired.AllowVolumeExpansion), liveValue)
+	}
+	if len(desired.MountOptions) > 0 || len(live.MountOptions) > 0 {
+		add("mountOptions", toJSON(desired.MountOptions), toJSON(live.MountOptions))
+	}
+	if len(desired.AllowedTopologies) > 0 || len(live.AllowedTopologies) > 0 {
+		add("allowedTopologies", toJSON(desired.AllowedTopologies), toJSON(live.AllowedTopologies))
+	}
+	return diffs
+}
+
+// getStorageClassDrifts compares the desired StorageClasses and the ones the operator would delete
+// with the live StorageClasses.
+func (c *storageClassController) getStorageClassDrifts(desiredSCs, removedSCs []*storagev1.StorageClass) ([]storageClassDrift, error) {
+	var drifts []storageClassDrift
+	for _, desired := range desiredSCs {
+		live, err := c.storageClassLister.Get(desired.Name)
+		switch {
+		case apierrors.IsNotFound(err):
+			drifts = append(drifts, storageClassDrift{Name: desired.Name, Missing: true})
+		case err != nil:
+			return nil, err
+		default:
+			if diffs := diffStorageClass(desired, live); len(diffs) > 0 {
+				drifts = append(drifts, storageClassDrift{Name: desired.Name, Diffs: diffs})
+			}
+		}
+	}
+	for _, sc := range removedSCs {
+		_, err := c.storageClassLister.Get(sc.Name)
+		switch {
+		case apierrors.IsNotFound(err):
+		case err != nil:
+			return nil, err
+		default:
+			drifts = append(drifts, storageClassDrift{Name: sc.Name, Removed: true})
+		}
+	}
+	return drifts, nil
+}
+
+// syncStorageClassDrift reports the drift of the StorageClasses in the AWSEBSStorageClassesDrifted condition
+// and emits an event when the drift of a StorageClass changes. Drift is reported only with StorageClassState
+// Unmanaged, with the other states the operator reconciles the StorageClasses.
+func (c *storageClassController) syncStorageClassDrift(ctx context.Context, scState opv1.StorageClassStateName, desiredSCs, removedSCs []*storagev1.StorageClass, recorder events.Recorder) error {
+	condition := opv1.OperatorCondition{
+		Type:    storageClassDriftConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "NotApplicable",
+		Message: "Drift is reported only when StorageClassState is Unmanaged",
+	}
+	if scState != opv1.UnmanagedStorageClass {
+		c.drifts = nil
+		_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+		return err
+	}
+
+	drifts, err := c.getStorageClassDrifts(desiredSCs, removedSCs)
+	if err != nil {
+		return err
+	}
+	current := map[string]string{}
+	var messages []string
+	for _, drift := range drifts {
+		current[drift.Name] = drift.String()
+		if c.drifts[drift.Name] != current[drift.Name] {
+			recorder.Warningf("StorageClassDrifted", "StorageClass %s differs from the one the operator renders: %s", drift.Name, drift.details())
+		}
+		if len(messages) < maxReportedDriftedStorageClasses {
+			messages = append(messages, drift.String())
+		}
+	}
+	for _, name := range sets.List(sets.KeySet(c.drifts)) {
+		if _, ok := current[name]; !ok {
+			recorder.Eventf("StorageClassDriftResolved", "StorageClass %s matches the one the operator renders", name)
+		}
+	}
+	c.drifts = current
+
+	condition.Reason = "AsExpected"
+	condition.Message = "The StorageClasses match the ones the operator renders"
+	if len(drifts) > 0 {
+		if len(drifts) > maxReportedDriftedStorageClasses {
+			messages = append(messages, fmt.Sprintf("and %d more", len(drifts)-maxReportedDriftedStorageClasses))
+		}
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "StorageClassesDrifted"
+		condition.Message = fmt.Sprintf("%d StorageClasses differ from the ones the operator renders: %s", len(drifts), strings.Join(messages, "; "))
+	}
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
@@ -0,0 +1,186 @@
+package operator
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/csi/csistorageclasscontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/openshift/aws-ebs-csi-driver-operator/assets"
+)
+
+func TestDiffStorageClass(t *testing.T) {
+	desired := func() *storagev1.StorageClass {
+		sc := resourceread.ReadStorageClassV1OrDie(mustReadAsset(t, "storageclass_gp3.yaml"))
+		sc.Parameters[kmsKeyID] = validARNString
+		return sc
+	}
+
+	tests := []struct {
+		name           string
+		live           func(sc *storagev1.StorageClass)
+		expectedFields []string
+	}{
+		{
+			name: "same",
+			live: func(sc *storagev1.StorageClass) {
+				sc.Annotations["other"] = "value"
+				sc.ResourceVersion = "1"
+			},
+		},
+		{
+			name: "parameters",
+			live: func(sc *storagev1.StorageClass) {
+				delete(sc.Parameters, kmsKeyID)
+				sc.Parameters["type"] = "gp2"
+				sc.Parameters["iops"] = "3000"
+			},
+			expectedFields: []string{"parameters.iops", "parameters.kmsKeyId", "parameters.type"},
+		},
+		{
+			name: "metadata and fields",
+			live: func(sc *storagev1.StorageClass) {
+				sc.Annotations[defaultStorageClassKey] = "false"
+				mode := storagev1.VolumeBindingImmediate
+				sc.VolumeBindingMode = &mode
+				sc.AllowVolumeExpansion = nil
+				sc.MountOptions = []string{"debug"}
+			},
+			expectedFields: []string{"metadata.annotations." + defaultStorageClassKey, "volumeBindingMode", "allowVolumeExpansion", "mountOptions"},
+		},
+		{
+			name: "allowed topologies",
+			live: func(sc *storagev1.StorageClass) {
+				sc.AllowedTopologies = []corev1.TopologySelectorTerm{{}}
+			},
+			expectedFields: []string{"allowedTopologies"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			live := desired()
+			test.live(live)
+			var fields []string
+			for _, diff := range diffStorageClass(desired(), live) {
+				fields = append(fields, diff.Field)
+			}
+			if !reflect.DeepEqual(fields, test.expectedFields) {
+				t.Errorf("expected diffs of %v, got %v", test.expectedFields, fields)
+			}
+		})
+	}
+}
+
+func TestStorageClassDrift(t *testing.T) {
+	gp3 := resourceread.ReadStorageClassV1OrDie(mustReadAsset(t, "storageclass_gp3.yaml"))
+	st1 := resourceread.ReadStorageClassV1OrDie(mustReadAsset(t, "storageclass_st1.yaml"))
+
+	kubeClient := fake.NewSimpleClientset(gp3, st1)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	scInformer := informerFactory.Storage().V1().StorageClasses()
+	scInformer.Informer().GetIndexer().Add(gp3)
+	scInformer.Informer().GetIndexer().Add(st1)
+	ccd := &opv1.ClusterCSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: provisionerName},
+		Spec: opv1.ClusterCSIDriverSpec{
+			StorageClassState: opv1.UnmanagedStorageClass,
+			DriverConfig: opv1.CSIDriverConfigSpec{
+				DriverType: opv1.AWSDriverType,
+				AWS:        &opv1.AWSCSIDriverConfigSpec{KMSKeyARN: validARNString},
+			},
+		},
+	}
+	ccdLister := &fakeCCDLister{ccd}
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&opv1.OperatorSpec{ManagementState: opv1.Managed},
+		&opv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+	c := &storageClassController{
+		operatorClient:     operatorClient,
+		kubeClient:         kubeClient,
+		ccdLister:          ccdLister,
+		storageClassLister: scInformer.Lister(),
+		nodeLister:         informerFactory.Core().V1().Nodes().Lister(),
+		assetFunc:          assets.ReadFile,
+		scStateEvaluator:   csistorageclasscontroller.NewStorageClassStateEvaluator(kubeClient, ccdLister, recorder),
+		hooks:              []csistorageclasscontroller.StorageClassHookFunc{getKMSKeyHook(ccdLister, newInfraLister("us-east-2"))},
+	}
+	sync := func() *opv1.OperatorCondition {
+		if err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, status, _, _ := operatorClient.GetOperatorState()
+		condition := v1helpers.FindOperatorCondition(status.Conditions, storageClassDriftConditionType)
+		if condition == nil {
+			t.Fatalf("condition %s not found", storageClassDriftConditionType)
+		}
+		return condition
+	}
+	driftEvents := func() int {
+		count := 0
+		for _, event := range recorder.Events() {
+			if event.Reason == "StorageClassDrifted" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// The drift of the KMS key is reported, but the StorageClasses are not changed.
+	condition := sync()
+	if condition.Status != opv1.ConditionTrue {
+		t.Errorf("expected drift, got %+v", condition)
+	}
+	for _, expected := range []string{
+		`gp3-csi: parameters.kmsKeyId (live unset, desired "` + validARNString + `")`,
+		"gp2-csi: missing",
+		"st1-csi: would be deleted",
+	} {
+		if !strings.Contains(condition.Message, expected) {
+			t.Errorf("expected %q in condition message %q", expected, condition.Message)
+		}
+	}
+	if count := driftEvents(); count != 3 {
+		t.Errorf("expected 3 StorageClassDrifted events, got %d", count)
+	}
+	live, err := kubeClient.StorageV1().StorageClasses().Get(context.TODO(), "gp3-csi", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := live.Parameters[kmsKeyID]; ok {
+		t.Errorf("unmanaged StorageClass gp3-csi was updated: %v", live.Parameters)
+	}
+
+	// Events are emitted only when the drift changes.
+	sync()
+	if count := driftEvents(); count != 3 {
+		t.Errorf("expected no new StorageClassDrifted events, got %d", count-3)
+	}
+
+	ccd.Spec.StorageClassState = opv1.ManagedStorageClass
+	if condition := sync(); condition.Status != opv1.ConditionFalse || condition.Reason != "NotApplicable" {
+		t.Errorf("expected no drift with StorageClassState Managed, got %+v", condition)
+	}
+}
+
+func mustReadAsset(t *testing.T, name string) []byte {
+	data, err := assets.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
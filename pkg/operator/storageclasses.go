@@ -0,0 +1,439 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/aws-ebs-csi-driver-operator/assets"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/csi/csistorageclasscontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// optionalStorageClassesAnnotation on the ClusterCSIDriver is a JSON list of the volume types
+	// of the optional StorageClasses the operator should create, e.g. ["io2", "st1"].
+	optionalStorageClassesAnnotation = "ebs.csi.openshift.io/optional-storage-classes"
+	// defaultStorageClassAnnotation on the ClusterCSIDriver is the name of the managed StorageClass
+	// that should be the default one, e.g. "gp2-csi". By default, gp3-csi is the default StorageClass.
+	defaultStorageClassAnnotation = "ebs.csi.openshift.io/default-storage-class"
+
+	defaultStorageClassKey = "storageclass.kubernetes.io/is-default-class"
+	// demotedDefaultStorageClassKey is set on the StorageClasses of the operator that are not the default only
+	// because the admin made another StorageClass the default. The operator restores their default annotation
+	// when no StorageClass of the admin is the default anymore.
+	demotedDefaultStorageClassKey = "ebs.csi.openshift.io/demoted-default-storage-class"
+
+	// storageClassConfigConditionType reports invalid StorageClass configuration in the ClusterCSIDriver
+	// annotations. The StorageClasses are still synced, the invalid values are ignored.
+	storageClassConfigConditionType = "AWSEBSStorageClassConfigDegraded"
+)
+
+// storageClassFiles are the assets of the StorageClasses that are always created.
+var storageClassFiles = []string{
+	"storageclass_gp3.yaml",
+	"storageclass_gp2.yaml",
+}
+
+// optionalStorageClassFiles are the assets of the optional StorageClasses, by volume type.
+var optionalStorageClassFiles = map[string]string{
+	"io2": "storageclass_io2.yaml",
+	"st1": "storageclass_st1.yaml",
+	"sc1": "storageclass_sc1.yaml",
+}
+
+// getStorageClassNames returns the names of the StorageClasses of storageClassFiles and optionalStorageClassFiles.
+func getStorageClassNames() (sets.Set[string], error) {
+	files := append([]string{}, storageClassFiles...)
+	for _, file := range optionalStorageClassFiles {
+		files = append(files, file)
+	}
+	names := sets.New[string]()
+	for _, file := range files {
+		scBytes, err := assets.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		names.Insert(resourceread.ReadStorageClassV1OrDie(scBytes).Name)
+	}
+	return names, nil
+}
+
+// getOptionalStorageClasses parses the optionalStorageClassesAnnotation of the ClusterCSIDriver.
+// Unsupported volume types are skipped and returned in the error together with the supported ones.
+// It returns a nil set when the annotation cannot be parsed.
+func getOptionalStorageClasses(ccd *opv1.ClusterCSIDriver) (sets.Set[string], error) {
+	value, ok := ccd.Annotations[optionalStorageClassesAnnotation]
+	if !ok {
+		return sets.New[string](), nil
+	}
+	var volumeTypes []string
+	if err := json.Unmarshal([]byte(value), &volumeTypes); err != nil {
+		return nil, fmt.Errorf("failed to parse the %s annotation: %w", optionalStorageClassesAnnotation, err)
+	}
+	enabled := sets.New[string]()
+	var errs []error
+	for _, volumeType := range volumeTypes {
+		if _, ok := optionalStorageClassFiles[volumeType]; !ok {
+			errs = append(errs, fmt.Errorf("invalid %s annotation: unsupported volume type %q, supported are %v",
+				optionalStorageClassesAnnotation, volumeType, sets.List(sets.KeySet(optionalStorageClassFiles))))
+			continue
+		}
+		enabled.Insert(volumeType)
+	}
+	return enabled, utilerrors.NewAggregate(errs)
+}
+
+// storageClassController creates the StorageClasses of the driver, including the optional ones
+// enabled in the ClusterCSIDriver and the zone-pinned ones, and deletes the disabled optional ones
+// and the zone-pinned ones of zones without nodes. The StorageClasses follow
+// the StorageClassState of the ClusterCSIDriver and the hooks are applied to them. Errors, e.g. invalid
+// configuration found by a hook, are reported in the Degraded condition of the controller. With
+// StorageClassState Unmanaged, the StorageClasses are rendered too, but only their drift is reported.
+// It replaces the library-go StorageClass controller, because that one keeps the default
+// StorageClass annotation of existing StorageClasses and so can't move the default to another class.
+type storageClassController struct {
+	operatorClient     v1helpers.OperatorClient
+	kubeClient         kubernetes.Interface
+	ccdLister          oplisterv1.ClusterCSIDriverLister
+	storageClassLister storagev1listers.StorageClassLister
+	nodeLister         corev1listers.NodeLister
+	assetFunc          resourceapply.AssetFunc
+	scStateEvaluator   *csistorageclasscontroller.StorageClassStateEvaluator
+	hooks              []csistorageclasscontroller.StorageClassHookFunc
+	// foreignDefaults are the default StorageClasses not managed by the operator found in the last sync,
+	// to emit events only when they change.
+	foreignDefaults string
+	// drifts are the drifts of the StorageClasses reported in the last sync, by StorageClass name.
+	drifts map[string]string
+}
+
+func newStorageClassController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	storageClassLister storagev1listers.StorageClassLister,
+	nodeLister corev1listers.NodeLister,
+	assetFunc resourceapply.AssetFunc,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+	hooks ...csistorageclasscontroller.StorageClassHookFunc,
+) factory.Controller {
+	c := &storageClassController{
+		operatorClient:     operatorClient,
+		kubeClient:         kubeClient,
+		ccdLister:          ccdLister,
+		storageClassLister: storageClassLister,
+		nodeLister:         nodeLister,
+		assetFunc:          assetFunc,
+		scStateEvaluator:   csistorageclasscontroller.NewStorageClassStateEvaluator(kubeClient, ccdLister, eventRecorder),
+		hooks:              hooks,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		resync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *storageClassController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	ccd, err := c.ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return err
+	}
+	// Invalid configuration is ignored and reported in the storageClassConfigConditionType condition.
+	var configErrs []error
+	enabled, err := getOptionalStorageClasses(ccd)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+	zonalNames, err := getZonalStorageClasses(ccd)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+	gp3Params, err := getGP3Parameters(ccd)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+	zones, err := getZones(c.nodeLister)
+	if err != nil {
+		return err
+	}
+	scState := c.scStateEvaluator.GetStorageClassState(string(opv1.AWSEBSCSIDriver))
+
+	// All StorageClasses the operator may create, to tell them apart from the admin's ones.
+	managedNames := sets.New[string]()
+	var expectedSCs, disabledSCs []*storagev1.StorageClass
+	for _, file := range storageClassFiles {
+		sc, err := c.readStorageClass(file)
+		if err != nil {
+			return err
+		}
+		managedNames.Insert(sc.Name)
+		expectedSCs = append(expectedSCs, sc)
+	}
+	for _, volumeType := range sets.List(sets.KeySet(optionalStorageClassFiles)) {
+		sc, err := c.readStorageClass(optionalStorageClassFiles[volumeType])
+		if err != nil {
+			return err
+		}
+		managedNames.Insert(sc.Name)
+		// While the annotation can't be parsed, the optional StorageClasses are left as they are.
+		if enabled == nil {
+			continue
+		}
+		if enabled.Has(volumeType) {
+			expectedSCs = append(expectedSCs, sc)
+		} else {
+			disabledSCs = append(disabledSCs, sc)
+		}
+	}
+
+	// A StorageClass with a failed hook is not updated, the others still are.
+	var errs []error
+	failedNames := sets.New[string]()
+	for _, sc := range expectedSCs {
+		for i := range c.hooks {
+			if err := c.hooks[i](opSpec, sc); err != nil {
+				errs = append(errs, fmt.Errorf("error running hook function (index=%d) on StorageClass %s: %w", i, sc.Name, err))
+				failedNames.Insert(sc.Name)
+				break
+			}
+		}
+	}
+
+	zonalSCs, err := renderZonalStorageClasses(expectedSCs, zonalNames, zones)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+	for _, sc := range zonalSCs {
+		managedNames.Insert(sc.Name)
+		if failedNames.Has(sc.Labels[zonalStorageClassLabel]) {
+			failedNames.Insert(sc.Name)
+		}
+	}
+	// Zone-pinned StorageClasses of zones without nodes, or of StorageClasses removed from the annotation.
+	existingSCs, err := c.storageClassLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	var staleZonalSCs []*storagev1.StorageClass
+	for _, sc := range existingSCs {
+		base, ok := sc.Labels[zonalStorageClassLabel]
+		if !ok {
+			continue
+		}
+		managedNames.Insert(sc.Name)
+		// While the annotation can't be parsed, the zone-pinned StorageClasses are left as they are.
+		if zonalNames == nil || !managedNames.Has(base) || failedNames.Has(base) || containsStorageClass(zonalSCs, sc.Name) {
+			continue
+		}
+		staleZonalSCs = append(staleZonalSCs, sc)
+	}
+	expectedSCs = append(expectedSCs, zonalSCs...)
+
+	// An unknown default StorageClass, e.g. a typo or a disabled optional class, is ignored.
+	defaultName, configured := ccd.Annotations[defaultStorageClassAnnotation]
+	if configured && !containsStorageClass(expectedSCs, defaultName) {
+		configErrs = append(configErrs, fmt.Errorf("invalid %s annotation: %q is not a StorageClass created by the operator", defaultStorageClassAnnotation, defaultName))
+		defaultName = ""
+	}
+	if err := c.setDefaultStorageClass(defaultName, expectedSCs, managedNames, syncCtx.Recorder()); err != nil {
+		return err
+	}
+
+	// With StorageClassState Unmanaged, the StorageClasses are still rendered to report their drift.
+	var desiredSCs []*storagev1.StorageClass
+	for _, sc := range expectedSCs {
+		if !failedNames.Has(sc.Name) {
+			desiredSCs = append(desiredSCs, sc)
+		}
+	}
+	if err := c.syncStorageClassDrift(ctx, scState, desiredSCs, append(disabledSCs, staleZonalSCs...), syncCtx.Recorder()); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, sc := range desiredSCs {
+		// ApplyStorageClass overwrites the default StorageClass annotation with the one of the existing StorageClass.
+		desired := sc.DeepCopy()
+		if err := c.scStateEvaluator.ApplyStorageClass(ctx, sc, scState); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if c.scStateEvaluator.IsManaged(scState) {
+			if err := c.updateDefaultStorageClassAnnotations(ctx, desired, syncCtx.Recorder()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	// Disabled and stale classes are removed, unless the admin manages the StorageClasses.
+	if scState != opv1.UnmanagedStorageClass {
+		for _, sc := range append(disabledSCs, staleZonalSCs...) {
+			if err := c.scStateEvaluator.ApplyStorageClass(ctx, sc, opv1.RemovedStorageClass); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	condition := opv1.OperatorCondition{
+		Type:    storageClassConfigConditionType,
+		Status:  opv1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: "The StorageClass configuration is valid",
+	}
+	if err := utilerrors.NewAggregate(configErrs); err != nil {
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "InvalidConfiguration"
+		condition.Message = fmt.Sprintf("Invalid values are ignored: %v", err)
+	}
+	// EC2 rejects gp3 volumes with more than webhook.GP3MaxIOPSPerGB IOPS per GiB, so a fixed iops sets a minimum size.
+	if gp3Params != nil && gp3Params.IOPS != nil {
+		condition.Message += fmt.Sprintf(". Volumes of the gp3 StorageClasses have %d IOPS and must have at least %d GiB", *gp3Params.IOPS, gp3MinVolumeSize(*gp3Params.IOPS))
+	}
+	if _, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition)); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func containsStorageClass(scs []*storagev1.StorageClass, name string) bool {
+	for _, sc := range scs {
+		if sc.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *storageClassController) readStorageClass(file string) (*storagev1.StorageClass, error) {
+	scBytes, err := c.assetFunc(file)
+	if err != nil {
+		return nil, err
+	}
+	return resourceread.ReadStorageClassV1OrDie(scBytes), nil
+}
+
+// setDefaultStorageClass sets the default StorageClass annotation of the expected StorageClasses.
+// The StorageClass defaultName from the defaultStorageClassAnnotation is the default. When defaultName
+// is empty, the annotation of existing StorageClasses is kept like in the library-go StorageClass controller.
+// When the admin made a StorageClass not managed by the operator the default, none of the expected
+// StorageClasses is the default; the ones that would be are marked with demotedDefaultStorageClassKey,
+// so that they become the default again once the admin's StorageClass is not the default anymore.
+func (c *storageClassController) setDefaultStorageClass(defaultName string, expectedSCs []*storagev1.StorageClass, managedNames sets.Set[string], recorder events.Recorder) error {
+	configured := defaultName != ""
+	existingSCs, err := c.storageClassLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	foreignDefaults := sets.New[string]()
+	existing := map[string]*storagev1.StorageClass{}
+	for _, sc := range existingSCs {
+		existing[sc.Name] = sc
+		if !managedNames.Has(sc.Name) && sc.Annotations[defaultStorageClassKey] == "true" {
+			foreignDefaults.Insert(sc.Name)
+		}
+	}
+	foreignDefaultNames := strings.Join(sets.List(foreignDefaults), ", ")
+	if foreignDefaultNames != c.foreignDefaults && foreignDefaultNames != "" {
+		recorder.Eventf("DefaultStorageClassNotManaged", "StorageClass %s is the default StorageClass, the operator does not make any of its StorageClasses the default", foreignDefaultNames)
+	}
+	c.foreignDefaults = foreignDefaultNames
+
+	for _, sc := range expectedSCs {
+		live := existing[sc.Name]
+		switch {
+		case configured && sc.Name == defaultName:
+			setDefaultStorageClassAnnotation(sc, "true")
+		case configured:
+			setDefaultStorageClassAnnotation(sc, "false")
+		case live != nil && live.Annotations[demotedDefaultStorageClassKey] == "true":
+			// The annotation of the asset, the StorageClass is "false" only because of the admin's default.
+		case foreignDefaults.Len() > 0:
+			// SetDefaultStorageClass would set "false" because of the admin's default, without marking the StorageClass.
+			if live != nil {
+				if value, ok := live.Annotations[defaultStorageClassKey]; ok {
+					setDefaultStorageClassAnnotation(sc, value)
+				}
+			}
+		default:
+			if err := csistorageclasscontroller.SetDefaultStorageClass(c.storageClassLister, sc); err != nil {
+				return err
+			}
+		}
+		if foreignDefaults.Len() > 0 && sc.Annotations[defaultStorageClassKey] == "true" {
+			klog.V(4).Infof("StorageClass %s is the default, not making StorageClass %s the default", foreignDefaultNames, sc.Name)
+			setDefaultStorageClassAnnotation(sc, "false")
+			sc.Annotations[demotedDefaultStorageClassKey] = "true"
+		}
+	}
+	return nil
+}
+
+// updateDefaultStorageClassAnnotations sets the default StorageClass annotation of an existing StorageClass
+// to the desired one and removes demotedDefaultStorageClassKey when it is not desired.
+func (c *storageClassController) updateDefaultStorageClassAnnotations(ctx context.Context, desired *storagev1.StorageClass, recorder events.Recorder) error {
+	value, hasDefault := desired.Annotations[defaultStorageClassKey]
+	_, demoted := desired.Annotations[demotedDefaultStorageClassKey]
+	sc, err := c.kubeClient.StorageV1().StorageClasses().Get(ctx, desired.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	_, liveDemoted := sc.Annotations[demotedDefaultStorageClassKey]
+	updateDefault := hasDefault && sc.Annotations[defaultStorageClassKey] != value
+	if !updateDefault && (demoted || !liveDemoted) {
+		return nil
+	}
+	sc = sc.DeepCopy()
+	if updateDefault {
+		setDefaultStorageClassAnnotation(sc, value)
+	}
+	if !demoted {
+		delete(sc.Annotations, demotedDefaultStorageClassKey)
+	}
+	if _, err := c.kubeClient.StorageV1().StorageClasses().Update(ctx, sc, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	if updateDefault {
+		recorder.Eventf("DefaultStorageClassAnnotationUpdated", "Set %s=%q in StorageClass %s", defaultStorageClassKey, value, desired.Name)
+	}
+	return nil
+}
+
+func setDefaultStorageClassAnnotation(sc *storagev1.StorageClass, value string) {
+	if sc.Annotations == nil {
+		sc.Annotations = map[string]string{}
+	}
+	sc.Annotations[defaultStorageClassKey] = value
+}
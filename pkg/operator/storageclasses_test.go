@@ -0,0 +1,423 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/csi/csistorageclasscontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/openshift/aws-ebs-csi-driver-operator/assets"
+)
+
+func TestStorageClassControllerSync(t *testing.T) {
+	existingSC := func(name string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: name},
+			Provisioner: provisionerName,
+		}
+	}
+	existingDefaultSC := func(name string) *storagev1.StorageClass {
+		sc := existingSC(name)
+		sc.Annotations = map[string]string{defaultStorageClassKey: "true"}
+		return sc
+	}
+	existingZonalSC := func(name, base string) *storagev1.StorageClass {
+		sc := existingSC(name)
+		sc.Labels = map[string]string{zonalStorageClassLabel: base}
+		return sc
+	}
+	newNode := func(name, zone string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{corev1.LabelTopologyZone: zone},
+		}}
+	}
+	nodes := []*corev1.Node{newNode("a", "us-east-1a"), newNode("b", "us-east-1b"), newNode("c", "us-east-1a")}
+
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		scState         opv1.StorageClassStateName
+		existingClasses []*storagev1.StorageClass
+		expectedClasses []string
+		// expectedDefaults are the default StorageClass annotations of the StorageClasses, when set.
+		expectedDefaults map[string]string
+		expectError      bool
+		// expectConfigError is the expected status of the StorageClass config condition.
+		expectConfigError bool
+		// expectedConfigMessage is a part of the message of the StorageClass config condition.
+		expectedConfigMessage string
+		// expectedGP3Parameters are the performance parameters expected in gp3-csi.
+		expectedGP3Parameters map[string]string
+		// failingHook is the name of a StorageClass whose hooks fail.
+		failingHook string
+	}{
+		{
+			name:            "optional classes disabled by default",
+			expectedClasses: []string{"gp3-csi", "gp2-csi"},
+		},
+		{
+			name:            "enabled classes",
+			annotations:     map[string]string{optionalStorageClassesAnnotation: `["io2", "sc1"]`},
+			expectedClasses: []string{"gp3-csi", "gp2-csi", "io2-csi", "sc1-csi"},
+		},
+		{
+			name:            "disabled class removed",
+			annotations:     map[string]string{optionalStorageClassesAnnotation: `["io2"]`},
+			existingClasses: []*storagev1.StorageClass{existingSC("st1-csi"), existingSC("other")},
+			expectedClasses: []string{"gp3-csi", "gp2-csi", "io2-csi", "other"},
+		},
+		{
+			name:            "unmanaged",
+			annotations:     map[string]string{optionalStorageClassesAnnotation: `["io2"]`},
+			scState:         opv1.UnmanagedStorageClass,
+			existingClasses: []*storagev1.StorageClass{existingSC("st1-csi")},
+			expectedClasses: []string{"st1-csi"},
+		},
+		{
+			name:            "removed",
+			annotations:     map[string]string{optionalStorageClassesAnnotation: `["io2", "st1"]`},
+			scState:         opv1.RemovedStorageClass,
+			existingClasses: []*storagev1.StorageClass{existingSC("gp3-csi"), existingSC("io2-csi")},
+			expectedClasses: nil,
+		},
+		{
+			name:              "unsupported volume type",
+			annotations:       map[string]string{optionalStorageClassesAnnotation: `["gp3", "io2"]`},
+			expectedClasses:   []string{"gp3-csi", "gp2-csi", "io2-csi"},
+			expectConfigError: true,
+		},
+		{
+			name:              "invalid annotation",
+			annotations:       map[string]string{optionalStorageClassesAnnotation: "io2"},
+			existingClasses:   []*storagev1.StorageClass{existingSC("st1-csi")},
+			expectedClasses:   []string{"gp3-csi", "gp2-csi", "st1-csi"},
+			expectConfigError: true,
+		},
+		{
+			name:            "zonal classes",
+			annotations:     map[string]string{zonalStorageClassesAnnotation: `["gp3-csi"]`},
+			expectedClasses: []string{"gp3-csi", "gp2-csi", "gp3-csi-us-east-1a", "gp3-csi-us-east-1b"},
+		},
+		{
+			name:        "zonal classes of zones without nodes removed",
+			annotations: map[string]string{zonalStorageClassesAnnotation: `["gp2-csi"]`},
+			existingClasses: []*storagev1.StorageClass{
+				existingZonalSC("gp2-csi-us-east-1c", "gp2-csi"),
+				existingZonalSC("gp3-csi-us-east-1a", "gp3-csi"),
+				existingZonalSC("custom-us-east-1c", "custom"),
+			},
+			expectedClasses: []string{"gp3-csi", "gp2-csi", "gp2-csi-us-east-1a", "gp2-csi-us-east-1b", "custom-us-east-1c"},
+		},
+		{
+			name:              "zonal classes of disabled optional class",
+			annotations:       map[string]string{zonalStorageClassesAnnotation: `["io2-csi", "gp3-csi"]`},
+			expectedClasses:   []string{"gp3-csi", "gp2-csi", "gp3-csi-us-east-1a", "gp3-csi-us-east-1b"},
+			expectConfigError: true,
+		},
+		{
+			name:              "invalid zonal annotation",
+			annotations:       map[string]string{zonalStorageClassesAnnotation: "gp3-csi"},
+			existingClasses:   []*storagev1.StorageClass{existingZonalSC("gp3-csi-us-east-1c", "gp3-csi")},
+			expectedClasses:   []string{"gp3-csi", "gp2-csi", "gp3-csi-us-east-1c"},
+			expectConfigError: true,
+		},
+		{
+			name:             "default moved",
+			annotations:      map[string]string{defaultStorageClassAnnotation: "gp2-csi"},
+			existingClasses:  []*storagev1.StorageClass{existingDefaultSC("gp3-csi"), existingSC("gp2-csi")},
+			expectedClasses:  []string{"gp3-csi", "gp2-csi"},
+			expectedDefaults: map[string]string{"gp3-csi": "false", "gp2-csi": "true"},
+		},
+		{
+			name:             "default of unmanaged StorageClasses kept",
+			annotations:      map[string]string{defaultStorageClassAnnotation: "gp2-csi"},
+			scState:          opv1.UnmanagedStorageClass,
+			existingClasses:  []*storagev1.StorageClass{existingDefaultSC("gp3-csi"), existingSC("gp2-csi")},
+			expectedClasses:  []string{"gp3-csi", "gp2-csi"},
+			expectedDefaults: map[string]string{"gp3-csi": "true", "gp2-csi": ""},
+		},
+		{
+			name:              "unknown default",
+			annotations:       map[string]string{defaultStorageClassAnnotation: "io2-csi"},
+			existingClasses:   []*storagev1.StorageClass{existingSC("gp3-csi"), existingDefaultSC("gp2-csi")},
+			expectedClasses:   []string{"gp3-csi", "gp2-csi"},
+			expectedDefaults:  map[string]string{"gp3-csi": "false", "gp2-csi": "true"},
+			expectConfigError: true,
+		},
+		{
+			name:                  "invalid gp3 parameters",
+			annotations:           map[string]string{gp3ParametersAnnotation: `{"iops": 100, "throughput": 250}`},
+			expectedClasses:       []string{"gp3-csi", "gp2-csi"},
+			expectedGP3Parameters: map[string]string{"throughput": "250"},
+			expectConfigError:     true,
+		},
+		{
+			name:                  "gp3 iops",
+			annotations:           map[string]string{gp3ParametersAnnotation: `{"iops": 6000}`},
+			expectedClasses:       []string{"gp3-csi", "gp2-csi"},
+			expectedGP3Parameters: map[string]string{"iops": "6000"},
+			expectedConfigMessage: "must have at least 12 GiB",
+		},
+		{
+			name:            "failed hook",
+			failingHook:     "gp3-csi",
+			expectedClasses: []string{"gp2-csi"},
+			expectError:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+			scInformer := informerFactory.Storage().V1().StorageClasses()
+			for _, class := range test.existingClasses {
+				kubeClient.Tracker().Add(class)
+				scInformer.Informer().GetIndexer().Add(class)
+			}
+			nodeInformer := informerFactory.Core().V1().Nodes()
+			for _, node := range nodes {
+				nodeInformer.Informer().GetIndexer().Add(node)
+			}
+			ccdLister := &fakeCCDLister{&opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+				Spec: opv1.ClusterCSIDriverSpec{
+					StorageClassState: test.scState,
+					DriverConfig: opv1.CSIDriverConfigSpec{
+						DriverType: opv1.AWSDriverType,
+						AWS:        &opv1.AWSCSIDriverConfigSpec{KMSKeyARN: validARNString},
+					},
+				},
+			}}
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			recorder := events.NewInMemoryRecorder("test")
+			c := &storageClassController{
+				operatorClient:     operatorClient,
+				kubeClient:         kubeClient,
+				ccdLister:          ccdLister,
+				storageClassLister: scInformer.Lister(),
+				nodeLister:         nodeInformer.Lister(),
+				assetFunc:          assets.ReadFile,
+				scStateEvaluator:   csistorageclasscontroller.NewStorageClassStateEvaluator(kubeClient, ccdLister, recorder),
+				hooks:              []csistorageclasscontroller.StorageClassHookFunc{getKMSKeyHook(ccdLister, newInfraLister("us-east-2")), getGP3ParametersHook(ccdLister)},
+			}
+			if test.failingHook != "" {
+				c.hooks = append(c.hooks, func(_ *opv1.OperatorSpec, class *storagev1.StorageClass) error {
+					if class.Name == test.failingHook {
+						return fmt.Errorf("hook failed")
+					}
+					return nil
+				})
+			}
+
+			err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder))
+			if (err != nil) != test.expectError {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			classes, err := kubeClient.StorageV1().StorageClasses().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := sets.New[string]()
+			for _, class := range classes.Items {
+				names.Insert(class.Name)
+				if expected, ok := test.expectedDefaults[class.Name]; ok && class.Annotations[defaultStorageClassKey] != expected {
+					t.Errorf("expected %s=%q in StorageClass %s, got %q", defaultStorageClassKey, expected, class.Name, class.Annotations[defaultStorageClassKey])
+				}
+				if class.Name == "io2-csi" && test.scState == "" && class.Parameters[kmsKeyID] != validARNString {
+					t.Errorf("expected %s %s in StorageClass %s, got %v", kmsKeyID, validARNString, class.Name, class.Parameters)
+				}
+				if class.Name == "gp3-csi" {
+					for _, key := range []string{"iops", "throughput", "iopsPerGB"} {
+						if class.Parameters[key] != test.expectedGP3Parameters[key] {
+							t.Errorf("expected %s=%q in StorageClass %s, got %v", key, test.expectedGP3Parameters[key], class.Name, class.Parameters)
+						}
+					}
+				}
+				if class.Name == "gp3-csi-us-east-1a" {
+					if class.Annotations[defaultStorageClassKey] == "true" || class.Parameters[kmsKeyID] != validARNString {
+						t.Errorf("unexpected zonal StorageClass %+v", class)
+					}
+					if len(class.AllowedTopologies) != 1 || class.AllowedTopologies[0].MatchLabelExpressions[0].Values[0] != "us-east-1a" {
+						t.Errorf("unexpected allowedTopologies %+v", class.AllowedTopologies)
+					}
+				}
+			}
+			if !names.Equal(sets.New(test.expectedClasses...)) {
+				t.Errorf("expected StorageClasses %v, got %v", test.expectedClasses, sets.List(names))
+			}
+
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, storageClassConfigConditionType)
+			if test.expectError {
+				return
+			}
+			if condition == nil {
+				t.Fatalf("condition %s not found", storageClassConfigConditionType)
+			}
+			if (condition.Status == opv1.ConditionTrue) != test.expectConfigError || !strings.Contains(condition.Message, test.expectedConfigMessage) {
+				t.Errorf("unexpected condition %+v", condition)
+			}
+		})
+	}
+}
+
+func TestSetDefaultStorageClass(t *testing.T) {
+	newSC := func(name, isDefault string) *storagev1.StorageClass {
+		sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name}, Provisioner: provisionerName}
+		if isDefault != "" {
+			sc.Annotations = map[string]string{defaultStorageClassKey: isDefault}
+		}
+		return sc
+	}
+	managedNames := sets.New("gp3-csi", "gp2-csi", "io2-csi")
+
+	tests := []struct {
+		name            string
+		defaultName     string
+		existingClasses []*storagev1.StorageClass
+		expected        map[string]string
+		expectedEvents  int
+	}{
+		{
+			name:     "gp3 by default",
+			expected: map[string]string{"gp3-csi": "true", "gp2-csi": "", "io2-csi": ""},
+		},
+		{
+			name:            "default kept without configuration",
+			existingClasses: []*storagev1.StorageClass{newSC("gp3-csi", "false"), newSC("gp2-csi", "true")},
+			expected:        map[string]string{"gp3-csi": "false", "gp2-csi": "", "io2-csi": ""},
+		},
+		{
+			name:            "configured default",
+			defaultName:     "io2-csi",
+			existingClasses: []*storagev1.StorageClass{newSC("gp3-csi", "true")},
+			expected:        map[string]string{"gp3-csi": "false", "gp2-csi": "false", "io2-csi": "true"},
+		},
+		{
+			name:            "default not managed by the operator",
+			defaultName:     "io2-csi",
+			existingClasses: []*storagev1.StorageClass{newSC("gp3-csi", "true"), newSC("custom", "true")},
+			expected:        map[string]string{"gp3-csi": "false", "gp2-csi": "false", "io2-csi": "false"},
+			expectedEvents:  1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scInformer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Storage().V1().StorageClasses()
+			for _, class := range test.existingClasses {
+				scInformer.Informer().GetIndexer().Add(class)
+			}
+			c := &storageClassController{storageClassLister: scInformer.Lister()}
+			recorder := events.NewInMemoryRecorder("test")
+
+			// The second sync must not repeat the event.
+			for i := 0; i < 2; i++ {
+				expectedSCs := []*storagev1.StorageClass{newSC("gp3-csi", "true"), newSC("gp2-csi", ""), newSC("io2-csi", "")}
+				if err := c.setDefaultStorageClass(test.defaultName, expectedSCs, managedNames, recorder); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				for _, sc := range expectedSCs {
+					if value := sc.Annotations[defaultStorageClassKey]; value != test.expected[sc.Name] {
+						t.Errorf("expected %s=%q in StorageClass %s, got %q", defaultStorageClassKey, test.expected[sc.Name], sc.Name, value)
+					}
+				}
+			}
+			if len(recorder.Events()) != test.expectedEvents {
+				t.Errorf("expected %d events, got %v", test.expectedEvents, recorder.Events())
+			}
+		})
+	}
+}
+
+func TestStorageClassControllerForeignDefault(t *testing.T) {
+	gp3 := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "gp3-csi", Annotations: map[string]string{defaultStorageClassKey: "true"}},
+		Provisioner: provisionerName,
+	}
+	custom := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "custom", Annotations: map[string]string{defaultStorageClassKey: "true"}},
+		Provisioner: "other.csi.example.com",
+	}
+	kubeClient := fake.NewSimpleClientset(gp3, custom)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	scInformer := informerFactory.Storage().V1().StorageClasses()
+	ccdLister := &fakeCCDLister{&opv1.ClusterCSIDriver{ObjectMeta: metav1.ObjectMeta{Name: provisionerName}}}
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&opv1.OperatorSpec{ManagementState: opv1.Managed},
+		&opv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+	c := &storageClassController{
+		operatorClient:     operatorClient,
+		kubeClient:         kubeClient,
+		ccdLister:          ccdLister,
+		storageClassLister: scInformer.Lister(),
+		nodeLister:         informerFactory.Core().V1().Nodes().Lister(),
+		assetFunc:          assets.ReadFile,
+		scStateEvaluator:   csistorageclasscontroller.NewStorageClassStateEvaluator(kubeClient, ccdLister, recorder),
+	}
+	sync := func() *storagev1.StorageClass {
+		classes, err := kubeClient.StorageV1().StorageClasses().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range classes.Items {
+			scInformer.Informer().GetIndexer().Update(&classes.Items[i])
+		}
+		if err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sc, err := kubeClient.StorageV1().StorageClasses().Get(context.TODO(), "gp3-csi", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sc
+	}
+
+	// The admin's StorageClass is the default, gp3-csi is not.
+	sc := sync()
+	if sc.Annotations[defaultStorageClassKey] != "false" || sc.Annotations[demotedDefaultStorageClassKey] != "true" {
+		t.Errorf("expected demoted gp3-csi, got annotations %v", sc.Annotations)
+	}
+	if sc = sync(); sc.Annotations[defaultStorageClassKey] != "false" {
+		t.Errorf("expected gp3-csi to stay not the default, got annotations %v", sc.Annotations)
+	}
+
+	// The admin's StorageClass is not the default anymore, gp3-csi is the default again.
+	custom.Annotations[defaultStorageClassKey] = "false"
+	if _, err := kubeClient.StorageV1().StorageClasses().Update(context.TODO(), custom, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sc = sync()
+	if _, ok := sc.Annotations[demotedDefaultStorageClassKey]; sc.Annotations[defaultStorageClassKey] != "true" || ok {
+		t.Errorf("expected gp3-csi to be the default again, got annotations %v", sc.Annotations)
+	}
+
+	// A StorageClass the admin made not the default stays so.
+	sc.Annotations[defaultStorageClassKey] = "false"
+	if _, err := kubeClient.StorageV1().StorageClasses().Update(context.TODO(), sc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if sc = sync(); sc.Annotations[defaultStorageClassKey] != "false" {
+		t.Errorf("expected gp3-csi to stay not the default, got annotations %v", sc.Annotations)
+	}
+}
@@ -1,34 +1,156 @@
 package operator
 
 import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
 	opv1 "github.com/openshift/api/operator/v1"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
 	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
 	"github.com/openshift/library-go/pkg/operator/csi/csistorageclasscontroller"
 	storagev1 "k8s.io/api/storage/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/klog/v2"
+
+	"github.com/openshift/aws-ebs-csi-driver-operator/pkg/webhook"
+)
+
+const (
+	// gp3ParametersAnnotation on the ClusterCSIDriver is a JSON object with the performance defaults
+	// of the gp3 StorageClasses, e.g. {"iops": 6000, "throughput": 250}.
+	gp3ParametersAnnotation = "ebs.csi.openshift.io/gp3-parameters"
 )
 
+// gp3Parameters are the defaults of the gp3 StorageClass parameters, as documented by the driver.
+type gp3Parameters struct {
+	// IOPS is the number of provisioned IOPS of each volume, the "iops" parameter.
+	IOPS *int64 `json:"iops,omitempty"`
+	// Throughput in MiB/s, the "throughput" parameter.
+	Throughput *int64 `json:"throughput,omitempty"`
+	// IOPSPerGB provisions IOPS proportional to the volume size, the "iopsPerGB" parameter.
+	IOPSPerGB *int64 `json:"iopsPerGB,omitempty"`
+}
+
+// getGP3Parameters parses the gp3ParametersAnnotation of the ClusterCSIDriver. Invalid fields are removed
+// from the returned parameters and reported in the error, nil parameters are returned only when the
+// annotation is missing or can't be parsed.
+func getGP3Parameters(ccd *opv1.ClusterCSIDriver) (*gp3Parameters, error) {
+	value, ok := ccd.Annotations[gp3ParametersAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	params := &gp3Parameters{}
+	if err := json.Unmarshal([]byte(value), params); err != nil {
+		return nil, fmt.Errorf("failed to parse the %s annotation: %w", gp3ParametersAnnotation, err)
+	}
+	if err := removeInvalidGP3Parameters(params); err != nil {
+		return params, fmt.Errorf("invalid %s annotation: %w", gp3ParametersAnnotation, err)
+	}
+	return params, nil
+}
+
+// removeInvalidGP3Parameters removes the fields outside the gp3 limits from params and returns why.
+func removeInvalidGP3Parameters(params *gp3Parameters) error {
+	var errs []error
+	if params.IOPS != nil && (*params.IOPS < webhook.GP3MinIOPS || *params.IOPS > webhook.GP3MaxIOPS) {
+		errs = append(errs, fmt.Errorf("iops %d must be between %d and %d", *params.IOPS, webhook.GP3MinIOPS, webhook.GP3MaxIOPS))
+		params.IOPS = nil
+	}
+	if params.Throughput != nil && (*params.Throughput < webhook.GP3MinThroughput || *params.Throughput > webhook.GP3MaxThroughput) {
+		errs = append(errs, fmt.Errorf("throughput %d must be between %d and %d MiB/s", *params.Throughput, webhook.GP3MinThroughput, webhook.GP3MaxThroughput))
+		params.Throughput = nil
+	}
+	if params.IOPSPerGB != nil && (*params.IOPSPerGB < 1 || *params.IOPSPerGB > webhook.GP3MaxIOPSPerGB) {
+		errs = append(errs, fmt.Errorf("iopsPerGB %d must be between 1 and %d", *params.IOPSPerGB, webhook.GP3MaxIOPSPerGB))
+		params.IOPSPerGB = nil
+	}
+	// The driver ignores iopsPerGB when iops is set.
+	if params.IOPS != nil && params.IOPSPerGB != nil {
+		errs = append(errs, fmt.Errorf("iops and iopsPerGB are mutually exclusive, iopsPerGB is ignored"))
+		params.IOPSPerGB = nil
+	}
+	if params.Throughput != nil {
+		// Volumes without iops or iopsPerGB get the baseline IOPS.
+		iops := int64(webhook.GP3MinIOPS)
+		if params.IOPS != nil {
+			iops = *params.IOPS
+		}
+		if params.IOPSPerGB == nil && float64(*params.Throughput) > float64(iops)*webhook.GP3MaxThroughputPerIOPS {
+			errs = append(errs, fmt.Errorf("throughput %d MiB/s exceeds %v MiB/s per IOPS of %d IOPS", *params.Throughput, webhook.GP3MaxThroughputPerIOPS, iops))
+			params.Throughput = nil
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// gp3MinVolumeSize returns the size in GiB of the smallest gp3 volume with the given IOPS.
+func gp3MinVolumeSize(iops int64) int64 {
+	return (iops + webhook.GP3MaxIOPSPerGB - 1) / webhook.GP3MaxIOPSPerGB
+}
+
+// getGP3ParametersHook sets the valid gp3 performance defaults of the ClusterCSIDriver in the gp3
+// StorageClasses. Invalid defaults are skipped here and reported by the storageClassController.
+func getGP3ParametersHook(ccdLister oplisterv1.ClusterCSIDriverLister) csistorageclasscontroller.StorageClassHookFunc {
+	return func(_ *opv1.OperatorSpec, class *storagev1.StorageClass) error {
+		if class.Parameters["type"] != "gp3" {
+			return nil
+		}
+		ccd, err := ccdLister.Get(class.Provisioner)
+		if err != nil {
+			return err
+		}
+		params, _ := getGP3Parameters(ccd)
+		if params == nil {
+			return nil
+		}
+
+		if params.IOPS != nil {
+			class.Parameters["iops"] = strconv.FormatInt(*params.IOPS, 10)
+		}
+		if params.Throughput != nil {
+			class.Parameters["throughput"] = strconv.FormatInt(*params.Throughput, 10)
+		}
+		if params.IOPSPerGB != nil {
+			class.Parameters["iopsPerGB"] = strconv.FormatInt(*params.IOPSPerGB, 10)
+			// Small volumes would be below the minimum IOPS of gp3 otherwise.
+			class.Parameters["allowAutoIOPSPerGBIncrease"] = "true"
+		}
+		klog.V(4).Infof("Set gp3 parameters %+v in StorageClass %s", class.Parameters, class.Name)
+		return nil
+	}
+}
+
 // getKMSKeyHook checks for AWSCSIDriverConfigSpec in the ClusterCSIDriver object.
 // If it contains KMSKeyARN, it sets the corresponding parameter in the StorageClass.
 // This allows the admin to specify a customer managed key to be used by default.
-func getKMSKeyHook(ccdLister oplisterv1.ClusterCSIDriverLister) csistorageclasscontroller.StorageClassHookFunc {
+// A key of the StorageClass in the storageClassKMSKeysAnnotation replaces KMSKeyARN.
+// Keys that can't be used in the region of the cluster are skipped, and KMSKeyARN is used when the
+// annotation can't be parsed. Both are only logged here and reported by the kmsKeyController.
+func getKMSKeyHook(ccdLister oplisterv1.ClusterCSIDriverLister, infraLister v1.InfrastructureLister) csistorageclasscontroller.StorageClassHookFunc {
 	return func(_ *opv1.OperatorSpec, class *storagev1.StorageClass) error {
 		ccd, err := ccdLister.Get(class.Provisioner)
 		if err != nil {
 			return err
 		}
 
-		driverConfig := ccd.Spec.DriverConfig
-		if driverConfig.DriverType != opv1.AWSDriverType || driverConfig.AWS == nil {
-			klog.V(4).Infof("No AWSCSIDriverConfigSpec defined for %s", class.Provisioner)
-			return nil
+		arn, err := getStorageClassKMSKey(ccd, class.Name)
+		if err != nil {
+			klog.Warningf("Using kmsKeyARN in StorageClass %s: %v", class.Name, err)
+			arn = getDefaultKMSKey(ccd)
 		}
-
-		arn := driverConfig.AWS.KMSKeyARN
 		if arn == "" {
 			klog.V(4).Infof("Not setting empty %s parameter in StorageClass %s", kmsKeyID, class.Name)
 			return nil
 		}
+		region, err := getAWSRegion(infraLister)
+		if err != nil {
+			return err
+		}
+		if err := validateKMSKeyARN(arn, region); err != nil {
+			klog.Warningf("Not setting %s in StorageClass %s: %v", kmsKeyID, class.Name, err)
+			return nil
+		}
 
 		if class.Parameters == nil {
 			class.Parameters = map[string]string{}
@@ -5,7 +5,11 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	configv1 "github.com/openshift/api/config/v1"
 	opv1 "github.com/openshift/api/operator/v1"
+	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -30,6 +34,24 @@ func sc() *storagev1.StorageClass {
 	}
 }
 
+func withName(sc *storagev1.StorageClass, name string) *storagev1.StorageClass {
+	sc.Name = name
+	return sc
+}
+
+func newInfraLister(region string) v1.InfrastructureLister {
+	configInformerFactory := configinformers.NewSharedInformerFactory(fakeconfig.NewSimpleClientset(), 0)
+	configInformerFactory.Config().V1().Infrastructures().Informer().GetIndexer().Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: infrastructureName},
+		Status: configv1.InfrastructureStatus{
+			PlatformStatus: &configv1.PlatformStatus{
+				AWS: &configv1.AWSPlatformStatus{Region: region},
+			},
+		},
+	})
+	return configInformerFactory.Config().V1().Infrastructures().Lister()
+}
+
 func withParameters(sc *storagev1.StorageClass, keysAndValues ...string) *storagev1.StorageClass {
 	for i := 0; i < len(keysAndValues); i += 2 {
 		sc.Parameters[keysAndValues[i]] = keysAndValues[i+1]
@@ -105,13 +127,68 @@ func TestStorageClassHook(t *testing.T) {
 			inputSC:    sc(),
 			expectedSC: withParameters(sc(), kmsKeyID, validARNString),
 		},
+		{
+			name: "with kmsKeyId of the StorageClass",
+			driver: &opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						storageClassKMSKeysAnnotation: `{"gp3-csi": "arn:aws:kms:us-east-2:269733383066:key/gp3", "other": "arn:aws:kms:us-east-2:269733383066:key/other"}`,
+					},
+				},
+				Spec: opv1.ClusterCSIDriverSpec{
+					DriverConfig: opv1.CSIDriverConfigSpec{
+						DriverType: opv1.AWSDriverType,
+						AWS: &opv1.AWSCSIDriverConfigSpec{
+							KMSKeyARN: validARNString,
+						},
+					},
+				},
+			},
+			inputSC:    withName(sc(), "gp3-csi"),
+			expectedSC: withParameters(withName(sc(), "gp3-csi"), kmsKeyID, "arn:aws:kms:us-east-2:269733383066:key/gp3"),
+		},
+		{
+			name: "with kmsKeyId of another region",
+			driver: &opv1.ClusterCSIDriver{
+				Spec: opv1.ClusterCSIDriverSpec{
+					DriverConfig: opv1.CSIDriverConfigSpec{
+						DriverType: opv1.AWSDriverType,
+						AWS: &opv1.AWSCSIDriverConfigSpec{
+							KMSKeyARN: "arn:aws:kms:us-west-1:269733383066:alias/test-key01",
+						},
+					},
+				},
+			},
+			inputSC:    sc(),
+			expectedSC: sc(),
+		},
+		{
+			name: "with malformed StorageClass keys",
+			driver: &opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						storageClassKMSKeysAnnotation: `["gp3-csi"]`,
+					},
+				},
+				Spec: opv1.ClusterCSIDriverSpec{
+					DriverConfig: opv1.CSIDriverConfigSpec{
+						DriverType: opv1.AWSDriverType,
+						AWS: &opv1.AWSCSIDriverConfigSpec{
+							KMSKeyARN: validARNString,
+						},
+					},
+				},
+			},
+			inputSC:    withName(sc(), "gp3-csi"),
+			expectedSC: withParameters(withName(sc(), "gp3-csi"), kmsKeyID, validARNString),
+		},
 	}
 
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
 			ccdLister := &fakeCCDLister{test.driver}
-			hook := getKMSKeyHook(ccdLister)
+			hook := getKMSKeyHook(ccdLister, newInfraLister("us-east-2"))
 			err := hook(nil, test.inputSC)
 
 			if err != nil && !test.expectError {
@@ -127,6 +204,110 @@ func TestStorageClassHook(t *testing.T) {
 	}
 }
 
+func TestGP3ParametersHook(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		inputSC     *storagev1.StorageClass
+		expectedSC  *storagev1.StorageClass
+		// expectInvalid is true when getGP3Parameters reports invalid parameters.
+		expectInvalid bool
+	}{
+		{
+			name:       "no annotation",
+			inputSC:    sc(),
+			expectedSC: sc(),
+		},
+		{
+			name:        "iops and throughput",
+			annotations: map[string]string{gp3ParametersAnnotation: `{"iops": 6000, "throughput": 250}`},
+			inputSC:     sc(),
+			expectedSC:  withParameters(sc(), "iops", "6000", "throughput", "250"),
+		},
+		{
+			name:        "iopsPerGB",
+			annotations: map[string]string{gp3ParametersAnnotation: `{"iopsPerGB": 50, "throughput": 500}`},
+			inputSC:     sc(),
+			expectedSC:  withParameters(sc(), "iopsPerGB", "50", "allowAutoIOPSPerGBIncrease", "true", "throughput", "500"),
+		},
+		{
+			name:        "other volume type",
+			annotations: map[string]string{gp3ParametersAnnotation: `{"iops": 6000}`},
+			inputSC:     withParameters(sc(), "type", "gp2"),
+			expectedSC:  withParameters(sc(), "type", "gp2"),
+		},
+		{
+			name:          "iops out of range",
+			annotations:   map[string]string{gp3ParametersAnnotation: `{"iops": 20000}`},
+			inputSC:       sc(),
+			expectedSC:    sc(),
+			expectInvalid: true,
+		},
+		{
+			name:          "valid throughput with iops out of range",
+			annotations:   map[string]string{gp3ParametersAnnotation: `{"iops": 20000, "throughput": 250}`},
+			inputSC:       sc(),
+			expectedSC:    withParameters(sc(), "throughput", "250"),
+			expectInvalid: true,
+		},
+		{
+			name:          "throughput above the IOPS ratio",
+			annotations:   map[string]string{gp3ParametersAnnotation: `{"iops": 3000, "throughput": 1000}`},
+			inputSC:       sc(),
+			expectedSC:    withParameters(sc(), "iops", "3000"),
+			expectInvalid: true,
+		},
+		{
+			name:          "iops and iopsPerGB",
+			annotations:   map[string]string{gp3ParametersAnnotation: `{"iops": 4000, "iopsPerGB": 10}`},
+			inputSC:       sc(),
+			expectedSC:    withParameters(sc(), "iops", "4000"),
+			expectInvalid: true,
+		},
+		{
+			name:          "iopsPerGB above the size ratio",
+			annotations:   map[string]string{gp3ParametersAnnotation: `{"iopsPerGB": 1000}`},
+			inputSC:       sc(),
+			expectedSC:    sc(),
+			expectInvalid: true,
+		},
+		{
+			name:          "invalid JSON",
+			annotations:   map[string]string{gp3ParametersAnnotation: `{"iops": "6000"}`},
+			inputSC:       sc(),
+			expectedSC:    sc(),
+			expectInvalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ccd := &opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+			}
+			hook := getGP3ParametersHook(&fakeCCDLister{ccd})
+			if err := hook(nil, test.inputSC); err != nil {
+				t.Errorf("got unexpected error: %s", err)
+			}
+			if !equality.Semantic.DeepEqual(test.expectedSC, test.inputSC) {
+				t.Errorf("Unexpected StorageClass content:\n%s", cmp.Diff(test.expectedSC, test.inputSC))
+			}
+			if _, err := getGP3Parameters(ccd); (err != nil) != test.expectInvalid {
+				t.Errorf("unexpected getGP3Parameters error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGP3MinVolumeSize(t *testing.T) {
+	for iops, expected := range map[int64]int64{3000: 6, 6000: 12, 6001: 13, 16000: 32} {
+		if size := gp3MinVolumeSize(iops); size != expected {
+			t.Errorf("expected %d GiB for %d IOPS, got %d", expected, iops, size)
+		}
+	}
+}
+
 type fakeCCDLister struct {
 	driver *opv1.ClusterCSIDriver
 }
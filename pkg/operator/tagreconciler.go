@@ -0,0 +1,508 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	configv1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	kubeclient "k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+)
+
+const (
+	tagReconcilerConditionType = "AWSEBSTagReconcilerProgressing"
+
+	// tagReconcilerStateConfigMap stores the tags applied by the last complete reconciliation,
+	// so tags removed from the desired set can be removed from the volumes and snapshots.
+	tagReconcilerStateConfigMap = "aws-ebs-csi-driver-operator-tags"
+	tagReconcilerStateKey       = "state.json"
+
+	tagReconcilerInterval = time.Hour
+	// tagReconcilerBatchSize is the number of resources handled by one DescribeTags call.
+	tagReconcilerBatchSize = 100
+	tagReconcilerQPS       = 5
+	tagReconcilerBurst     = 10
+)
+
+var volumeSnapshotContentGVR = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshotcontents",
+}
+
+// tagReconcilerState is the content of the tagReconcilerStateConfigMap.
+type tagReconcilerState struct {
+	Tags           map[string]string `json:"tags"`
+	LastReconciled metav1.Time       `json:"lastReconciled"`
+}
+
+// tagReconcilerController back-fills the tags from getEffectiveTags onto EBS volumes and snapshots
+// that existed before the tags were changed. New volumes and snapshots get the tags from the driver
+// --extra-tags argument. Tags removed from the desired set are removed from the resources only when
+// they were applied by a previous reconciliation. EC2 API calls are rate limited and the progress
+// is reported in the AWSEBSTagReconcilerProgressing condition.
+type tagReconcilerController struct {
+	operatorClient     v1helpers.OperatorClient
+	kubeClient         kubeclient.Interface
+	guestDynamicClient dynamic.Interface
+	namespace          string
+	infraLister        v1.InfrastructureLister
+	ccdLister          oplisterv1.ClusterCSIDriverLister
+	pvLister           corev1listers.PersistentVolumeLister
+	configMapLister    corev1listers.ConfigMapNamespaceLister
+	rateLimiter        flowcontrol.RateLimiter
+	// newEC2Client returns the EC2 client to use, with the same endpoint and credentials as the driver.
+	newEC2Client func() (*ec2.Client, error)
+}
+
+func newTagReconcilerController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubeclient.Interface,
+	guestDynamicClient dynamic.Interface,
+	namespace string,
+	infraLister v1.InfrastructureLister,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	pvLister corev1listers.PersistentVolumeLister,
+	configMapLister corev1listers.ConfigMapNamespaceLister,
+	newEC2Client func() (*ec2.Client, error),
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &tagReconcilerController{
+		operatorClient:     operatorClient,
+		kubeClient:         kubeClient,
+		guestDynamicClient: guestDynamicClient,
+		namespace:          namespace,
+		infraLister:        infraLister,
+		ccdLister:          ccdLister,
+		pvLister:           pvLister,
+		configMapLister:    configMapLister,
+		rateLimiter:        flowcontrol.NewTokenBucketRateLimiter(tagReconcilerQPS, tagReconcilerBurst),
+		newEC2Client:       newEC2Client,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ResyncEvery(
+		tagReconcilerInterval,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *tagReconcilerController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	desiredTags, err := getEffectiveTags(c.infraLister, c.ccdLister)
+	var annotationErr *extraTagsAnnotationError
+	if errors.As(err, &annotationErr) {
+		// Reported by the extra tags controller. Tags are not removed from the volumes because of a typo.
+		klog.V(2).Infof("Skipping tag reconciliation: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	desiredTags, _, err = filterValidTags(desiredTags)
+	if err != nil {
+		// Reported by the extra tags controller.
+		klog.V(4).Infof("Skipping invalid tags: %v", err)
+	}
+	desired := tagsToMap(desiredTags)
+
+	state, err := c.getState()
+	if err != nil {
+		return err
+	}
+	if equalTags(desired, state.Tags) && time.Since(state.LastReconciled.Time) < tagReconcilerInterval {
+		klog.V(4).Infof("Tags were reconciled at %s, skipping", state.LastReconciled)
+		return nil
+	}
+
+	ec2Client, err := c.newEC2Client()
+	if errors.Is(err, errNoAWSCredentials) {
+		return c.updateCondition(ctx, opv1.ConditionFalse, "CredentialsMissing",
+			fmt.Sprintf("Existing volumes and snapshots are not re-tagged: %v", err))
+	}
+	if err != nil {
+		return err
+	}
+
+	resourceIDs, err := c.listResourceIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Remove only tags applied by the operator that are not desired anymore.
+	stale := map[string]string{}
+	for key, value := range state.Tags {
+		if _, ok := desired[key]; !ok {
+			stale[key] = value
+		}
+	}
+
+	updated := 0
+	for start := 0; start < len(resourceIDs); start += tagReconcilerBatchSize {
+		end := start + tagReconcilerBatchSize
+		if end > len(resourceIDs) {
+			end = len(resourceIDs)
+		}
+		n, err := c.reconcileBatch(ctx, ec2Client, resourceIDs[start:end], desired, stale)
+		updated += n
+		if err != nil {
+			return err
+		}
+		if end < len(resourceIDs) {
+			msg := fmt.Sprintf("Reconciled tags of %d of %d volumes and snapshots, updated %d", end, len(resourceIDs), updated)
+			if err := c.updateCondition(ctx, opv1.ConditionTrue, "Reconciling", msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	if updated > 0 {
+		syncCtx.Recorder().Eventf("TagsReconciled", "Updated tags of %d of %d EBS volumes and snapshots", updated, len(resourceIDs))
+	}
+	if err := c.saveState(ctx, syncCtx.Recorder(), &tagReconcilerState{Tags: desired, LastReconciled: metav1.Now()}); err != nil {
+		return err
+	}
+	return c.updateCondition(ctx, opv1.ConditionFalse, "AsExpected",
+		fmt.Sprintf("All %d volumes and snapshots have the desired tags, updated %d", len(resourceIDs), updated))
+}
+
+// reconcileBatch compares the current tags of the resources with the desired ones and fixes them.
+// It returns the number of resources that were updated.
+func (c *tagReconcilerController) reconcileBatch(ctx context.Context, ec2Client *ec2.Client, resourceIDs []string, desired, stale map[string]string) (int, error) {
+	// CreateTags fails for all resources when one of them does not exist.
+	resourceIDs, err := c.getExistingResourceIDs(ctx, ec2Client, resourceIDs)
+	if err != nil {
+		return 0, err
+	}
+	if len(resourceIDs) == 0 {
+		return 0, nil
+	}
+
+	current := map[string]map[string]string{}
+	if err := c.rateLimiter.Wait(ctx); err != nil {
+		return 0, err
+	}
+	paginator := ec2.NewDescribeTagsPaginator(ec2Client, &ec2.DescribeTagsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("resource-id"),
+				Values: resourceIDs,
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to describe tags: %w", err)
+		}
+		for _, tag := range page.Tags {
+			id := aws.ToString(tag.ResourceId)
+			if current[id] == nil {
+				current[id] = map[string]string{}
+			}
+			current[id][aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+
+	// Group the resources by the tags they need, so each group needs a single API call.
+	toCreate := map[string][]string{}
+	toDelete := map[string][]string{}
+	createTags := map[string]map[string]string{}
+	deleteTags := map[string]map[string]string{}
+	updatedIDs := map[string]bool{}
+	for _, id := range resourceIDs {
+		missing := map[string]string{}
+		for key, value := range desired {
+			if currentValue, ok := current[id][key]; !ok || currentValue != value {
+				missing[key] = value
+			}
+		}
+		if len(missing) > 0 {
+			k := tagsKey(missing)
+			toCreate[k] = append(toCreate[k], id)
+			createTags[k] = missing
+			updatedIDs[id] = true
+		}
+
+		extra := map[string]string{}
+		for key, value := range stale {
+			if currentValue, ok := current[id][key]; ok && currentValue == value {
+				extra[key] = value
+			}
+		}
+		if len(extra) > 0 {
+			k := tagsKey(extra)
+			toDelete[k] = append(toDelete[k], id)
+			deleteTags[k] = extra
+			updatedIDs[id] = true
+		}
+	}
+
+	for _, k := range sortedKeys(toCreate) {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			return 0, err
+		}
+		klog.V(2).Infof("Adding tags %s to %v", k, toCreate[k])
+		_, err := ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: toCreate[k],
+			Tags:      toEC2Tags(createTags[k]),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to create tags on %v: %w", toCreate[k], err)
+		}
+	}
+	for _, k := range sortedKeys(toDelete) {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			return 0, err
+		}
+		klog.V(2).Infof("Removing tags %s from %v", k, toDelete[k])
+		_, err := ec2Client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+			Resources: toDelete[k],
+			Tags:      toEC2Tags(deleteTags[k]),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete tags from %v: %w", toDelete[k], err)
+		}
+	}
+	return len(updatedIDs), nil
+}
+
+// getExistingResourceIDs returns the IDs of the volumes and snapshots that still exist in EC2, e.g. PVs
+// with the Retain reclaim policy can outlive their volume. The resources are described with filters,
+// because describing them by ID fails when one of them does not exist.
+func (c *tagReconcilerController) getExistingResourceIDs(ctx context.Context, ec2Client *ec2.Client, resourceIDs []string) ([]string, error) {
+	var volumeIDs, snapshotIDs []string
+	for _, id := range resourceIDs {
+		if strings.HasPrefix(id, "snap-") {
+			snapshotIDs = append(snapshotIDs, id)
+		} else {
+			volumeIDs = append(volumeIDs, id)
+		}
+	}
+
+	existing := map[string]bool{}
+	if len(volumeIDs) > 0 {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		paginator := ec2.NewDescribeVolumesPaginator(ec2Client, &ec2.DescribeVolumesInput{
+			Filters: []ec2types.Filter{{Name: aws.String("volume-id"), Values: volumeIDs}},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe volumes: %w", err)
+			}
+			for _, volume := range page.Volumes {
+				existing[aws.ToString(volume.VolumeId)] = true
+			}
+		}
+	}
+	if len(snapshotIDs) > 0 {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		paginator := ec2.NewDescribeSnapshotsPaginator(ec2Client, &ec2.DescribeSnapshotsInput{
+			Filters: []ec2types.Filter{{Name: aws.String("snapshot-id"), Values: snapshotIDs}},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe snapshots: %w", err)
+			}
+			for _, snapshot := range page.Snapshots {
+				existing[aws.ToString(snapshot.SnapshotId)] = true
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(resourceIDs))
+	var missing []string
+	for _, id := range resourceIDs {
+		if existing[id] {
+			ids = append(ids, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		klog.V(2).Infof("Skipping volumes and snapshots that do not exist: %v", missing)
+	}
+	return ids, nil
+}
+
+// listResourceIDs returns the IDs of the EBS volumes and snapshots provisioned by the driver.
+func (c *tagReconcilerController) listResourceIDs(ctx context.Context) ([]string, error) {
+	pvs, err := c.pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != string(opv1.AWSEBSCSIDriver) {
+			continue
+		}
+		ids = append(ids, pv.Spec.CSI.VolumeHandle)
+	}
+
+	contents, err := c.guestDynamicClient.Resource(volumeSnapshotContentGVR).List(ctx, metav1.ListOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		// The snapshot CRDs are not installed.
+		contents = &unstructured.UnstructuredList{}
+	case err != nil:
+		return nil, err
+	}
+	for _, content := range contents.Items {
+		driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+		if driver != string(opv1.AWSEBSCSIDriver) {
+			continue
+		}
+		handle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle")
+		if handle == "" {
+			continue
+		}
+		ids = append(ids, handle)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (c *tagReconcilerController) getState() (*tagReconcilerState, error) {
+	state := &tagReconcilerState{}
+	cm, err := c.configMapLister.Get(tagReconcilerStateConfigMap)
+	if apierrors.IsNotFound(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(cm.Data[tagReconcilerStateKey]), state); err != nil {
+		klog.Warningf("Ignoring malformed tag reconciler state in ConfigMap %s: %v", tagReconcilerStateConfigMap, err)
+		return &tagReconcilerState{}, nil
+	}
+	return state, nil
+}
+
+func (c *tagReconcilerController) saveState(ctx context.Context, recorder events.Recorder, state *tagReconcilerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tagReconcilerStateConfigMap,
+			Namespace: c.namespace,
+		},
+		Data: map[string]string{
+			tagReconcilerStateKey: string(data),
+		},
+	}
+	_, _, err = resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), recorder, cm)
+	return err
+}
+
+func (c *tagReconcilerController) updateCondition(ctx context.Context, status opv1.ConditionStatus, reason, message string) error {
+	condition := opv1.OperatorCondition{
+		Type:    tagReconcilerConditionType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+	_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+func tagsToMap(tags []configv1.AWSResourceTag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[tag.Key] = tag.Value
+	}
+	return m
+}
+
+func equalTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// tagsKey returns a stable string representation of the tags, used to group resources.
+func tagsKey(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, fmt.Sprintf("%q=%q", key, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toEC2Tags(tags map[string]string) []ec2types.Tag {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ec2Tags := make([]ec2types.Tag, 0, len(tags))
+	for _, key := range keys {
+		ec2Tags = append(ec2Tags, ec2types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tags[key]),
+		})
+	}
+	return ec2Tags
+}
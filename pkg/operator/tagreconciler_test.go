@@ -0,0 +1,248 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// fakeEC2 is a minimal stand-in for the EC2 Query API that supports the tag operations
+// and describing volumes and snapshots. Only the resources in tags exist.
+type fakeEC2 struct {
+	lock sync.Mutex
+	tags map[string]map[string]string
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.Form.Get("Action")
+	switch action {
+	case "DescribeTags":
+		fmt.Fprintf(w, "<DescribeTagsResponse><requestId>1</requestId><tagSet>")
+		for i := 1; r.Form.Get(fmt.Sprintf("Filter.1.Value.%d", i)) != ""; i++ {
+			id := r.Form.Get(fmt.Sprintf("Filter.1.Value.%d", i))
+			for key, value := range f.tags[id] {
+				fmt.Fprintf(w, "<item><resourceId>%s</resourceId><key>%s</key><value>%s</value></item>", id, key, value)
+			}
+		}
+		fmt.Fprintf(w, "</tagSet></DescribeTagsResponse>")
+	case "DescribeVolumes", "DescribeSnapshots":
+		set, field := "volumeSet", "volumeId"
+		if action == "DescribeSnapshots" {
+			set, field = "snapshotSet", "snapshotId"
+		}
+		fmt.Fprintf(w, "<%sResponse><requestId>1</requestId><%s>", action, set)
+		for i := 1; r.Form.Get(fmt.Sprintf("Filter.1.Value.%d", i)) != ""; i++ {
+			id := r.Form.Get(fmt.Sprintf("Filter.1.Value.%d", i))
+			if _, ok := f.tags[id]; ok {
+				fmt.Fprintf(w, "<item><%s>%s</%s></item>", field, id, field)
+			}
+		}
+		fmt.Fprintf(w, "</%s></%sResponse>", set, action)
+	case "CreateTags", "DeleteTags":
+		for i := 1; r.Form.Get(fmt.Sprintf("ResourceId.%d", i)) != ""; i++ {
+			id := r.Form.Get(fmt.Sprintf("ResourceId.%d", i))
+			if _, ok := f.tags[id]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "<Response><Errors><Error><Code>InvalidVolume.NotFound</Code><Message>The volume '%s' does not exist.</Message></Error></Errors><RequestID>1</RequestID></Response>", id)
+				return
+			}
+		}
+		for i := 1; r.Form.Get(fmt.Sprintf("ResourceId.%d", i)) != ""; i++ {
+			id := r.Form.Get(fmt.Sprintf("ResourceId.%d", i))
+			for j := 1; r.Form.Get(fmt.Sprintf("Tag.%d.Key", j)) != ""; j++ {
+				key := r.Form.Get(fmt.Sprintf("Tag.%d.Key", j))
+				if action == "CreateTags" {
+					f.tags[id][key] = r.Form.Get(fmt.Sprintf("Tag.%d.Value", j))
+				} else {
+					delete(f.tags[id], key)
+				}
+			}
+		}
+		fmt.Fprintf(w, "<%sResponse><requestId>1</requestId><return>true</return></%sResponse>", action, action)
+	default:
+		http.Error(w, "unsupported action "+action, http.StatusBadRequest)
+	}
+}
+
+func csiPV(name, driver, handle string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       driver,
+					VolumeHandle: handle,
+				},
+			},
+		},
+	}
+}
+
+func volumeSnapshotContent(name, driver, handle string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshotContent",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"spec": map[string]interface{}{
+				"driver": driver,
+			},
+			"status": map[string]interface{}{
+				"snapshotHandle": handle,
+			},
+		},
+	}
+}
+
+func TestTagReconciler(t *testing.T) {
+	ec2Server := &fakeEC2{
+		tags: map[string]map[string]string{
+			"vol-1":  {"owner": "old", "other": "keep"},
+			"vol-2":  {},
+			"vol-3":  {"owner": "someone"},
+			"snap-1": {"owner": "team-a", "cost-center": "storage", "removed": "yes"},
+		},
+	}
+	server := httptest.NewTLSServer(ec2Server)
+	defer server.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	infra := &v1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: infrastructureName},
+		Status: v1.InfrastructureStatus{
+			PlatformStatus: &v1.PlatformStatus{
+				AWS: &v1.AWSPlatformStatus{
+					Region:       "us-east-1",
+					ResourceTags: []v1.AWSResourceTag{{Key: "owner", Value: "team-a"}},
+				},
+			},
+		},
+	}
+	configInformerFactory := configinformers.NewSharedInformerFactory(fakeconfig.NewSimpleClientset(), 0)
+	configInformerFactory.Config().V1().Infrastructures().Informer().GetIndexer().Add(infra)
+
+	ccdLister := &fakeCCDLister{&opv1.ClusterCSIDriver{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        provisionerName,
+			Annotations: map[string]string{extraTagsAnnotation: `{"cost-center": "storage"}`},
+		},
+	}}
+
+	oldState, _ := json.Marshal(&tagReconcilerState{Tags: map[string]string{"owner": "old", "removed": "yes"}})
+	stateCM := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: tagReconcilerStateConfigMap, Namespace: defaultNamespace},
+		Data:       map[string]string{tagReconcilerStateKey: string(oldState)},
+	}
+	kubeClient := fake.NewSimpleClientset(stateCM)
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	kubeInformerFactory.Core().V1().ConfigMaps().Informer().GetIndexer().Add(stateCM)
+	pvIndexer := kubeInformerFactory.Core().V1().PersistentVolumes().Informer().GetIndexer()
+	pvIndexer.Add(csiPV("pv-1", provisionerName, "vol-1"))
+	pvIndexer.Add(csiPV("pv-2", provisionerName, "vol-2"))
+	pvIndexer.Add(csiPV("pv-other", "other.csi.example.com", "vol-3"))
+	// A PV with the Retain reclaim policy whose volume was deleted.
+	pvIndexer.Add(csiPV("pv-deleted", provisionerName, "vol-deleted"))
+
+	dynamicClient := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{volumeSnapshotContentGVR: "VolumeSnapshotContentList"},
+		volumeSnapshotContent("content-1", provisionerName, "snap-1"),
+	)
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&opv1.OperatorSpec{ManagementState: opv1.Managed},
+		&opv1.OperatorStatus{},
+		nil,
+	)
+	c := &tagReconcilerController{
+		operatorClient:     operatorClient,
+		kubeClient:         kubeClient,
+		guestDynamicClient: dynamicClient,
+		namespace:          defaultNamespace,
+		infraLister:        configInformerFactory.Config().V1().Infrastructures().Lister(),
+		ccdLister:          ccdLister,
+		pvLister:           kubeInformerFactory.Core().V1().PersistentVolumes().Lister(),
+		configMapLister:    kubeInformerFactory.Core().V1().ConfigMaps().Lister().ConfigMaps(defaultNamespace),
+		rateLimiter:        flowcontrol.NewFakeAlwaysRateLimiter(),
+		newEC2Client: func() (*ec2.Client, error) {
+			return newEC2Client(&ec2ClientConfig{
+				region:          "us-east-1",
+				endpoint:        server.URL,
+				caBundle:        caBundle,
+				accessKeyID:     "id",
+				secretAccessKey: "secret",
+			})
+		},
+	}
+
+	err := c.sync(context.TODO(), factory.NewSyncContext("test", events.NewInMemoryRecorder("test")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedTags := map[string]map[string]string{
+		"vol-1":  {"owner": "team-a", "cost-center": "storage", "other": "keep"},
+		"vol-2":  {"owner": "team-a", "cost-center": "storage"},
+		"vol-3":  {"owner": "someone"},
+		"snap-1": {"owner": "team-a", "cost-center": "storage"},
+	}
+	if diff := cmp.Diff(expectedTags, ec2Server.tags); diff != "" {
+		t.Errorf("unexpected EC2 tags:\n%s", diff)
+	}
+
+	_, status, _, _ := operatorClient.GetOperatorState()
+	condition := v1helpers.FindOperatorCondition(status.Conditions, tagReconcilerConditionType)
+	if condition == nil || condition.Status != opv1.ConditionFalse {
+		t.Errorf("unexpected condition: %+v", condition)
+	}
+
+	cm, err := kubeClient.CoreV1().ConfigMaps(defaultNamespace).Get(context.TODO(), tagReconcilerStateConfigMap, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get state ConfigMap: %v", err)
+	}
+	state := &tagReconcilerState{}
+	if err := json.Unmarshal([]byte(cm.Data[tagReconcilerStateKey]), state); err != nil {
+		t.Fatalf("failed to parse state: %v", err)
+	}
+	keys := []string{}
+	for key := range state.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if diff := cmp.Diff([]string{"cost-center", "owner"}, keys); diff != "" {
+		t.Errorf("unexpected state:\n%s", diff)
+	}
+}
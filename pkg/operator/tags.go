@@ -0,0 +1,271 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	configv1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	v1 "github.com/openshift/client-go/config/listers/config/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// extraTagsAnnotation on the ClusterCSIDriver holds a JSON object with additional tags
+	// for EBS volumes and snapshots, e.g. {"cost-center": "storage"}.
+	// Infrastructure.Status.PlatformStatus.AWS.ResourceTags take precedence over these tags.
+	extraTagsAnnotation = "ebs.csi.openshift.io/extra-tags"
+
+	extraTagsConditionType = "AWSEBSExtraTagsDegraded"
+
+	// AWS limits, see https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/Using_Tags.html#tag-restrictions
+	awsMaxTagsPerResource = 50
+	awsMaxTagKeyLength    = 128
+	awsMaxTagValueLength  = 256
+	awsReservedTagPrefix  = "aws:"
+
+	// driverClusterTagPrefix is the prefix of the tag the driver adds with --k8s-tag-cluster-id.
+	driverClusterTagPrefix = "kubernetes.io/cluster/"
+)
+
+var (
+	// driverTagKeys are the tags the driver sets on every volume it creates
+	// (with --k8s-tag-cluster-id and --extra-create-metadata), on top of the extra tags.
+	driverTagKeys = sets.New[string](
+		"CSIVolumeName",
+		"CSIVolumeSnapshotName",
+		"KubernetesCluster",
+		"ebs.csi.aws.com/cluster",
+		"kubernetes.io/created-for/pvc/name",
+		"kubernetes.io/created-for/pvc/namespace",
+		"kubernetes.io/created-for/pv/name",
+	)
+
+	// maxExtraTags is the number of tags left for --extra-tags once the driver tags are set.
+	// CSIVolumeName and CSIVolumeSnapshotName are never set on the same resource,
+	// the kubernetes.io/cluster/<id> tag takes the place of one of them.
+	maxExtraTags = awsMaxTagsPerResource - driverTagKeys.Len()
+)
+
+// extraTagsAnnotationError is returned by getEffectiveTags when the extraTagsAnnotation cannot be parsed.
+type extraTagsAnnotationError struct {
+	err error
+}
+
+func (e *extraTagsAnnotationError) Error() string {
+	return fmt.Sprintf("failed to parse the %s annotation: %v", extraTagsAnnotation, e.err)
+}
+
+func (e *extraTagsAnnotationError) Unwrap() error {
+	return e.err
+}
+
+// getEffectiveTags returns the tags the driver adds to EBS volumes and snapshots: the Infrastructure
+// resource tags, followed by the tags from the ClusterCSIDriver extraTagsAnnotation sorted by key.
+// A ClusterCSIDriver tag with the same key as an Infrastructure tag is ignored. When the annotation
+// cannot be parsed, it returns the Infrastructure tags together with an *extraTagsAnnotationError.
+func getEffectiveTags(infraLister v1.InfrastructureLister, ccdLister oplisterv1.ClusterCSIDriverLister) ([]configv1.AWSResourceTag, error) {
+	infra, err := infraLister.Get(infrastructureName)
+	if err != nil {
+		return nil, err
+	}
+	var tags []configv1.AWSResourceTag
+	if infra.Status.PlatformStatus != nil && infra.Status.PlatformStatus.AWS != nil {
+		tags = append(tags, infra.Status.PlatformStatus.AWS.ResourceTags...)
+	}
+
+	ccd, err := ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return nil, err
+	}
+	driverTags, err := getClusterCSIDriverTags(ccd)
+	if err != nil {
+		return tags, &extraTagsAnnotationError{err: err}
+	}
+	infraKeys := sets.New[string]()
+	for _, tag := range tags {
+		infraKeys.Insert(tag.Key)
+	}
+	for _, tag := range driverTags {
+		if infraKeys.Has(tag.Key) {
+			klog.V(2).Infof("Ignoring tag %q from the %s annotation, it is set in the Infrastructure resource tags", tag.Key, extraTagsAnnotation)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// getClusterCSIDriverTags parses the extraTagsAnnotation of the ClusterCSIDriver.
+func getClusterCSIDriverTags(ccd *opv1.ClusterCSIDriver) ([]configv1.AWSResourceTag, error) {
+	value, ok := ccd.Annotations[extraTagsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	tagMap := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &tagMap); err != nil {
+		return nil, err
+	}
+
+	tags := make([]configv1.AWSResourceTag, 0, len(tagMap))
+	for key, value := range tagMap {
+		tags = append(tags, configv1.AWSResourceTag{Key: key, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+	return tags, nil
+}
+
+// filterValidTags checks the tags against the AWS tag restrictions, the tags managed by the driver
+// and the syntax of the driver --extra-tags flag. The flag is a comma separated list of key=value
+// pairs with surrounding whitespace trimmed and no escaping, so a comma anywhere, '=' in a key or
+// leading or trailing whitespace cannot be passed to the driver without changing the tag. Such tags
+// are rejected. It returns the valid tags in their order, the keys of the dropped tags and an error
+// that describes why they were dropped. Of duplicate keys, the first tag is kept and tags above
+// maxExtraTags are dropped.
+func filterValidTags(tags []configv1.AWSResourceTag) (valid []configv1.AWSResourceTag, dropped []string, err error) {
+	var errs []error
+	valid = make([]configv1.AWSResourceTag, 0, len(tags))
+	seen := sets.New[string]()
+	for _, tag := range tags {
+		if seen.Has(tag.Key) {
+			errs = append(errs, fmt.Errorf("duplicate tag key %q", tag.Key))
+			dropped = append(dropped, tag.Key)
+			continue
+		}
+		seen.Insert(tag.Key)
+
+		if err := validateTag(tag); err != nil {
+			errs = append(errs, err)
+			dropped = append(dropped, tag.Key)
+			continue
+		}
+		valid = append(valid, tag)
+	}
+
+	if len(valid) > maxExtraTags {
+		var tooMany []string
+		for _, tag := range valid[maxExtraTags:] {
+			tooMany = append(tooMany, tag.Key)
+		}
+		errs = append(errs, fmt.Errorf("too many tags: %d, at most %d tags can be added to the ones set by the driver", len(valid), maxExtraTags))
+		dropped = append(dropped, tooMany...)
+		valid = valid[:maxExtraTags]
+	}
+	return valid, dropped, utilerrors.NewAggregate(errs)
+}
+
+func validateTag(tag configv1.AWSResourceTag) error {
+	var errs []error
+	keyLength := utf8.RuneCountInString(tag.Key)
+	switch {
+	case keyLength == 0:
+		errs = append(errs, fmt.Errorf("tag key must not be empty"))
+	case keyLength > awsMaxTagKeyLength:
+		errs = append(errs, fmt.Errorf("tag key %q is longer than %d characters", tag.Key, awsMaxTagKeyLength))
+	}
+	if utf8.RuneCountInString(tag.Value) > awsMaxTagValueLength {
+		errs = append(errs, fmt.Errorf("value of tag %q is longer than %d characters", tag.Key, awsMaxTagValueLength))
+	}
+	if strings.HasPrefix(strings.ToLower(tag.Key), awsReservedTagPrefix) {
+		errs = append(errs, fmt.Errorf("tag key %q uses the reserved prefix %q", tag.Key, awsReservedTagPrefix))
+	}
+	if driverTagKeys.Has(tag.Key) || strings.HasPrefix(tag.Key, driverClusterTagPrefix) {
+		errs = append(errs, fmt.Errorf("tag key %q is managed by the driver", tag.Key))
+	}
+	if strings.ContainsAny(tag.Key, ",=") {
+		errs = append(errs, fmt.Errorf("tag key %q must not contain ',' or '='", tag.Key))
+	}
+	if strings.Contains(tag.Value, ",") {
+		errs = append(errs, fmt.Errorf("value of tag %q must not contain ','", tag.Key))
+	}
+	if strings.TrimSpace(tag.Key) != tag.Key || strings.TrimSpace(tag.Value) != tag.Value {
+		errs = append(errs, fmt.Errorf("key and value of tag %q must not start or end with whitespace", tag.Key))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// encodeTags returns the tags in the format of the driver --extra-tags flag.
+// The tags must be filtered by filterValidTags first.
+func encodeTags(tags []configv1.AWSResourceTag) string {
+	tagPairs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tagPairs = append(tagPairs, fmt.Sprintf("%s=%s", tag.Key, tag.Value))
+	}
+	return strings.Join(tagPairs, ",")
+}
+
+// extraTagsController reports the effective set of extra tags and the dropped invalid tags in the
+// AWSEBSExtraTagsDegraded condition. The tags themselves are passed to the driver by withCustomTags.
+type extraTagsController struct {
+	operatorClient v1helpers.OperatorClient
+	infraLister    v1.InfrastructureLister
+	ccdLister      oplisterv1.ClusterCSIDriverLister
+}
+
+func newExtraTagsController(
+	name string,
+	operatorClient v1helpers.OperatorClient,
+	infraLister v1.InfrastructureLister,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	informers []factory.Informer,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &extraTagsController{
+		operatorClient: operatorClient,
+		infraLister:    infraLister,
+		ccdLister:      ccdLister,
+	}
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		append(informers, operatorClient.Informer())...,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *extraTagsController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	condition := opv1.OperatorCondition{
+		Type:   extraTagsConditionType,
+		Status: opv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+
+	tags, err := getEffectiveTags(c.infraLister, c.ccdLister)
+	var annotationErr *extraTagsAnnotationError
+	if err != nil && !errors.As(err, &annotationErr) {
+		return err
+	}
+	tags, dropped, invalidErr := filterValidTags(tags)
+	switch {
+	case annotationErr != nil:
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "InvalidAnnotation"
+		condition.Message = fmt.Sprintf("Only the Infrastructure resource tags are added to volumes and snapshots: %v. Extra tags: %s", annotationErr, encodeTags(tags))
+	case invalidErr != nil:
+		condition.Status = opv1.ConditionTrue
+		condition.Reason = "InvalidTags"
+		condition.Message = fmt.Sprintf("Tags %q are not added to volumes and snapshots: %v. Extra tags: %s", dropped, invalidErr, encodeTags(tags))
+	case len(tags) == 0:
+		condition.Message = "No extra tags"
+	default:
+		condition.Message = fmt.Sprintf("Extra tags: %s", encodeTags(tags))
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
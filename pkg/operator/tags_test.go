@@ -0,0 +1,206 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/openshift/api/config/v1"
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFilterValidTags(t *testing.T) {
+	tooManyTags := []v1.AWSResourceTag{}
+	var tooManyKeys []string
+	for i := 0; i <= maxExtraTags; i++ {
+		tooManyTags = append(tooManyTags, v1.AWSResourceTag{Key: fmt.Sprintf("key%d", i), Value: "value"})
+		tooManyKeys = append(tooManyKeys, fmt.Sprintf("key%d", i))
+	}
+
+	tests := []struct {
+		name         string
+		tags         []v1.AWSResourceTag
+		expectedKeys []string
+		// expectedDropped are the keys of the dropped tags.
+		expectedDropped []string
+		expectError     bool
+	}{
+		{
+			name: "valid tags",
+			tags: []v1.AWSResourceTag{
+				{Key: "key1", Value: "value1"},
+				{Key: "cost-center", Value: "a=b"},
+				{Key: "empty", Value: ""},
+			},
+			expectedKeys: []string{"key1", "cost-center", "empty"},
+		},
+		{
+			name:            "too many tags",
+			tags:            tooManyTags,
+			expectedKeys:    tooManyKeys[:maxExtraTags],
+			expectedDropped: tooManyKeys[maxExtraTags:],
+			expectError:     true,
+		},
+		{
+			name: "invalid tag",
+			tags: []v1.AWSResourceTag{
+				{Key: "key1", Value: "value1"},
+				{Key: "a=b", Value: "value"},
+				{Key: "key2", Value: "a,b"},
+				{Key: "key3", Value: "value3"},
+			},
+			expectedKeys:    []string{"key1", "key3"},
+			expectedDropped: []string{"a=b", "key2"},
+			expectError:     true,
+		},
+		{
+			name: "duplicate key",
+			tags: []v1.AWSResourceTag{
+				{Key: "key1", Value: "value1"},
+				{Key: "key1", Value: "value2"},
+			},
+			expectedKeys:    []string{"key1"},
+			expectedDropped: []string{"key1"},
+			expectError:     true,
+		},
+		{
+			name:        "empty key",
+			tags:        []v1.AWSResourceTag{{Key: "", Value: "value"}},
+			expectError: true,
+		},
+		{
+			name:        "key too long",
+			tags:        []v1.AWSResourceTag{{Key: strings.Repeat("k", awsMaxTagKeyLength+1), Value: "value"}},
+			expectError: true,
+		},
+		{
+			name:        "value too long",
+			tags:        []v1.AWSResourceTag{{Key: "key", Value: strings.Repeat("v", awsMaxTagValueLength+1)}},
+			expectError: true,
+		},
+		{
+			name:        "reserved prefix",
+			tags:        []v1.AWSResourceTag{{Key: "AWS:createdBy", Value: "value"}},
+			expectError: true,
+		},
+		{
+			name:        "driver cluster tag",
+			tags:        []v1.AWSResourceTag{{Key: "kubernetes.io/cluster/other", Value: "owned"}},
+			expectError: true,
+		},
+		{
+			name:        "driver volume name tag",
+			tags:        []v1.AWSResourceTag{{Key: "CSIVolumeName", Value: "pvc-1"}},
+			expectError: true,
+		},
+		{
+			name:        "comma in value",
+			tags:        []v1.AWSResourceTag{{Key: "key", Value: "a,b"}},
+			expectError: true,
+		},
+		{
+			name:        "equal sign in key",
+			tags:        []v1.AWSResourceTag{{Key: "a=b", Value: "value"}},
+			expectError: true,
+		},
+		{
+			name:        "surrounding whitespace",
+			tags:        []v1.AWSResourceTag{{Key: "key", Value: " value"}},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tags, dropped, err := filterValidTags(test.tags)
+			if err != nil && !test.expectError {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && test.expectError {
+				t.Errorf("expected error, got none")
+			}
+			var keys []string
+			for _, tag := range tags {
+				keys = append(keys, tag.Key)
+			}
+			if !reflect.DeepEqual(keys, test.expectedKeys) {
+				t.Errorf("expected tags %v, got %v", test.expectedKeys, keys)
+			}
+			if test.expectedDropped != nil && !reflect.DeepEqual(dropped, test.expectedDropped) {
+				t.Errorf("expected dropped tags %v, got %v", test.expectedDropped, dropped)
+			}
+		})
+	}
+}
+
+func TestExtraTagsController(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		expectedStatus  opv1.ConditionStatus
+		expectedMessage string
+	}{
+		{
+			name:            "no tags",
+			expectedStatus:  opv1.ConditionFalse,
+			expectedMessage: "No extra tags",
+		},
+		{
+			name:            "valid tags",
+			annotations:     map[string]string{extraTagsAnnotation: `{"cost-center": "storage"}`},
+			expectedStatus:  opv1.ConditionFalse,
+			expectedMessage: "Extra tags: cost-center=storage",
+		},
+		{
+			name:            "invalid tag",
+			annotations:     map[string]string{extraTagsAnnotation: `{"a=b": "value", "cost-center": "storage"}`},
+			expectedStatus:  opv1.ConditionTrue,
+			expectedMessage: `Tags ["a=b"] are not added to volumes and snapshots: tag key "a=b" must not contain ',' or '='. Extra tags: cost-center=storage`,
+		},
+		{
+			name:            "comma in value",
+			annotations:     map[string]string{extraTagsAnnotation: `{"owners": "a,b", "cost-center": "storage"}`},
+			expectedStatus:  opv1.ConditionTrue,
+			expectedMessage: `Tags ["owners"] are not added to volumes and snapshots: value of tag "owners" must not contain ','. Extra tags: cost-center=storage`,
+		},
+		{
+			name:            "malformed annotation",
+			annotations:     map[string]string{extraTagsAnnotation: `cost-center=storage`},
+			expectedStatus:  opv1.ConditionTrue,
+			expectedMessage: "Only the Infrastructure resource tags are added to volumes and snapshots: failed to parse",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			c := &extraTagsController{
+				operatorClient: operatorClient,
+				infraLister:    newInfraLister("us-east-1"),
+				ccdLister: &fakeCCDLister{&opv1.ClusterCSIDriver{
+					ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+				}},
+			}
+			recorder := events.NewInMemoryRecorder("test")
+			if err := c.sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, extraTagsConditionType)
+			if condition == nil {
+				t.Fatalf("condition %s not found", extraTagsConditionType)
+			}
+			if condition.Status != test.expectedStatus || !strings.Contains(condition.Message, test.expectedMessage) {
+				t.Errorf("expected status %s and message %q, got %+v", test.expectedStatus, test.expectedMessage, condition)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	oplisterv1 "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/csi/csistorageclasscontroller"
+	dc "github.com/openshift/library-go/pkg/operator/deploymentcontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/loglevel"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	admissioninformersv1 "k8s.io/client-go/informers/admissionregistration/v1"
+	appsinformersv1 "k8s.io/client-go/informers/apps/v1"
+	kubeclient "k8s.io/client-go/kubernetes"
+	admissionv1listers "k8s.io/client-go/listers/admissionregistration/v1"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/aws-ebs-csi-driver-operator/pkg/webhook"
+)
+
+const (
+	// storageClassPolicyAnnotation on the ClusterCSIDriver is a JSON webhook.Policy of the StorageClasses
+	// of the driver, e.g. {"requireEncryption": true, "allowedTypes": ["gp3"]}. When set, the operator
+	// runs a validating admission webhook that rejects new StorageClasses that violate the policy.
+	storageClassPolicyAnnotation = "ebs.csi.openshift.io/storage-class-policy"
+
+	// operatorImageEnvName overrides the image of the operator. The webhook runs the "webhook" command of the operator.
+	operatorImageEnvName = "OPERATOR_IMAGE"
+	// podNameEnvName is the name of the operator pod, the event recorder of library-go reads it too.
+	podNameEnvName = "POD_NAME"
+
+	// webhookDeploymentName is the name of the Deployment in webhook.yaml.
+	webhookDeploymentName = "aws-ebs-csi-driver-webhook"
+	// webhookContainerName is the name of the webhook container in webhook.yaml.
+	webhookContainerName = "webhook"
+	// webhookConfigName is the name of the ValidatingWebhookConfiguration in webhook_config.yaml.
+	webhookConfigName = "aws-ebs-csi-driver-storageclass-policy"
+)
+
+// getOperatorImage returns the image of the operator: the operatorImageEnvName environment variable when set,
+// otherwise the image of the operator container in the pod of the operator. The pod is found by podNameEnvName
+// or by the hostname, which is the pod name unless the pod sets another one.
+func getOperatorImage(ctx context.Context, kubeClient kubeclient.Interface, namespace string) (string, error) {
+	if image := os.Getenv(operatorImageEnvName); image != "" {
+		return image, nil
+	}
+	podName := os.Getenv(podNameEnvName)
+	if podName == "" {
+		var err error
+		if podName, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	pod, err := kubeClient.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the operator pod %s/%s: %w", namespace, podName, err)
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == operatorName || len(pod.Spec.Containers) == 1 {
+			return container.Image, nil
+		}
+	}
+	return "", fmt.Errorf("container %s not found in the operator pod %s/%s", operatorName, namespace, podName)
+}
+
+// getStorageClassPolicy parses the storageClassPolicyAnnotation of the ClusterCSIDriver.
+// It returns nil when the annotation is not set.
+func getStorageClassPolicy(ccdLister oplisterv1.ClusterCSIDriverLister) (*webhook.Policy, error) {
+	ccd, err := ccdLister.Get(string(opv1.AWSEBSCSIDriver))
+	if err != nil {
+		return nil, err
+	}
+	value, ok := ccd.Annotations[storageClassPolicyAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	policy, err := webhook.ParsePolicy(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the %s annotation: %w", storageClassPolicyAnnotation, err)
+	}
+	return policy, nil
+}
+
+// webhookConditionalFuncs returns the functions that decide if the Service and ServiceAccount of the
+// webhook should be created or deleted. When the ClusterCSIDriver can't be read or the policy is invalid,
+// nothing is changed. Without the operator image, the webhook can't run.
+func webhookConditionalFuncs(ccdLister oplisterv1.ClusterCSIDriverLister, operatorImage string) (shouldCreate, shouldDelete func() bool) {
+	shouldCreate = func() bool {
+		policy, err := getStorageClassPolicy(ccdLister)
+		return err == nil && policy != nil && operatorImage != ""
+	}
+	shouldDelete = func() bool {
+		policy, err := getStorageClassPolicy(ccdLister)
+		return err == nil && (policy == nil || operatorImage == "")
+	}
+	return shouldCreate, shouldDelete
+}
+
+// withWebhookPlaceholders replaces the placeholders of webhook.yaml.
+func withWebhookPlaceholders(operatorImage string) dc.ManifestHookFunc {
+	return func(spec *opv1.OperatorSpec, manifest []byte) ([]byte, error) {
+		if operatorImage == "" {
+			return nil, fmt.Errorf("the image of the operator is unknown")
+		}
+		return []byte(strings.NewReplacer(
+			"${OPERATOR_IMAGE}", operatorImage,
+			"${LOG_LEVEL}", strconv.Itoa(loglevel.LogLevelToVerbosity(spec.LogLevel)),
+		).Replace(string(manifest))), nil
+	}
+}
+
+// withStorageClassPolicy passes the policy to the webhook. The pods are rolled out when it changes.
+func withStorageClassPolicy(ccdLister oplisterv1.ClusterCSIDriverLister) dc.DeploymentHookFunc {
+	return func(_ *opv1.OperatorSpec, deployment *appsv1.Deployment) error {
+		policy, err := getStorageClassPolicy(ccdLister)
+		if err != nil {
+			return err
+		}
+		if policy == nil {
+			return fmt.Errorf("the %s annotation is not set", storageClassPolicyAnnotation)
+		}
+		value, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		for i := range deployment.Spec.Template.Spec.Containers {
+			container := &deployment.Spec.Template.Spec.Containers[i]
+			if container.Name == webhookContainerName {
+				container.Args = append(container.Args, "--policy="+string(value))
+			}
+		}
+		return nil
+	}
+}
+
+// getStorageClassPolicyHook validates the StorageClasses of the operator against the storageClassPolicyAnnotation
+// before they are applied. ApplyStorageClass re-creates a StorageClass when its parameters change and the webhook
+// would reject the new StorageClass only after the old one was deleted. A StorageClass that violates the policy
+// is not updated and the error is reported in the Degraded condition of the StorageClass controller.
+func getStorageClassPolicyHook(ccdLister oplisterv1.ClusterCSIDriverLister) csistorageclasscontroller.StorageClassHookFunc {
+	return func(_ *opv1.OperatorSpec, class *storagev1.StorageClass) error {
+		policy, err := getStorageClassPolicy(ccdLister)
+		if err != nil || policy == nil {
+			return err
+		}
+		if err := policy.Validate(class); err != nil {
+			return fmt.Errorf("StorageClass %s violates the policy of the %s annotation: %w", class.Name, storageClassPolicyAnnotation, err)
+		}
+		return nil
+	}
+}
+
+// webhookController runs the StorageClass validating admission webhook. It deploys webhook.yaml with
+// a regular DeploymentController only when the storageClassPolicyAnnotation is set and removes the
+// Deployment when the annotation is removed. When the policy is set, but the operator image is unknown,
+// the webhook is not deployed and the Available condition is False. The ValidatingWebhookConfiguration
+// of webhookConfigManifest is created once the Deployment is Available, and removed with the Deployment.
+// The Service and ServiceAccount of the webhook are created by a conditional static resources controller.
+type webhookController struct {
+	name                  string
+	operatorClient        v1helpers.OperatorClient
+	kubeClient            kubeclient.Interface
+	namespace             string
+	operatorImage         string
+	webhookConfigManifest []byte
+	ccdLister             oplisterv1.ClusterCSIDriverLister
+	deploymentLister      appsv1listers.DeploymentNamespaceLister
+	webhookConfigLister   admissionv1listers.ValidatingWebhookConfigurationLister
+	resourceCache         resourceapply.ResourceCache
+	deployment            factory.Controller
+}
+
+func newWebhookController(
+	name string,
+	manifest []byte,
+	webhookConfigManifest []byte,
+	operatorClient v1helpers.OperatorClientWithFinalizers,
+	kubeClient kubeclient.Interface,
+	namespace string,
+	operatorImage string,
+	ccdLister oplisterv1.ClusterCSIDriverLister,
+	deployInformer appsinformersv1.DeploymentInformer,
+	webhookConfigInformer admissioninformersv1.ValidatingWebhookConfigurationInformer,
+	optionalInformers []factory.Informer,
+	eventRecorder events.Recorder,
+	optionalManifestHooks []dc.ManifestHookFunc,
+	optionalDeploymentHooks ...dc.DeploymentHookFunc,
+) factory.Controller {
+	c := &webhookController{
+		name:                  name,
+		operatorClient:        operatorClient,
+		kubeClient:            kubeClient,
+		namespace:             namespace,
+		operatorImage:         operatorImage,
+		webhookConfigManifest: webhookConfigManifest,
+		ccdLister:             ccdLister,
+		deploymentLister:      deployInformer.Lister().Deployments(namespace),
+		webhookConfigLister:   webhookConfigInformer.Lister(),
+		resourceCache:         resourceapply.NewResourceCache(),
+		// Only its Sync is used, it's never started on its own.
+		deployment: dc.NewDeploymentController(
+			name,
+			manifest,
+			eventRecorder,
+			operatorClient,
+			kubeClient,
+			deployInformer,
+			nil,
+			append([]dc.ManifestHookFunc{withWebhookPlaceholders(operatorImage)}, optionalManifestHooks...),
+			append(optionalDeploymentHooks, withStorageClassPolicy(ccdLister))...,
+		),
+	}
+	informers := append(optionalInformers, deployInformer.Informer(), webhookConfigInformer.Informer(), operatorClient.Informer())
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		informers...,
+	).ResyncEvery(
+		resync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *webhookController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	policy, err := getStorageClassPolicy(c.ccdLister)
+	if err != nil {
+		return err
+	}
+	switch {
+	case policy == nil:
+		return c.disable(ctx, syncCtx, opv1.ConditionTrue, "WebhookDisabled", "The StorageClass policy is not set")
+	case c.operatorImage == "":
+		return c.disable(ctx, syncCtx, opv1.ConditionFalse, "OperatorImageUnknown",
+			"The StorageClass policy is not enforced, the image of the operator is unknown")
+	}
+	if err := c.deployment.Sync(ctx, syncCtx); err != nil {
+		return err
+	}
+	return c.syncWebhookConfig(ctx, syncCtx)
+}
+
+// syncWebhookConfig applies the ValidatingWebhookConfiguration once the webhook Deployment is Available.
+// Its failurePolicy is Fail, so StorageClasses of the driver can't be created before the webhook runs.
+// Once created, it's kept while the webhook pods are rolled out.
+func (c *webhookController) syncWebhookConfig(ctx context.Context, syncCtx factory.SyncContext) error {
+	deployment, err := c.deploymentLister.Get(webhookDeploymentName)
+	if apierrors.IsNotFound(err) {
+		// The Deployment was just created, the informer triggers the next sync.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isDeploymentAvailable(deployment) {
+		klog.V(4).Infof("Waiting for Deployment %s/%s to be available", c.namespace, webhookDeploymentName)
+		return nil
+	}
+	_, _, err = resourceapply.ApplyValidatingWebhookConfigurationImproved(
+		ctx,
+		c.kubeClient.AdmissionregistrationV1(),
+		syncCtx.Recorder(),
+		resourceread.ReadValidatingWebhookConfigurationV1OrDie(c.webhookConfigManifest),
+		c.resourceCache,
+	)
+	return err
+}
+
+func isDeploymentAvailable(deployment *appsv1.Deployment) bool {
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentAvailable {
+			return condition.Status == corev1.ConditionTrue && deployment.Status.AvailableReplicas > 0
+		}
+	}
+	return false
+}
+
+// disable removes the ValidatingWebhookConfiguration and the webhook Deployment and reports the reason
+// in the conditions of the controller.
+func (c *webhookController) disable(ctx context.Context, syncCtx factory.SyncContext, available opv1.ConditionStatus, reason, message string) error {
+	// The ValidatingWebhookConfiguration goes first, it would block new StorageClasses without the webhook.
+	_, err := c.webhookConfigLister.Get(webhookConfigName)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return err
+	default:
+		err := c.kubeClient.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(ctx, webhookConfigName, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.V(2).Infof("Deleted ValidatingWebhookConfiguration %s: %s", webhookConfigName, message)
+		syncCtx.Recorder().Eventf("ValidatingWebhookConfigurationDeleted", "Deleted ValidatingWebhookConfiguration %s: %s", webhookConfigName, message)
+	}
+
+	_, err = c.deploymentLister.Get(webhookDeploymentName)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return err
+	default:
+		err := c.kubeClient.AppsV1().Deployments(c.namespace).Delete(ctx, webhookDeploymentName, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.V(2).Infof("Deleted Deployment %s/%s: %s", c.namespace, webhookDeploymentName, message)
+		syncCtx.Recorder().Eventf("WebhookDeploymentDeleted", "Deleted Deployment %s: %s", webhookDeploymentName, message)
+	}
+
+	_, _, err = v1helpers.UpdateStatus(
+		ctx,
+		c.operatorClient,
+		v1helpers.UpdateConditionFn(opv1.OperatorCondition{
+			Type:    c.name + opv1.OperatorStatusTypeAvailable,
+			Status:  available,
+			Reason:  reason,
+			Message: message,
+		}),
+		v1helpers.UpdateConditionFn(opv1.OperatorCondition{
+			Type:    c.name + opv1.OperatorStatusTypeProgressing,
+			Status:  opv1.ConditionFalse,
+			Reason:  reason,
+			Message: message,
+		}),
+	)
+	return err
+}
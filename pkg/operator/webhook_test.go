@@ -0,0 +1,351 @@
+package operator
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/openshift/aws-ebs-csi-driver-operator/assets"
+)
+
+func TestWebhookControllerSync(t *testing.T) {
+	manifest, err := assets.ReadFile("webhook.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configManifest, err := assets.ReadFile("webhook_config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existingDeployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      webhookDeploymentName,
+			Namespace: defaultNamespace,
+		},
+	}
+	availableDeployment := existingDeployment.DeepCopy()
+	availableDeployment.Status = appsv1.DeploymentStatus{
+		AvailableReplicas: 1,
+		Conditions:        []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue}},
+	}
+	existingConfig := resourceread.ReadValidatingWebhookConfigurationV1OrDie(configManifest)
+
+	tests := []struct {
+		name               string
+		annotations        map[string]string
+		operatorImage      string
+		deployments        []*appsv1.Deployment
+		configs            []*admissionv1.ValidatingWebhookConfiguration
+		expectError        bool
+		expectedDeployment bool
+		expectedConfig     bool
+		expectedPolicyArg  string
+		expectedReason     string
+		// expectedStatus is the status of the Available condition, when set.
+		expectedStatus opv1.ConditionStatus
+	}{
+		{
+			name:               "policy set",
+			annotations:        map[string]string{storageClassPolicyAnnotation: `{"allowedTypes": ["gp3"], "requireEncryption": true}`},
+			operatorImage:      "operator-image",
+			expectedDeployment: true,
+			expectedPolicyArg:  `--policy={"requireEncryption":true,"allowedTypes":["gp3"]}`,
+			expectedReason:     "Deploying",
+		},
+		{
+			name:               "unavailable Deployment",
+			annotations:        map[string]string{storageClassPolicyAnnotation: `{"requireEncryption": true}`},
+			operatorImage:      "operator-image",
+			deployments:        []*appsv1.Deployment{existingDeployment},
+			expectedDeployment: true,
+			expectedConfig:     false,
+		},
+		{
+			name:               "available Deployment",
+			annotations:        map[string]string{storageClassPolicyAnnotation: `{"requireEncryption": true}`},
+			operatorImage:      "operator-image",
+			deployments:        []*appsv1.Deployment{availableDeployment},
+			expectedDeployment: true,
+			expectedConfig:     true,
+		},
+		{
+			name:               "policy not set",
+			expectedDeployment: false,
+			expectedReason:     "WebhookDisabled",
+		},
+		{
+			name:               "policy removed",
+			deployments:        []*appsv1.Deployment{availableDeployment},
+			configs:            []*admissionv1.ValidatingWebhookConfiguration{existingConfig},
+			expectedDeployment: false,
+			expectedConfig:     false,
+			expectedReason:     "WebhookDisabled",
+		},
+		{
+			name:               "operator image unknown",
+			annotations:        map[string]string{storageClassPolicyAnnotation: `{"requireEncryption": true}`},
+			deployments:        []*appsv1.Deployment{availableDeployment},
+			configs:            []*admissionv1.ValidatingWebhookConfiguration{existingConfig},
+			expectedDeployment: false,
+			expectedConfig:     false,
+			expectedStatus:     opv1.ConditionFalse,
+			expectedReason:     "OperatorImageUnknown",
+		},
+		{
+			name:               "invalid policy",
+			annotations:        map[string]string{storageClassPolicyAnnotation: `{"allowedTypes": ["gp4"]}`},
+			operatorImage:      "operator-image",
+			deployments:        []*appsv1.Deployment{availableDeployment},
+			configs:            []*admissionv1.ValidatingWebhookConfiguration{existingConfig},
+			expectError:        true,
+			expectedDeployment: true,
+			expectedConfig:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+			deployInformer := informerFactory.Apps().V1().Deployments()
+			for _, deployment := range test.deployments {
+				kubeClient.Tracker().Add(deployment)
+				deployInformer.Informer().GetIndexer().Add(deployment)
+			}
+			configInformer := informerFactory.Admissionregistration().V1().ValidatingWebhookConfigurations()
+			for _, config := range test.configs {
+				kubeClient.Tracker().Add(config)
+				configInformer.Informer().GetIndexer().Add(config)
+			}
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			ccdLister := &fakeCCDLister{&opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+			}}
+			recorder := events.NewInMemoryRecorder("test")
+			c := newWebhookController(
+				"AWSEBSDriverWebhookController",
+				manifest,
+				configManifest,
+				operatorClient,
+				kubeClient,
+				defaultNamespace,
+				test.operatorImage,
+				ccdLister,
+				deployInformer,
+				configInformer,
+				nil,
+				recorder,
+				nil,
+			)
+			err := c.Sync(context.TODO(), factory.NewSyncContext("test", recorder))
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			deployment, err := kubeClient.AppsV1().Deployments(defaultNamespace).Get(context.TODO(), webhookDeploymentName, metav1.GetOptions{})
+			if !test.expectedDeployment {
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("expected no Deployment, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("failed to get Deployment: %v", err)
+			}
+			_, err = kubeClient.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), webhookConfigName, metav1.GetOptions{})
+			if test.expectedConfig && err != nil {
+				t.Errorf("failed to get ValidatingWebhookConfiguration: %v", err)
+			}
+			if !test.expectedConfig && !apierrors.IsNotFound(err) {
+				t.Errorf("expected no ValidatingWebhookConfiguration, got %v", err)
+			}
+			if test.expectedPolicyArg != "" {
+				container := deployment.Spec.Template.Spec.Containers[0]
+				if container.Image != "operator-image" {
+					t.Errorf("unexpected image %q", container.Image)
+				}
+				if args := strings.Join(container.Args, " "); !strings.Contains(args, test.expectedPolicyArg) {
+					t.Errorf("expected arg %s, got %s", test.expectedPolicyArg, args)
+				}
+			}
+
+			if test.expectedReason == "" {
+				return
+			}
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, "AWSEBSDriverWebhookControllerAvailable")
+			if condition == nil {
+				t.Fatalf("Available condition not found")
+			}
+			if condition.Reason != test.expectedReason {
+				t.Errorf("expected reason %q, got %q", test.expectedReason, condition.Reason)
+			}
+			if test.expectedStatus != "" && condition.Status != test.expectedStatus {
+				t.Errorf("expected status %s, got %s", test.expectedStatus, condition.Status)
+			}
+		})
+	}
+}
+
+func TestGetOperatorImage(t *testing.T) {
+	newPod := func(containers ...string) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "operator-pod", Namespace: defaultNamespace}}
+		for _, name := range containers {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name, Image: name + "-image"})
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name          string
+		envImage      string
+		pod           *corev1.Pod
+		expectedImage string
+		expectError   bool
+	}{
+		{
+			name:          "image from the environment",
+			envImage:      "env-image",
+			pod:           newPod(operatorName),
+			expectedImage: "env-image",
+		},
+		{
+			name:          "image of the operator container",
+			pod:           newPod("kube-rbac-proxy", operatorName),
+			expectedImage: operatorName + "-image",
+		},
+		{
+			name:          "image of the only container",
+			pod:           newPod("operator"),
+			expectedImage: "operator-image",
+		},
+		{
+			name:        "operator container not found",
+			pod:         newPod("kube-rbac-proxy", "operator"),
+			expectError: true,
+		},
+		{
+			name:        "pod not found",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(operatorImageEnvName, test.envImage)
+			t.Setenv(podNameEnvName, "operator-pod")
+			kubeClient := fake.NewSimpleClientset()
+			if test.pod != nil {
+				kubeClient.Tracker().Add(test.pod)
+			}
+
+			image, err := getOperatorImage(context.TODO(), kubeClient, defaultNamespace)
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if image != test.expectedImage {
+				t.Errorf("expected image %q, got %q", test.expectedImage, image)
+			}
+		})
+	}
+}
+
+func TestWebhookConditionalFuncs(t *testing.T) {
+	tests := []struct {
+		name                 string
+		annotations          map[string]string
+		operatorImage        string
+		expectedShouldCreate bool
+		expectedShouldDelete bool
+	}{
+		{
+			name:                 "policy set",
+			annotations:          map[string]string{storageClassPolicyAnnotation: `{"requireKMSKey": true}`},
+			operatorImage:        "operator-image",
+			expectedShouldCreate: true,
+		},
+		{
+			name:                 "operator image not set",
+			annotations:          map[string]string{storageClassPolicyAnnotation: `{"requireKMSKey": true}`},
+			expectedShouldDelete: true,
+		},
+		{
+			name:                 "policy not set",
+			expectedShouldDelete: true,
+		},
+		{
+			name:        "invalid policy",
+			annotations: map[string]string{storageClassPolicyAnnotation: `{"requireKMSKeys": true}`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shouldCreate, shouldDelete := webhookConditionalFuncs(&fakeCCDLister{&opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+			}}, test.operatorImage)
+			if shouldCreate() != test.expectedShouldCreate || shouldDelete() != test.expectedShouldDelete {
+				t.Errorf("expected create %t and delete %t, got %t and %t", test.expectedShouldCreate, test.expectedShouldDelete, shouldCreate(), shouldDelete())
+			}
+		})
+	}
+}
+
+func TestStorageClassPolicyHook(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		parameters  map[string]string
+		expectError bool
+	}{
+		{
+			name:       "policy not set",
+			parameters: map[string]string{"type": "gp3", "encrypted": "false"},
+		},
+		{
+			name:        "compliant StorageClass",
+			annotations: map[string]string{storageClassPolicyAnnotation: `{"requireEncryption": true}`},
+			parameters:  map[string]string{"type": "gp3", "encrypted": "true"},
+		},
+		{
+			name:        "policy violation",
+			annotations: map[string]string{storageClassPolicyAnnotation: `{"requireEncryption": true}`},
+			parameters:  map[string]string{"type": "gp3", "encrypted": "false"},
+			expectError: true,
+		},
+		{
+			name:        "invalid policy",
+			annotations: map[string]string{storageClassPolicyAnnotation: `{"allowedTypes": ["gp4"]}`},
+			parameters:  map[string]string{"type": "gp3", "encrypted": "true"},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook := getStorageClassPolicyHook(&fakeCCDLister{&opv1.ClusterCSIDriver{
+				ObjectMeta: metav1.ObjectMeta{Name: provisionerName, Annotations: test.annotations},
+			}})
+			sc := &storagev1.StorageClass{
+				ObjectMeta:  metav1.ObjectMeta{Name: "gp3-csi"},
+				Provisioner: provisionerName,
+				Parameters:  test.parameters,
+			}
+			if err := hook(nil, sc); (err != nil) != test.expectError {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/csi/csidrivernodeservicecontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appsinformersv1 "k8s.io/client-go/informers/apps/v1"
+	coreinformersv1 "k8s.io/client-go/informers/core/v1"
+	kubeclient "k8s.io/client-go/kubernetes"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// windowsNodeDaemonSetName is the name of the DaemonSet in node_windows.yaml.
+	windowsNodeDaemonSetName = "aws-ebs-csi-driver-node-windows"
+
+	// Environment variables with Windows images of the node DaemonSet. The Linux images
+	// can't run on Windows nodes, so the DaemonSet is deployed only when all of them are set.
+	windowsDriverImageEnvName              = "WINDOWS_DRIVER_IMAGE"
+	windowsNodeDriverRegistrarImageEnvName = "WINDOWS_NODE_DRIVER_REGISTRAR_IMAGE"
+	windowsLivenessProbeImageEnvName       = "WINDOWS_LIVENESS_PROBE_IMAGE"
+)
+
+var windowsNodeSelector = labels.SelectorFromSet(labels.Set{corev1.LabelOSStable: "windows"})
+
+// windowsNodeImages are the images of the Windows node DaemonSet.
+type windowsNodeImages struct {
+	driver              string
+	nodeDriverRegistrar string
+	livenessProbe       string
+}
+
+// missing returns the environment variables of the images that are not set.
+func (i windowsNodeImages) missing() []string {
+	var names []string
+	if i.driver == "" {
+		names = append(names, windowsDriverImageEnvName)
+	}
+	if i.nodeDriverRegistrar == "" {
+		names = append(names, windowsNodeDriverRegistrarImageEnvName)
+	}
+	if i.livenessProbe == "" {
+		names = append(names, windowsLivenessProbeImageEnvName)
+	}
+	return names
+}
+
+// windowsNodeServiceController runs the node service of the driver on Windows nodes.
+// It deploys node_windows.yaml with a regular CSIDriverNodeServiceController only when
+// the cluster has Windows nodes and removes the DaemonSet when the last one is gone.
+// When a Windows image is not set, the DaemonSet is not deployed and a warning event is emitted.
+type windowsNodeServiceController struct {
+	name            string
+	operatorClient  v1helpers.OperatorClient
+	kubeClient      kubeclient.Interface
+	namespace       string
+	images          windowsNodeImages
+	nodeLister      corev1listers.NodeLister
+	daemonSetLister appsv1listers.DaemonSetNamespaceLister
+	nodeService     factory.Controller
+}
+
+func newWindowsNodeServiceController(
+	name string,
+	manifest []byte,
+	operatorClient v1helpers.OperatorClientWithFinalizers,
+	kubeClient kubeclient.Interface,
+	namespace string,
+	images windowsNodeImages,
+	nodeInformer coreinformersv1.NodeInformer,
+	dsInformer appsinformersv1.DaemonSetInformer,
+	optionalInformers []factory.Informer,
+	eventRecorder events.Recorder,
+	optionalDaemonSetHooks ...csidrivernodeservicecontroller.DaemonSetHookFunc,
+) factory.Controller {
+	c := &windowsNodeServiceController{
+		name:            name,
+		operatorClient:  operatorClient,
+		kubeClient:      kubeClient,
+		namespace:       namespace,
+		images:          images,
+		nodeLister:      nodeInformer.Lister(),
+		daemonSetLister: dsInformer.Lister().DaemonSets(namespace),
+		// Only its Sync is used, it's never started on its own.
+		nodeService: csidrivernodeservicecontroller.NewCSIDriverNodeServiceController(
+			name,
+			manifest,
+			eventRecorder,
+			operatorClient,
+			kubeClient,
+			dsInformer,
+			nil,
+			append(optionalDaemonSetHooks, withWindowsNodeImages(images))...,
+		),
+	}
+	informers := append(optionalInformers, nodeInformer.Informer(), dsInformer.Informer(), operatorClient.Informer())
+	return factory.New().WithSync(
+		c.sync,
+	).WithInformers(
+		informers...,
+	).ResyncEvery(
+		resync,
+	).WithSyncDegradedOnError(
+		operatorClient,
+	).ToController(
+		name,
+		eventRecorder,
+	)
+}
+
+func (c *windowsNodeServiceController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != opv1.Managed {
+		return nil
+	}
+
+	windowsNodes, err := c.nodeLister.List(windowsNodeSelector)
+	if err != nil {
+		return err
+	}
+	if len(windowsNodes) == 0 {
+		return c.disable(ctx, syncCtx, "NoWindowsNodes", "There are no Windows nodes in the cluster")
+	}
+	if missing := c.images.missing(); len(missing) > 0 {
+		message := fmt.Sprintf("The cluster has %d Windows nodes, but %s not set in the operator environment", len(windowsNodes), strings.Join(missing, ", "))
+		previous := v1helpers.FindOperatorCondition(opStatus.Conditions, c.name+opv1.OperatorStatusTypeAvailable)
+		if previous == nil || previous.Message != message {
+			syncCtx.Recorder().Warningf("WindowsImagesNotSet", "EBS volumes are not supported on Windows nodes: %s", message)
+		}
+		return c.disable(ctx, syncCtx, "WindowsImagesNotSet", message)
+	}
+	return c.nodeService.Sync(ctx, syncCtx)
+}
+
+// disable removes the Windows node DaemonSet and reports the reason in the conditions of the controller.
+func (c *windowsNodeServiceController) disable(ctx context.Context, syncCtx factory.SyncContext, reason, message string) error {
+	_, err := c.daemonSetLister.Get(windowsNodeDaemonSetName)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return err
+	default:
+		err := c.kubeClient.AppsV1().DaemonSets(c.namespace).Delete(ctx, windowsNodeDaemonSetName, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.V(2).Infof("Deleted DaemonSet %s/%s: %s", c.namespace, windowsNodeDaemonSetName, message)
+		syncCtx.Recorder().Eventf("WindowsNodeDaemonSetDeleted", "Deleted DaemonSet %s: %s", windowsNodeDaemonSetName, message)
+	}
+
+	_, _, err = v1helpers.UpdateStatus(
+		ctx,
+		c.operatorClient,
+		v1helpers.UpdateConditionFn(opv1.OperatorCondition{
+			Type:    c.name + opv1.OperatorStatusTypeAvailable,
+			Status:  opv1.ConditionTrue,
+			Reason:  reason,
+			Message: message,
+		}),
+		v1helpers.UpdateConditionFn(opv1.OperatorCondition{
+			Type:    c.name + opv1.OperatorStatusTypeProgressing,
+			Status:  opv1.ConditionFalse,
+			Reason:  reason,
+			Message: message,
+		}),
+	)
+	return err
+}
+
+// withWindowsNodeImages replaces the images of the Windows node DaemonSet with the Windows specific images.
+func withWindowsNodeImages(images windowsNodeImages) csidrivernodeservicecontroller.DaemonSetHookFunc {
+	return func(_ *opv1.OperatorSpec, daemonSet *appsv1.DaemonSet) error {
+		for i := range daemonSet.Spec.Template.Spec.Containers {
+			container := &daemonSet.Spec.Template.Spec.Containers[i]
+			switch container.Name {
+			case "csi-driver":
+				container.Image = images.driver
+			case "csi-node-driver-registrar":
+				container.Image = images.nodeDriverRegistrar
+			case "csi-liveness-probe":
+				container.Image = images.livenessProbe
+			}
+		}
+		return nil
+	}
+}
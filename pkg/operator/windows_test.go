@@ -0,0 +1,153 @@
+package operator
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/openshift/aws-ebs-csi-driver-operator/assets"
+)
+
+func TestWindowsNodeServiceControllerSync(t *testing.T) {
+	manifest, err := assets.ReadFile("node_windows.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newNode := func(name, os string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{corev1.LabelOSStable: os},
+		}}
+	}
+	existingDaemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      windowsNodeDaemonSetName,
+			Namespace: defaultNamespace,
+		},
+	}
+
+	images := windowsNodeImages{
+		driver:              "windows-driver",
+		nodeDriverRegistrar: "windows-registrar",
+		livenessProbe:       "windows-liveness-probe",
+	}
+
+	tests := []struct {
+		name              string
+		nodes             []*corev1.Node
+		daemonSets        []*appsv1.DaemonSet
+		images            windowsNodeImages
+		expectedDaemonSet bool
+		expectedReason    string
+		expectedEvent     string
+	}{
+		{
+			name:              "Windows node",
+			nodes:             []*corev1.Node{newNode("linux", "linux"), newNode("windows", "windows")},
+			images:            images,
+			expectedDaemonSet: true,
+			expectedReason:    "Deploying",
+		},
+		{
+			name:              "Windows images not set",
+			nodes:             []*corev1.Node{newNode("linux", "linux"), newNode("windows", "windows")},
+			daemonSets:        []*appsv1.DaemonSet{existingDaemonSet},
+			images:            windowsNodeImages{driver: "windows-driver"},
+			expectedDaemonSet: false,
+			expectedReason:    "WindowsImagesNotSet",
+			expectedEvent:     "WindowsImagesNotSet",
+		},
+		{
+			name:              "Linux nodes only",
+			nodes:             []*corev1.Node{newNode("linux", "linux")},
+			expectedDaemonSet: false,
+			expectedReason:    "NoWindowsNodes",
+		},
+		{
+			name:              "last Windows node removed",
+			nodes:             []*corev1.Node{newNode("linux", "linux")},
+			daemonSets:        []*appsv1.DaemonSet{existingDaemonSet},
+			expectedDaemonSet: false,
+			expectedReason:    "NoWindowsNodes",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+			nodeInformer := informerFactory.Core().V1().Nodes()
+			for _, node := range test.nodes {
+				nodeInformer.Informer().GetIndexer().Add(node)
+			}
+			dsInformer := informerFactory.Apps().V1().DaemonSets()
+			for _, daemonSet := range test.daemonSets {
+				kubeClient.Tracker().Add(daemonSet)
+				dsInformer.Informer().GetIndexer().Add(daemonSet)
+			}
+			operatorClient := v1helpers.NewFakeOperatorClient(
+				&opv1.OperatorSpec{ManagementState: opv1.Managed},
+				&opv1.OperatorStatus{},
+				nil,
+			)
+			recorder := events.NewInMemoryRecorder("test")
+			c := newWindowsNodeServiceController(
+				"AWSEBSDriverWindowsNodeServiceController",
+				manifest,
+				operatorClient,
+				kubeClient,
+				defaultNamespace,
+				test.images,
+				nodeInformer,
+				dsInformer,
+				nil,
+				recorder,
+			)
+			if err := c.Sync(context.TODO(), factory.NewSyncContext("test", recorder)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			daemonSet, err := kubeClient.AppsV1().DaemonSets(defaultNamespace).Get(context.TODO(), windowsNodeDaemonSetName, metav1.GetOptions{})
+			if test.expectedDaemonSet {
+				if err != nil {
+					t.Fatalf("failed to get DaemonSet: %v", err)
+				}
+				for _, container := range daemonSet.Spec.Template.Spec.Containers {
+					if !strings.HasPrefix(container.Image, "windows-") {
+						t.Errorf("unexpected image %q of container %s", container.Image, container.Name)
+					}
+				}
+			} else if !apierrors.IsNotFound(err) {
+				t.Errorf("expected no DaemonSet, got %v", err)
+			}
+
+			_, status, _, _ := operatorClient.GetOperatorState()
+			condition := v1helpers.FindOperatorCondition(status.Conditions, "AWSEBSDriverWindowsNodeServiceControllerAvailable")
+			if condition == nil {
+				t.Fatalf("Available condition not found")
+			}
+			if condition.Reason != test.expectedReason {
+				t.Errorf("expected reason %q, got %q", test.expectedReason, condition.Reason)
+			}
+			if test.expectedEvent != "" {
+				found := false
+				for _, event := range recorder.Events() {
+					found = found || event.Reason == test.expectedEvent
+				}
+				if !found {
+					t.Errorf("expected event %s, got %v", test.expectedEvent, recorder.Events())
+				}
+			}
+		})
+	}
+}
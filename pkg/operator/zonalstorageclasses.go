@@ -0,0 +1,109 @@
+package operator
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	opv1 "github.com/openshift/api/operator/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// zonalStorageClassesAnnotation on the ClusterCSIDriver is a JSON list of the StorageClasses
+	// created by the operator that get a copy pinned to each zone of the cluster nodes, e.g. ["gp3-csi"].
+	zonalStorageClassesAnnotation = "ebs.csi.openshift.io/zonal-storage-classes"
+	// zonalStorageClassLabel is the name of the StorageClass a zone-pinned StorageClass was rendered from.
+	zonalStorageClassLabel = "ebs.csi.openshift.io/zonal-storage-class"
+)
+
+// getZonalStorageClasses parses the zonalStorageClassesAnnotation of the ClusterCSIDriver.
+// It returns a nil set when the annotation cannot be parsed.
+func getZonalStorageClasses(ccd *opv1.ClusterCSIDriver) (sets.Set[string], error) {
+	value, ok := ccd.Annotations[zonalStorageClassesAnnotation]
+	if !ok {
+		return sets.New[string](), nil
+	}
+	var names []string
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return nil, fmt.Errorf("failed to parse the %s annotation: %w", zonalStorageClassesAnnotation, err)
+	}
+	return sets.New(names...), nil
+}
+
+// getZones returns the sorted zones of the nodes.
+func getZones(nodeLister corev1listers.NodeLister) ([]string, error) {
+	nodes, err := nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	zones := sets.New[string]()
+	for _, node := range nodes {
+		if zone := node.Labels[corev1.LabelTopologyZone]; zone != "" {
+			zones.Insert(zone)
+		}
+	}
+	return sets.List(zones), nil
+}
+
+// renderZonalStorageClass returns a copy of the StorageClass that provisions volumes only in the zone.
+// The copy is not the default StorageClass, unless the defaultStorageClassAnnotation names it.
+func renderZonalStorageClass(sc *storagev1.StorageClass, zone string) (*storagev1.StorageClass, error) {
+	zonalSC := sc.DeepCopy()
+	zonalSC.Name = sc.Name + "-" + zone
+	if msgs := validation.IsDNS1123Subdomain(zonalSC.Name); len(msgs) > 0 {
+		return nil, fmt.Errorf("invalid name %q of the copy of StorageClass %s for zone %q: %v", zonalSC.Name, sc.Name, zone, msgs)
+	}
+	delete(zonalSC.Annotations, defaultStorageClassKey)
+	if zonalSC.Labels == nil {
+		zonalSC.Labels = map[string]string{}
+	}
+	zonalSC.Labels[zonalStorageClassLabel] = sc.Name
+	zonalSC.AllowedTopologies = []corev1.TopologySelectorTerm{
+		{
+			MatchLabelExpressions: []corev1.TopologySelectorLabelRequirement{
+				{
+					Key:    corev1.LabelTopologyZone,
+					Values: []string{zone},
+				},
+			},
+		},
+	}
+	return zonalSC, nil
+}
+
+// renderZonalStorageClasses returns the zone-pinned copies of the StorageClasses in zonalNames,
+// sorted by name. Names in zonalNames that are not StorageClasses of expectedSCs and copies with
+// invalid names are skipped and returned in the error.
+func renderZonalStorageClasses(expectedSCs []*storagev1.StorageClass, zonalNames sets.Set[string], zones []string) ([]*storagev1.StorageClass, error) {
+	var errs []error
+	expectedNames := sets.New[string]()
+	var zonalSCs []*storagev1.StorageClass
+	for _, sc := range expectedSCs {
+		expectedNames.Insert(sc.Name)
+		if !zonalNames.Has(sc.Name) {
+			continue
+		}
+		for _, zone := range zones {
+			zonalSC, err := renderZonalStorageClass(sc, zone)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			zonalSCs = append(zonalSCs, zonalSC)
+		}
+	}
+	if unknown := zonalNames.Difference(expectedNames); unknown.Len() > 0 {
+		errs = append(errs, fmt.Errorf("invalid %s annotation: %v are not StorageClasses created by the operator", zonalStorageClassesAnnotation, sets.List(unknown)))
+	}
+	sort.Slice(zonalSCs, func(i, j int) bool {
+		return zonalSCs[i].Name < zonalSCs[j].Name
+	})
+	return zonalSCs, utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,107 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestRenderZonalStorageClass(t *testing.T) {
+	tests := []struct {
+		name          string
+		scName        string
+		zone          string
+		expectedName  string
+		expectedError string
+	}{
+		{
+			name:         "valid zone",
+			scName:       "gp3-csi",
+			zone:         "us-east-1a",
+			expectedName: "gp3-csi-us-east-1a",
+		},
+		{
+			name:         "local zone",
+			scName:       "gp3-csi",
+			zone:         "us-east-1-bos-1a",
+			expectedName: "gp3-csi-us-east-1-bos-1a",
+		},
+		{
+			name:          "zone with upper case letters",
+			scName:        "gp3-csi",
+			zone:          "US-EAST-1A",
+			expectedError: `invalid name "gp3-csi-US-EAST-1A"`,
+		},
+		{
+			name:          "zone with invalid characters",
+			scName:        "gp3-csi",
+			zone:          "us_east_1a",
+			expectedError: `invalid name "gp3-csi-us_east_1a"`,
+		},
+		{
+			name:          "name too long",
+			scName:        "gp3-csi",
+			zone:          strings.Repeat("a", 250),
+			expectedError: "must be no more than 253 characters",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        test.scName,
+					Annotations: map[string]string{defaultStorageClassKey: "true"},
+				},
+				Provisioner: provisionerName,
+			}
+			zonalSC, err := renderZonalStorageClass(sc, test.zone)
+			if test.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+					t.Errorf("expected error containing %q, got %v", test.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if zonalSC.Name != test.expectedName {
+				t.Errorf("expected name %q, got %q", test.expectedName, zonalSC.Name)
+			}
+			if _, ok := zonalSC.Annotations[defaultStorageClassKey]; ok {
+				t.Errorf("expected the default StorageClass annotation to be removed, got %v", zonalSC.Annotations)
+			}
+			if zonalSC.Labels[zonalStorageClassLabel] != test.scName {
+				t.Errorf("expected label %s=%s, got %v", zonalStorageClassLabel, test.scName, zonalSC.Labels)
+			}
+			terms := zonalSC.AllowedTopologies
+			if len(terms) != 1 || terms[0].MatchLabelExpressions[0].Key != corev1.LabelTopologyZone || terms[0].MatchLabelExpressions[0].Values[0] != test.zone {
+				t.Errorf("unexpected allowedTopologies %+v", terms)
+			}
+			if sc.Name != test.scName || sc.Annotations[defaultStorageClassKey] != "true" {
+				t.Errorf("the original StorageClass was modified: %+v", sc)
+			}
+		})
+	}
+}
+
+func TestRenderZonalStorageClasses(t *testing.T) {
+	expectedSCs := []*storagev1.StorageClass{
+		{ObjectMeta: metav1.ObjectMeta{Name: "gp3-csi"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "gp2-csi"}},
+	}
+	zonalSCs, err := renderZonalStorageClasses(expectedSCs, sets.New("gp3-csi", "io2-csi"), []string{"us-east-1b", "US-EAST-1C", "us-east-1a"})
+	if err == nil || !strings.Contains(err.Error(), "[io2-csi] are not StorageClasses created by the operator") || !strings.Contains(err.Error(), "US-EAST-1C") {
+		t.Errorf("expected errors for io2-csi and zone US-EAST-1C, got %v", err)
+	}
+	var names []string
+	for _, sc := range zonalSCs {
+		names = append(names, sc.Name)
+	}
+	if expected := []string{"gp3-csi-us-east-1a", "gp3-csi-us-east-1b"}; strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected StorageClasses %v, got %v", expected, names)
+	}
+}
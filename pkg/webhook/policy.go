@@ -0,0 +1,217 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	storagev1 "k8s.io/api/storage/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// provisioner is the name of the driver. StorageClasses of other provisioners are not validated.
+	provisioner = "ebs.csi.aws.com"
+
+	// defaultVolumeType is the volume type the driver uses when the StorageClass has no "type" parameter.
+	defaultVolumeType = "gp3"
+)
+
+// Names of the StorageClass parameters of the driver. The driver matches them case-insensitively.
+const (
+	typeKey                       = "type"
+	iopsKey                       = "iops"
+	iopsPerGBKey                  = "iopspergb"
+	allowAutoIOPSPerGBIncreaseKey = "allowautoiopspergbincrease"
+	throughputKey                 = "throughput"
+	encryptedKey                  = "encrypted"
+	kmsKeyIDKey                   = "kmskeyid"
+	blockExpressKey               = "blockexpress"
+	blockSizeKey                  = "blocksize"
+	inodeSizeKey                  = "inodesize"
+	bytesPerInodeKey              = "bytesperinode"
+	numberOfInodesKey             = "numberofinodes"
+	ext4BigAllocKey               = "ext4bigalloc"
+	ext4ClusterSizeKey            = "ext4clustersize"
+	outpostARNKey                 = "outpostarn"
+	fsTypeKey                     = "fstype"
+
+	// Parameters with these prefixes are consumed by the CSI sidecars or are resource tags.
+	csiParameterPrefix     = "csi.storage.k8s.io/"
+	tagSpecificationPrefix = "tagspecification"
+)
+
+// Limits of gp3 volumes, see https://docs.aws.amazon.com/ebs/latest/userguide/general-purpose.html
+const (
+	GP3MinIOPS       = 3000
+	GP3MaxIOPS       = 16000
+	GP3MinThroughput = 125
+	GP3MaxThroughput = 1000
+	// GP3MaxIOPSPerGB is the maximum ratio of provisioned IOPS to the volume size in GiB.
+	GP3MaxIOPSPerGB = 500
+	// GP3MaxThroughputPerIOPS is the maximum ratio of throughput in MiB/s to provisioned IOPS.
+	GP3MaxThroughputPerIOPS = 0.25
+)
+
+var (
+	boolParameters    = sets.New(encryptedKey, allowAutoIOPSPerGBIncreaseKey, blockExpressKey, ext4BigAllocKey)
+	integerParameters = sets.New(iopsKey, iopsPerGBKey, throughputKey, blockSizeKey, inodeSizeKey, bytesPerInodeKey, numberOfInodesKey, ext4ClusterSizeKey)
+	otherParameters   = sets.New(typeKey, kmsKeyIDKey, outpostARNKey, fsTypeKey)
+)
+
+// volumeTypeLimits are the provisioned performance limits of an EBS volume type,
+// see https://docs.aws.amazon.com/ebs/latest/userguide/ebs-volume-types.html
+type volumeTypeLimits struct {
+	minIOPS, maxIOPS             int64
+	maxIOPSPerGB                 int64
+	minThroughput, maxThroughput int64
+}
+
+// volumeTypes are the EBS volume types. Types without IOPS or throughput limits don't accept the parameter.
+var volumeTypes = map[string]volumeTypeLimits{
+	"gp2":      {},
+	"gp3":      {minIOPS: GP3MinIOPS, maxIOPS: GP3MaxIOPS, maxIOPSPerGB: GP3MaxIOPSPerGB, minThroughput: GP3MinThroughput, maxThroughput: GP3MaxThroughput},
+	"io1":      {minIOPS: 100, maxIOPS: 64000, maxIOPSPerGB: 50},
+	"io2":      {minIOPS: 100, maxIOPS: 256000, maxIOPSPerGB: 1000},
+	"st1":      {},
+	"sc1":      {},
+	"standard": {},
+}
+
+// Policy is the policy of the StorageClasses of the driver.
+type Policy struct {
+	// RequireEncryption rejects StorageClasses without the "encrypted": "true" parameter.
+	RequireEncryption bool `json:"requireEncryption,omitempty"`
+	// AllowedTypes are the allowed volume types. All types are allowed when empty.
+	// StorageClasses without the "type" parameter provision gp3 volumes.
+	AllowedTypes []string `json:"allowedTypes,omitempty"`
+	// RequireKMSKey rejects StorageClasses without the "kmsKeyId" parameter.
+	RequireKMSKey bool `json:"requireKMSKey,omitempty"`
+	// AllowedKMSKeys are the allowed values of the "kmsKeyId" parameter. All keys are allowed when empty.
+	AllowedKMSKeys []string `json:"allowedKMSKeys,omitempty"`
+	// ValidateParameters rejects unknown parameters, parameters with invalid values and
+	// IOPS or throughput outside the limits of the volume type.
+	ValidateParameters bool `json:"validateParameters,omitempty"`
+}
+
+// ParsePolicy parses and validates a JSON Policy. Unknown fields are rejected.
+func ParsePolicy(value string) (*Policy, error) {
+	policy := &Policy{}
+	decoder := json.NewDecoder(bytes.NewBufferString(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(policy); err != nil {
+		return nil, err
+	}
+	for _, volumeType := range policy.AllowedTypes {
+		if _, ok := volumeTypes[volumeType]; !ok {
+			return nil, fmt.Errorf("allowedTypes: unknown volume type %q", volumeType)
+		}
+	}
+	for _, key := range policy.AllowedKMSKeys {
+		if key == "" {
+			return nil, fmt.Errorf("allowedKMSKeys: empty KMS key")
+		}
+	}
+	return policy, nil
+}
+
+// Validate returns the violations of the policy by the StorageClass, nil when it complies.
+// StorageClasses of other provisioners always comply.
+func (p *Policy) Validate(sc *storagev1.StorageClass) error {
+	if sc.Provisioner != provisioner {
+		return nil
+	}
+	params := make(map[string]string, len(sc.Parameters))
+	for key, value := range sc.Parameters {
+		params[strings.ToLower(key)] = value
+	}
+	volumeType := params[typeKey]
+	if volumeType == "" {
+		volumeType = defaultVolumeType
+	}
+
+	var errs []error
+	if p.RequireEncryption || p.RequireKMSKey {
+		if encrypted, err := strconv.ParseBool(params[encryptedKey]); err != nil || !encrypted {
+			errs = append(errs, fmt.Errorf("parameter \"encrypted\" must be \"true\""))
+		}
+	}
+	if len(p.AllowedTypes) > 0 && !sets.New(p.AllowedTypes...).Has(volumeType) {
+		errs = append(errs, fmt.Errorf("volume type %q is not allowed, allowed types are %v", volumeType, p.AllowedTypes))
+	}
+	kmsKey := params[kmsKeyIDKey]
+	if p.RequireKMSKey && kmsKey == "" {
+		errs = append(errs, fmt.Errorf("parameter \"kmsKeyId\" is required"))
+	}
+	if len(p.AllowedKMSKeys) > 0 && kmsKey != "" && !sets.New(p.AllowedKMSKeys...).Has(kmsKey) {
+		errs = append(errs, fmt.Errorf("KMS key %q is not allowed", kmsKey))
+	}
+	if p.ValidateParameters {
+		errs = append(errs, validateParameters(params, volumeType)...)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// validateParameters checks the StorageClass parameters, with lowercase names, against the parameters
+// documented by the driver.
+func validateParameters(params map[string]string, volumeType string) []error {
+	var errs []error
+	for _, key := range sets.List(sets.KeySet(params)) {
+		value := params[key]
+		switch {
+		case strings.HasPrefix(key, csiParameterPrefix), strings.HasPrefix(key, tagSpecificationPrefix), otherParameters.Has(key):
+		case boolParameters.Has(key):
+			if _, err := strconv.ParseBool(value); err != nil {
+				errs = append(errs, fmt.Errorf("parameter %q must be a boolean, got %q", key, value))
+			}
+		case integerParameters.Has(key):
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n <= 0 {
+				errs = append(errs, fmt.Errorf("parameter %q must be a positive integer, got %q", key, value))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown parameter %q", key))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	limits, ok := volumeTypes[volumeType]
+	if !ok {
+		return []error{fmt.Errorf("unknown volume type %q", volumeType)}
+	}
+	if value, ok := params[iopsKey]; ok {
+		iops, _ := strconv.ParseInt(value, 10, 64)
+		if limits.maxIOPS == 0 {
+			errs = append(errs, fmt.Errorf("volume type %s does not support parameter \"iops\"", volumeType))
+		} else if iops < limits.minIOPS || iops > limits.maxIOPS {
+			errs = append(errs, fmt.Errorf("iops %d of volume type %s must be between %d and %d", iops, volumeType, limits.minIOPS, limits.maxIOPS))
+		}
+	}
+	if value, ok := params[iopsPerGBKey]; ok {
+		iopsPerGB, _ := strconv.ParseInt(value, 10, 64)
+		if limits.maxIOPSPerGB == 0 {
+			errs = append(errs, fmt.Errorf("volume type %s does not support parameter \"iopsPerGB\"", volumeType))
+		} else if iopsPerGB > limits.maxIOPSPerGB {
+			errs = append(errs, fmt.Errorf("iopsPerGB %d of volume type %s must be at most %d", iopsPerGB, volumeType, limits.maxIOPSPerGB))
+		}
+	}
+	if value, ok := params[throughputKey]; ok {
+		throughput, _ := strconv.ParseInt(value, 10, 64)
+		if limits.maxThroughput == 0 {
+			errs = append(errs, fmt.Errorf("volume type %s does not support parameter \"throughput\"", volumeType))
+		} else if throughput < limits.minThroughput || throughput > limits.maxThroughput {
+			errs = append(errs, fmt.Errorf("throughput %d of volume type %s must be between %d and %d MiB/s", throughput, volumeType, limits.minThroughput, limits.maxThroughput))
+		}
+	}
+	if blockExpress, _ := strconv.ParseBool(params[blockExpressKey]); blockExpress && volumeType != "io2" {
+		errs = append(errs, fmt.Errorf("parameter \"blockExpress\" is supported only by volume type io2"))
+	}
+	if encrypted, _ := strconv.ParseBool(params[encryptedKey]); params[kmsKeyIDKey] != "" && !encrypted {
+		errs = append(errs, fmt.Errorf("parameter \"kmsKeyId\" requires \"encrypted\": \"true\""))
+	}
+	return errs
+}
@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		value       string
+		expectError bool
+	}{
+		{value: `{}`},
+		{value: `{"requireEncryption": true, "allowedTypes": ["gp3", "io2"], "requireKMSKey": true, "validateParameters": true}`},
+		{value: `{"allowedKMSKeys": ["arn:aws:kms:us-east-1:111122223333:key/test"]}`},
+		{value: `{"allowedTypes": ["gp4"]}`, expectError: true},
+		{value: `{"allowedKMSKeys": [""]}`, expectError: true},
+		{value: `{"requireEncrypted": true}`, expectError: true},
+		{value: `["gp3"]`, expectError: true},
+	}
+	for _, test := range tests {
+		_, err := ParsePolicy(test.value)
+		if (err != nil) != test.expectError {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	const key = "arn:aws:kms:us-east-1:111122223333:key/test"
+	newSC := func(params map[string]string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "test"},
+			Provisioner: provisioner,
+			Parameters:  params,
+		}
+	}
+
+	tests := []struct {
+		name          string
+		policy        Policy
+		sc            *storagev1.StorageClass
+		expectedError string
+	}{
+		{
+			name:   "empty policy",
+			policy: Policy{},
+			sc:     newSC(map[string]string{"type": "gp2", "foo": "bar"}),
+		},
+		{
+			name:   "other provisioner",
+			policy: Policy{RequireEncryption: true, ValidateParameters: true},
+			sc:     &storagev1.StorageClass{Provisioner: "other.csi.example.com", Parameters: map[string]string{"foo": "bar"}},
+		},
+		{
+			name:          "encryption required",
+			policy:        Policy{RequireEncryption: true},
+			sc:            newSC(map[string]string{"type": "gp3", "encrypted": "false"}),
+			expectedError: `parameter "encrypted" must be "true"`,
+		},
+		{
+			name:   "encrypted",
+			policy: Policy{RequireEncryption: true},
+			sc:     newSC(map[string]string{"type": "gp3", "Encrypted": "true"}),
+		},
+		{
+			name:          "type not allowed",
+			policy:        Policy{AllowedTypes: []string{"gp3", "io2"}},
+			sc:            newSC(map[string]string{"type": "gp2"}),
+			expectedError: `volume type "gp2" is not allowed`,
+		},
+		{
+			name:   "default type",
+			policy: Policy{AllowedTypes: []string{"gp3"}},
+			sc:     newSC(nil),
+		},
+		{
+			name:          "KMS key required",
+			policy:        Policy{RequireKMSKey: true},
+			sc:            newSC(map[string]string{"encrypted": "true"}),
+			expectedError: `parameter "kmsKeyId" is required`,
+		},
+		{
+			name:          "KMS key not allowed",
+			policy:        Policy{AllowedKMSKeys: []string{key}},
+			sc:            newSC(map[string]string{"encrypted": "true", "kmsKeyId": key + "-other"}),
+			expectedError: "is not allowed",
+		},
+		{
+			name:   "allowed KMS key",
+			policy: Policy{RequireKMSKey: true, AllowedKMSKeys: []string{key}},
+			sc:     newSC(map[string]string{"encrypted": "true", "kmsKeyId": key}),
+		},
+		{
+			name:   "valid parameters",
+			policy: Policy{ValidateParameters: true},
+			sc: newSC(map[string]string{
+				"type":                       "io2",
+				"iopsPerGB":                  "50",
+				"allowAutoIOPSPerGBIncrease": "true",
+				"blockExpress":               "true",
+				"encrypted":                  "true",
+				"kmsKeyId":                   key,
+				"csi.storage.k8s.io/fstype":  "xfs",
+				"tagSpecification_1":         "team=storage",
+			}),
+		},
+		{
+			name:          "unknown parameter",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"type": "gp3", "iopsPerGiB": "10"}),
+			expectedError: `unknown parameter "iopspergib"`,
+		},
+		{
+			name:          "invalid boolean",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"encrypted": "yes"}),
+			expectedError: `parameter "encrypted" must be a boolean`,
+		},
+		{
+			name:          "gp3 IOPS out of range",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"type": "gp3", "iops": "20000"}),
+			expectedError: "iops 20000 of volume type gp3 must be between 3000 and 16000",
+		},
+		{
+			name:          "IOPS of gp2",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"type": "gp2", "iops": "3000"}),
+			expectedError: `volume type gp2 does not support parameter "iops"`,
+		},
+		{
+			name:          "throughput of io1",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"type": "io1", "iops": "1000", "throughput": "250"}),
+			expectedError: `volume type io1 does not support parameter "throughput"`,
+		},
+		{
+			name:          "io1 IOPS per GB",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"type": "io1", "iopsPerGB": "100"}),
+			expectedError: "iopsPerGB 100 of volume type io1 must be at most 50",
+		},
+		{
+			name:          "unknown type",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"type": "gp4"}),
+			expectedError: `unknown volume type "gp4"`,
+		},
+		{
+			name:          "KMS key without encryption",
+			policy:        Policy{ValidateParameters: true},
+			sc:            newSC(map[string]string{"kmsKeyId": key}),
+			expectedError: `parameter "kmsKeyId" requires "encrypted": "true"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Validate(test.sc)
+			switch {
+			case test.expectedError == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)):
+				t.Errorf("expected error %q, got %v", test.expectedError, err)
+			}
+		})
+	}
+}
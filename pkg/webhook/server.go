@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ValidateStorageClassPath is the path of the StorageClass validation in the ValidatingWebhookConfiguration.
+	ValidateStorageClassPath = "/validate-storageclass"
+	// HealthzPath is the path of the liveness and readiness probes.
+	HealthzPath = "/healthz"
+
+	// maxRequestSize limits the size of AdmissionReviews, StorageClasses are small.
+	maxRequestSize = 1 << 20
+)
+
+var storageClassResource = metav1.GroupVersionResource{Group: "storage.k8s.io", Version: "v1", Resource: "storageclasses"}
+
+// Options are the options of the webhook server.
+type Options struct {
+	// Port is the HTTPS port of the server.
+	Port int
+	// CertFile and KeyFile are the serving certificate and its private key. They are reloaded when they change.
+	CertFile string
+	KeyFile  string
+	// Policy is validated against the created StorageClasses.
+	Policy *Policy
+}
+
+// Run serves the StorageClass validation until the context is done.
+func Run(ctx context.Context, options Options) error {
+	cert, err := dynamiccertificates.NewDynamicServingContentFromFiles("serving-cert", options.CertFile, options.KeyFile)
+	if err != nil {
+		return err
+	}
+	servingCert := &servingCertificate{content: cert}
+	if err := servingCert.load(); err != nil {
+		return err
+	}
+	cert.AddListener(servingCert)
+	go cert.Run(ctx, 1)
+
+	mux := http.NewServeMux()
+	mux.Handle(ValidateStorageClassPath, NewHandler(options.Policy))
+	mux.HandleFunc(HealthzPath, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", options.Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: servingCert.getCertificate,
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	klog.Infof("Serving StorageClass validation on %s", server.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// servingCertificate keeps the parsed serving certificate, service-ca rotates it in the mounted Secret.
+type servingCertificate struct {
+	content *dynamiccertificates.DynamicCertKeyPairContent
+	cert    atomic.Pointer[tls.Certificate]
+}
+
+func (s *servingCertificate) load() error {
+	cert, err := tls.X509KeyPair(s.content.CurrentCertKeyContent())
+	if err != nil {
+		return fmt.Errorf("failed to load the serving certificate: %w", err)
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+// Enqueue is called when the certificate files change.
+func (s *servingCertificate) Enqueue() {
+	if err := s.load(); err != nil {
+		klog.Error(err)
+	}
+}
+
+func (s *servingCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// handler validates the StorageClasses of AdmissionReviews against the policy.
+type handler struct {
+	policy *Policy
+}
+
+// NewHandler returns the http.Handler of the admission/v1 AdmissionReviews of StorageClasses.
+func NewHandler(policy *Policy) http.Handler {
+	return &handler{policy: policy}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = h.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	response, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func (h *handler) review(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if request.Resource != storageClassResource {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	sc := &storagev1.StorageClass{}
+	if err := json.Unmarshal(request.Object.Raw, sc); err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusBadRequest,
+				Reason:  metav1.StatusReasonBadRequest,
+				Message: fmt.Sprintf("failed to decode the StorageClass: %v", err),
+			},
+		}
+	}
+	if err := h.policy.Validate(sc); err != nil {
+		klog.V(2).Infof("Rejected StorageClass %s: %v", sc.Name, err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusForbidden,
+				Reason:  metav1.StatusReasonForbidden,
+				Message: fmt.Sprintf("StorageClass %s violates the policy of the %s StorageClasses: %v", sc.Name, provisioner, err),
+			},
+		}
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
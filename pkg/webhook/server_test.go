@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestHandler(t *testing.T) {
+	newReview := func(resource metav1.GroupVersionResource, sc *storagev1.StorageClass) *admissionv1.AdmissionReview {
+		raw, _ := json.Marshal(sc)
+		return &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "uid",
+				Resource:  resource,
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		}
+	}
+	newSC := func(provisionerName, encrypted string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "test"},
+			Provisioner: provisionerName,
+			Parameters:  map[string]string{"encrypted": encrypted},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		review          *admissionv1.AdmissionReview
+		expectedAllowed bool
+		expectedCode    int32
+	}{
+		{
+			name:            "compliant StorageClass",
+			review:          newReview(storageClassResource, newSC(provisioner, "true")),
+			expectedAllowed: true,
+		},
+		{
+			name:         "policy violation",
+			review:       newReview(storageClassResource, newSC(provisioner, "false")),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:            "other provisioner",
+			review:          newReview(storageClassResource, newSC("other.csi.example.com", "false")),
+			expectedAllowed: true,
+		},
+		{
+			name:            "other resource",
+			review:          newReview(metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"}, newSC(provisioner, "false")),
+			expectedAllowed: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, _ := json.Marshal(test.review)
+			recorder := httptest.NewRecorder()
+			NewHandler(&Policy{RequireEncryption: true}).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, ValidateStorageClassPath, bytes.NewReader(body)))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			review := &admissionv1.AdmissionReview{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), review); err != nil {
+				t.Fatalf("failed to parse the response: %v", err)
+			}
+			response := review.Response
+			if response == nil || response.UID != "uid" {
+				t.Fatalf("unexpected response %+v", response)
+			}
+			if response.Allowed != test.expectedAllowed {
+				t.Errorf("expected allowed %t, got %t", test.expectedAllowed, response.Allowed)
+			}
+			if !test.expectedAllowed && (response.Result == nil || response.Result.Code != test.expectedCode) {
+				t.Errorf("expected code %d, got %+v", test.expectedCode, response.Result)
+			}
+		})
+	}
+}